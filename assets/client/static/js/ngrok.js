@@ -132,13 +132,36 @@ ngrok.factory("txnSvc", function() {
             return String(Math.round(value * power) / power);
         }
         // parse nanosecond count
-        var ns = txn.Duration;
-        var ms = ns / (1000 * 1000);
-        txn.Duration = ms;
-        if (ms > 1000) {
-            txn.Duration = toFixed(ms / 1000, 2) + "s";
-        } else {
-            txn.Duration = toFixed(ms, 2) + "ms";
+        var formatNs = function(ns) {
+            var ms = ns / (1000 * 1000);
+            if (ms > 1000) {
+                return toFixed(ms / 1000, 2) + "s";
+            } else {
+                return toFixed(ms, 2) + "ms";
+            }
+        };
+        txn.Duration = formatNs(txn.Duration);
+
+        // the phases one after the other, with their share of the time the
+        // visitor waited
+        var t = txn.Timing;
+        if (!!t) {
+            var phases = [
+                { name: "Queued on the server", ns: t.Queued },
+                { name: "Connecting to the local service", ns: t.Dial },
+                { name: "Waiting for the first byte", ns: t.FirstByte },
+                { name: "Receiving the response", ns: Math.max(t.Total - t.FirstByte, 0) }
+            ];
+            var total = t.Queued + t.Dial + t.Total;
+            var offset = 0;
+            phases.forEach(function(p) {
+                p.left = total > 0 ? 100 * offset / total : 0;
+                p.width = total > 0 ? Math.max(100 * p.ns / total, 0.5) : 0;
+                p.duration = formatNs(p.ns);
+                offset += p.ns;
+            });
+            txn.Phases = phases;
+            txn.PhasesTotal = formatNs(total);
         }
     };
 
@@ -169,6 +192,10 @@ ngrok.factory("txnSvc", function() {
                 activate(txns[0]);
             }
         },
+        addOlder: function(txn) {
+            preprocessTxn(txn);
+            txns.push(txn);
+        },
         all: function() {
             return txns;
         },
@@ -181,6 +208,13 @@ ngrok.factory("txnSvc", function() {
         },
         isActive: function(txn) {
             return !!active && txn.Id == active.Id;
+        },
+        byId: function(id) {
+            for (var i=0; i<txns.length; i++) {
+                if (txns[i].Id == id) {
+                    return txns[i];
+                }
+            }
         }
     };
 });
@@ -302,10 +336,23 @@ ngrok.directive({
 });
 
 ngrok.controller({
-    "HttpTxns": function($scope, txnSvc) {
+    "HttpTxns": function($scope, $http, txnSvc) {
         $scope.tunnels = window.data.UiState.Tunnels;
         $scope.txns = txnSvc.all();
 
+        // older requests are loaded page by page from the history
+        var before = 0;
+        $scope.moreHistory = window.data.UiState.History;
+        $scope.loadOlder = function() {
+            $http.get("/http/in/history", { params: { before: before, limit: 20 } }).success(function(page) {
+                page.Txns.forEach(function(t) {
+                    txnSvc.addOlder(t);
+                });
+                before = page.Next;
+                $scope.moreHistory = page.Next != 0;
+            });
+        };
+
         if (!!window.WebSocket) {
             var ws = new WebSocket("ws://" + location.host + "/_ws");
             ws.onopen = function() {
@@ -337,6 +384,20 @@ ngrok.controller({
                 data: { txnid: txnSvc.active().Id }
             });
         }
+        $scope.selectCurl = function($event) {
+            // select the whole command so it can be copied at once
+            var range = document.createRange();
+            range.selectNodeContents($event.currentTarget);
+            var selection = window.getSelection();
+            selection.removeAllRanges();
+            selection.addRange(range);
+        }
+        $scope.tokenExpired = function(token) {
+            return !!token.Expires && token.Expires * 1000 < Date.now();
+        }
+        $scope.tokenNotYetValid = function(token) {
+            return !!token.NotBefore && token.NotBefore * 1000 > Date.now();
+        }
         var setReq = function() {
             var txn = txnSvc.active();
             if (!!txn && txn.Req) {
@@ -360,6 +421,34 @@ ngrok.controller({
         $scope.$watch(function() { return txnSvc.active() }, setResp);
     },
 
+    "HttpDiff": function($scope, txnSvc) {
+        $scope.showOriginal = function() {
+            var orig = txnSvc.byId($scope.Diff.OriginalId);
+            if (!!orig) {
+                txnSvc.active(orig);
+            }
+        };
+        var setDiff = function() {
+            var txn = txnSvc.active();
+            if (!!txn && txn.Diff) {
+                $scope.Diff = txn.Diff;
+            } else {
+                $scope.Diff = null;
+            }
+        };
+        $scope.$watch(function() { return txnSvc.active() }, setDiff);
+    },
+
+    "Stats": function($scope, $http, $timeout) {
+        var poll = function() {
+            $http.get("/api/stats").success(function(data) {
+                $scope.stats = data;
+            });
+            $timeout(poll, 5000);
+        };
+        poll();
+    },
+
     "TxnNavItem": function($scope, txnSvc) {
         $scope.isActive = function() { return txnSvc.isActive($scope.txn); }
         $scope.makeActive = function() {
@@ -378,6 +467,9 @@ ngrok.controller({
             }
         };
 
+        // tokens can expire in the future
+        $.timeago.settings.allowFuture = true;
+
         $scope.TimeFormat = function(ts) {
             if (!!ts) {
                 return $.timeago($scope.ISO8601(ts));
@@ -32,6 +32,35 @@ type LRUCache struct {
 
 	// How many bytes we are limiting the cache to.
 	capacity uint64
+
+	// How long entries live after they're set, forever if 0.
+	ttl time.Duration
+
+	// Which entries are evicted first when the cache is full.
+	policy EvictionPolicy
+
+	hits, misses, evictions uint64
+}
+
+type EvictionPolicy int
+
+const (
+	// evict the least recently used entry
+	EvictLRU EvictionPolicy = iota
+
+	// evict the least recently set entry, reads don't count
+	EvictFIFO
+)
+
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "lru":
+		return EvictLRU, nil
+	case "fifo":
+		return EvictFIFO, nil
+	default:
+		return EvictLRU, fmt.Errorf("Unknown eviction policy %s, must be one of: lru, fifo", name)
+	}
 }
 
 // Values that go into LRUCache need to satisfy this interface.
@@ -49,6 +78,7 @@ type entry struct {
 	value         Value
 	size          int
 	time_accessed time.Time
+	time_set      time.Time
 }
 
 func NewLRUCache(capacity uint64) *LRUCache {
@@ -65,9 +95,23 @@ func (lru *LRUCache) Get(key string) (v Value, ok bool) {
 
 	element := lru.table[key]
 	if element == nil {
+		lru.misses++
 		return nil, false
 	}
-	lru.moveToFront(element)
+
+	if lru.expired(element.Value.(*entry)) {
+		lru.remove(element)
+		lru.misses++
+		lru.evictions++
+		return nil, false
+	}
+
+	lru.hits++
+	if lru.policy == EvictFIFO {
+		element.Value.(*entry).time_accessed = time.Now()
+	} else {
+		lru.moveToFront(element)
+	}
 	return element.Value.(*entry).value, true
 }
 
@@ -102,9 +146,7 @@ func (lru *LRUCache) Delete(key string) bool {
 		return false
 	}
 
-	lru.list.Remove(element)
-	delete(lru.table, key)
-	lru.size -= uint64(element.Value.(*entry).size)
+	lru.remove(element)
 	return true
 }
 
@@ -117,6 +159,30 @@ func (lru *LRUCache) Clear() {
 	lru.size = 0
 }
 
+// Sets how long entries live after they're set, 0 for forever
+func (lru *LRUCache) SetTTL(ttl time.Duration) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.ttl = ttl
+}
+
+func (lru *LRUCache) SetEvictionPolicy(policy EvictionPolicy) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	lru.policy = policy
+}
+
+// Returns how many lookups found an entry and how many didn't, and how many
+// entries were evicted for lack of space or because they expired
+func (lru *LRUCache) Counters() (hits, misses, evictions uint64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	return lru.hits, lru.misses, lru.evictions
+}
+
 func (lru *LRUCache) SetCapacity(capacity uint64) {
 	lru.mu.Lock()
 	defer lru.mu.Unlock()
@@ -139,7 +205,8 @@ func (lru *LRUCache) StatsJSON() string {
 		return "{}"
 	}
 	l, s, c, o := lru.Stats()
-	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v, \"OldestAccess\": \"%v\"}", l, s, c, o)
+	h, m, e := lru.Counters()
+	return fmt.Sprintf("{\"Length\": %v, \"Size\": %v, \"Capacity\": %v, \"OldestAccess\": \"%v\", \"Hits\": %v, \"Misses\": %v, \"Evictions\": %v}", l, s, c, o, h, m, e)
 }
 
 func (lru *LRUCache) Keys() []string {
@@ -148,7 +215,9 @@ func (lru *LRUCache) Keys() []string {
 
 	keys := make([]string, 0, lru.list.Len())
 	for e := lru.list.Front(); e != nil; e = e.Next() {
-		keys = append(keys, e.Value.(*entry).key)
+		if !lru.expired(e.Value.(*entry)) {
+			keys = append(keys, e.Value.(*entry).key)
+		}
 	}
 	return keys
 }
@@ -160,7 +229,9 @@ func (lru *LRUCache) Items() []Item {
 	items := make([]Item, 0, lru.list.Len())
 	for e := lru.list.Front(); e != nil; e = e.Next() {
 		v := e.Value.(*entry)
-		items = append(items, Item{Key: v.key, Value: v.value})
+		if !lru.expired(v) {
+			items = append(items, Item{Key: v.key, Value: v.value})
+		}
 	}
 	return items
 }
@@ -215,6 +286,7 @@ func (lru *LRUCache) updateInplace(element *list.Element, value Value) {
 	sizeDiff := valueSize - element.Value.(*entry).size
 	element.Value.(*entry).value = value
 	element.Value.(*entry).size = valueSize
+	element.Value.(*entry).time_set = time.Now()
 	lru.size += uint64(sizeDiff)
 	lru.moveToFront(element)
 	lru.checkCapacity()
@@ -226,7 +298,8 @@ func (lru *LRUCache) moveToFront(element *list.Element) {
 }
 
 func (lru *LRUCache) addNew(key string, value Value) {
-	newEntry := &entry{key, value, value.Size(), time.Now()}
+	now := time.Now()
+	newEntry := &entry{key, value, value.Size(), now, now}
 	element := lru.list.PushFront(newEntry)
 	lru.table[key] = element
 	lru.size += uint64(newEntry.size)
@@ -234,12 +307,18 @@ func (lru *LRUCache) addNew(key string, value Value) {
 }
 
 func (lru *LRUCache) checkCapacity() {
-	// Partially duplicated from Delete
 	for lru.size > lru.capacity {
-		delElem := lru.list.Back()
-		delValue := delElem.Value.(*entry)
-		lru.list.Remove(delElem)
-		delete(lru.table, delValue.key)
-		lru.size -= uint64(delValue.size)
+		lru.remove(lru.list.Back())
+		lru.evictions++
 	}
 }
+
+func (lru *LRUCache) remove(element *list.Element) {
+	lru.list.Remove(element)
+	delete(lru.table, element.Value.(*entry).key)
+	lru.size -= uint64(element.Value.(*entry).size)
+}
+
+func (lru *LRUCache) expired(e *entry) bool {
+	return lru.ttl > 0 && time.Since(e.time_set) > lru.ttl
+}
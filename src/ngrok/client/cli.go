@@ -3,6 +3,7 @@ package client
 import (
 	"flag"
 	"fmt"
+	"ngrok/log"
 	"ngrok/version"
 	"os"
 )
@@ -17,19 +18,24 @@ Examples:
 	ngrok -subdomain=example 8080
 	ngrok -proto=tcp 22
 	ngrok -hostname="example.com" -httpauth="user:password" 10.0.0.1
+	ngrok -proto=socks -httpauth="user:password"
 
 
 Advanced usage: ngrok [OPTIONS] <command> [command args] [...]
 Commands:
 	ngrok start [tunnel] [...]    Start tunnels by name from config file
 	ngrok list                    List tunnel names from config file
+	ngrok status                  Print the running client's tunnels as JSON
 	ngrok help                    Print help
 	ngrok version                 Print ngrok version
+	ngrok service <command> [...] Install, uninstall, start or stop the Windows service
 
 Examples:
 	ngrok start www api blog pubsub
 	ngrok -log=stdout -config=ngrok.yml start ssh
+	ngrok -json -log=ngrok.log start www
 	ngrok version
+	ngrok service install -config=C:\ngrok\ngrok.yml start www
 
 `
 
@@ -42,6 +48,7 @@ type Options struct {
 	hostname  string
 	protocol  string
 	subdomain string
+	json      bool
 	command   string
 	args      []string
 }
@@ -66,7 +73,7 @@ func ParseArgs() (opts *Options, err error) {
 	loglevel := flag.String(
 		"log-level",
 		"DEBUG",
-		"The level of messages to log. One of: DEBUG, INFO, WARNING, ERROR")
+		"The level of messages to log. One of: DEBUG, INFO, WARNING, ERROR. Subsystems can have their own, e.g. INFO,control=DEBUG,proxy=WARNING,web=DEBUG")
 
 	authtoken := flag.String(
 		"authtoken",
@@ -76,7 +83,7 @@ func ParseArgs() (opts *Options, err error) {
 	httpauth := flag.String(
 		"httpauth",
 		"",
-		"username:password HTTP basic auth creds protecting the public tunnel endpoint")
+		"username:password HTTP basic auth (or SOCKS5 auth) creds protecting the public tunnel endpoint")
 
 	subdomain := flag.String(
 		"subdomain",
@@ -91,10 +98,24 @@ func ParseArgs() (opts *Options, err error) {
 	protocol := flag.String(
 		"proto",
 		"http+https",
-		"The protocol of the traffic over the tunnel {'http', 'https', 'tcp'} (default: 'http+https')")
+		"The protocol of the traffic over the tunnel {'http', 'https', 'tcp', 'socks'} (default: 'http+https')")
+
+	json := flag.Bool(
+		"json",
+		false,
+		"Write events like tunnel_established, reconnecting and request to stdout as JSON, one per line, instead of showing the terminal interface")
 
 	flag.Parse()
 
+	if _, _, err = log.ParseLevels(*loglevel); err != nil {
+		return
+	}
+
+	if *json && *logto == "stdout" {
+		err = fmt.Errorf("-json writes events to stdout, log to a file instead")
+		return
+	}
+
 	opts = &Options{
 		config:    *config,
 		logto:     *logto,
@@ -104,6 +125,7 @@ func ParseArgs() (opts *Options, err error) {
 		protocol:  *protocol,
 		authtoken: *authtoken,
 		hostname:  *hostname,
+		json:      *json,
 		command:   flag.Arg(0),
 	}
 
@@ -112,6 +134,9 @@ func ParseArgs() (opts *Options, err error) {
 		opts.args = flag.Args()[1:]
 	case "start":
 		opts.args = flag.Args()[1:]
+	case "service":
+		opts.args = flag.Args()[1:]
+	case "status":
 	case "version":
 		fmt.Println(version.MajorMinor())
 		os.Exit(0)
@@ -119,6 +144,12 @@ func ParseArgs() (opts *Options, err error) {
 		flag.Usage()
 		os.Exit(0)
 	case "":
+		// socks tunnels don't need a local address
+		if opts.protocol == "socks" {
+			opts.command = "default"
+			return
+		}
+
 		err = fmt.Errorf("Error: Specify a local port to tunnel to, or " +
 			"an ngrok command.\n\nExample: To expose port 80, run " +
 			"'ngrok 80'")
@@ -1,29 +1,82 @@
 package client
 
 import (
+	"crypto/rsa"
+	"crypto/tls"
 	"fmt"
 	"gopkg.in/yaml.v1"
 	"io/ioutil"
 	"net"
 	"net/url"
+	"ngrok/conn"
 	"ngrok/log"
+	"ngrok/util"
 	"os"
 	"os/user"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// socks tunnels may connect anywhere unless configured otherwise
+const defaultSocksNetworks = "0.0.0.0/0,::/0"
+
 type Configuration struct {
 	HttpProxy          string                          `yaml:"http_proxy,omitempty"`
 	ServerAddr         string                          `yaml:"server_addr,omitempty"`
 	InspectAddr        string                          `yaml:"inspect_addr,omitempty"`
 	TrustHostRootCerts bool                            `yaml:"trust_host_root_certs,omitempty"`
 	AuthToken          string                          `yaml:"auth_token,omitempty"`
+	Reconnect          *ReconnectConfiguration         `yaml:"reconnect,omitempty"`
+	DNSServers         []string                        `yaml:"dns_servers,omitempty"`
+	Hosts              map[string]string               `yaml:"hosts,omitempty"`
 	Tunnels            map[string]*TunnelConfiguration `yaml:"tunnels,omitempty"`
 	LogTo              string                          `yaml:"-"`
+	Json               bool                            `yaml:"-"`
 	Path               string                          `yaml:"-"`
+
+	// socket options of control, proxy and local connections,
+	// e.g. control: "keepalive=30s,nodelay=false,readbuf=262144"
+	SocketOptions map[string]string `yaml:"socket_options,omitempty"`
+
+	// update from a self-hosted release server instead of the hosted channel,
+	// only accepting releases signed with the key in update_public_key
+	UpdateUrl       string `yaml:"update_url,omitempty"`
+	UpdatePublicKey string `yaml:"update_public_key,omitempty"`
+
+	// keep the requests that drop out of the web interface on disk
+	History *HistoryConfiguration `yaml:"history,omitempty"`
+
+	socketOptions map[string]*conn.SocketOptions
+	updateKey     *rsa.PublicKey
+}
+
+type ReconnectConfiguration struct {
+	// give up after this many consecutive failed attempts, 0 retries forever
+	MaxRetries int `yaml:"max_retries,omitempty"`
+
+	// initial and maximum delay between attempts, e.g. "1s" or "5m"
+	BaseDelay string `yaml:"base_delay,omitempty"`
+	MaxDelay  string `yaml:"max_delay,omitempty"`
+
+	// randomize each delay by up to this fraction of itself (0.0 - 1.0)
+	Jitter float64 `yaml:"jitter,omitempty"`
+
+	// keep retrying even when the server rejects our authentication or tunnels
+	Forever bool `yaml:"forever,omitempty"`
+
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+type HistoryConfiguration struct {
+	// the history file, ~/.ngrok-history by default
+	Path string `yaml:"path,omitempty"`
+
+	// how many requests are kept, the oldest are dropped first
+	MaxRequests int `yaml:"max_requests,omitempty"`
 }
 
 type TunnelConfiguration struct {
@@ -32,6 +85,68 @@ type TunnelConfiguration struct {
 	Protocols  map[string]string `yaml:"proto,omitempty"`
 	HttpAuth   string            `yaml:"auth,omitempty"`
 	RemotePort uint16            `yaml:"remote_port,omitempty"`
+
+	// tcp and socks only, which of the server's public IPs to bind remote_port on
+	RemoteIp string `yaml:"remote_ip,omitempty"`
+
+	// http only, let the server cache responses that allow it
+	Cache bool `yaml:"cache,omitempty"`
+
+	// http only, let the server handle CORS for any origin or the listed ones
+	Cors        bool     `yaml:"cors,omitempty"`
+	CorsOrigins []string `yaml:"cors_origins,omitempty"`
+
+	// tcp only, let the server terminate TLS with its certificate
+	Tls bool `yaml:"tls,omitempty"`
+
+	// send a PROXY protocol header with the visitor's address to the local service
+	ProxyProtocol bool `yaml:"proxy_protocol,omitempty"`
+
+	// how long a proxied connection may stay idle before the server closes it, e.g. "2h"
+	IdleTimeout string `yaml:"idle_timeout,omitempty"`
+
+	// http only, rewrites of request paths applied in order before they're forwarded
+	Rewrite []*RewriteConfiguration `yaml:"rewrite,omitempty"`
+
+	// http only, point the local service's redirects to localhost at the public URL
+	RewriteLocation bool `yaml:"rewrite_location,omitempty"`
+
+	// http only, send the requests for these path prefixes to other local
+	// services, e.g. /api: 8080. Other requests go to the tunnel's address
+	Paths map[string]string `yaml:"paths,omitempty"`
+
+	// http only, connect to the local service with TLS, e.g. to present a
+	// client certificate to a service that requires one
+	LocalTls *LocalTlsConfiguration `yaml:"local_tls,omitempty"`
+
+	idleTimeout time.Duration
+}
+
+// How to connect to a local https service. The certificate and key are only
+// needed if the service asks for a client certificate.
+type LocalTlsConfiguration struct {
+	Cert string `yaml:"cert,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+
+	// verify the service's certificate against this CA instead of the system's
+	Ca string `yaml:"ca,omitempty"`
+
+	// the name in the service's certificate, the host of the local address by default
+	ServerName string `yaml:"server_name,omitempty"`
+
+	// don't verify the service's certificate at all, e.g. for a self-signed one
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+
+	config *tls.Config
+}
+
+// One rewrite of request paths, e.g. strip_prefix: /api, add_prefix: /myapp
+// or match: ^/old/(.*) with replace: /new/$1
+type RewriteConfiguration struct {
+	StripPrefix string `yaml:"strip_prefix,omitempty"`
+	AddPrefix   string `yaml:"add_prefix,omitempty"`
+	Match       string `yaml:"match,omitempty"`
+	Replace     string `yaml:"replace,omitempty"`
 }
 
 func LoadConfiguration(opts *Options) (config *Configuration, err error) {
@@ -80,6 +195,28 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 		config.HttpProxy = os.Getenv("http_proxy")
 	}
 
+	if config.Reconnect == nil {
+		config.Reconnect = new(ReconnectConfiguration)
+	}
+
+	if config.Reconnect.BaseDelay == "" {
+		config.Reconnect.BaseDelay = "1s"
+	}
+
+	if config.Reconnect.MaxDelay == "" {
+		config.Reconnect.MaxDelay = "30s"
+	}
+
+	if config.History != nil {
+		if config.History.Path == "" {
+			config.History.Path = defaultPath() + "-history"
+		}
+
+		if config.History.MaxRequests == 0 {
+			config.History.MaxRequests = 10000
+		}
+	}
+
 	// validate and normalize configuration
 	if config.InspectAddr != "disabled" {
 		if config.InspectAddr, err = normalizeAddress(config.InspectAddr, "inspect_addr"); err != nil {
@@ -91,6 +228,38 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 		return
 	}
 
+	if err = normalizeReconnect(config.Reconnect); err != nil {
+		return
+	}
+
+	if config.History != nil && config.History.MaxRequests < 0 {
+		err = fmt.Errorf("Invalid history max_requests %d, must be positive", config.History.MaxRequests)
+		return
+	}
+
+	for i, server := range config.DNSServers {
+		if config.DNSServers[i], err = normalizeDNSServer(server); err != nil {
+			return
+		}
+	}
+
+	for host, ip := range config.Hosts {
+		if net.ParseIP(ip) == nil {
+			err = fmt.Errorf("Invalid IP address for host %s: '%s'", host, ip)
+			return
+		}
+	}
+
+	if config.socketOptions, err = parseSocketOptions(config.SocketOptions); err != nil {
+		return
+	}
+
+	if config.UpdateUrl != "" {
+		if config.updateKey, err = loadUpdateKey(config.UpdateUrl, config.UpdatePublicKey); err != nil {
+			return
+		}
+	}
+
 	if config.HttpProxy != "" {
 		var proxyUrl *url.URL
 		if proxyUrl, err = url.Parse(config.HttpProxy); err != nil {
@@ -103,6 +272,7 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 		}
 	}
 
+	vars := newTemplateData()
 	for name, t := range config.Tunnels {
 		if t == nil || t.Protocols == nil || len(t.Protocols) == 0 {
 			err = fmt.Errorf("Tunnel %s does not specify any protocols to tunnel.", name)
@@ -111,13 +281,83 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 
 		for k, addr := range t.Protocols {
 			tunnelName := fmt.Sprintf("for tunnel %s[%s]", name, k)
-			if t.Protocols[k], err = normalizeAddress(addr, tunnelName); err != nil {
+			if t.Protocols[k], err = normalizeTunnelAddress(k, addr, tunnelName); err != nil {
 				return
 			}
 
 			if err = validateProtocol(k, tunnelName); err != nil {
 				return
 			}
+
+			if t.Tls && k != "tcp" {
+				err = fmt.Errorf("Invalid protocol %s for tunnel %s, TLS termination is only supported for tcp tunnels", k, name)
+				return
+			}
+
+			if err = validateSocksAuth(k, t.HttpAuth, tunnelName); err != nil {
+				return
+			}
+
+			if t.RemoteIp != "" && k != "tcp" && k != "socks" {
+				err = fmt.Errorf("Invalid protocol %s for tunnel %s, remote_ip is only supported for tcp and socks tunnels", k, name)
+				return
+			}
+
+			if len(t.Paths) > 0 && k != "http" && k != "https" {
+				err = fmt.Errorf("Invalid protocol %s for tunnel %s, paths are only supported for http(s) tunnels", k, name)
+				return
+			}
+
+			if (len(t.Rewrite) > 0 || t.RewriteLocation) && k != "http" && k != "https" {
+				err = fmt.Errorf("Invalid protocol %s for tunnel %s, rewrite rules are only supported for http(s) tunnels", k, name)
+				return
+			}
+
+			if t.LocalTls != nil && k != "http" && k != "https" {
+				err = fmt.Errorf("Invalid protocol %s for tunnel %s, local_tls is only supported for http(s) tunnels", k, name)
+				return
+			}
+		}
+
+		if t.RemoteIp != "" && net.ParseIP(t.RemoteIp) == nil {
+			err = fmt.Errorf("Invalid remote_ip %s for tunnel %s", t.RemoteIp, name)
+			return
+		}
+
+		if t.LocalTls != nil {
+			if t.LocalTls.config, err = loadLocalTls(t.LocalTls); err != nil {
+				err = fmt.Errorf("Invalid local_tls for tunnel %s: %v", name, err)
+				return
+			}
+		}
+
+		for prefix, addr := range t.Paths {
+			if !strings.HasPrefix(prefix, "/") {
+				err = fmt.Errorf("Invalid path '%s' for tunnel %s, paths must start with /", prefix, name)
+				return
+			}
+
+			if t.Paths[prefix], err = normalizeTunnelAddress("http", addr, fmt.Sprintf("for path %s of tunnel %s", prefix, name)); err != nil {
+				return
+			}
+		}
+
+		for i, r := range t.Rewrite {
+			if err = validateRewrite(r); err != nil {
+				err = fmt.Errorf("Invalid rewrite rule %d for tunnel %s: %v", i+1, name, err)
+				return
+			}
+		}
+
+		if t.IdleTimeout != "" {
+			if t.idleTimeout, err = time.ParseDuration(t.IdleTimeout); err != nil || t.idleTimeout < time.Second {
+				err = fmt.Errorf("Invalid idle_timeout '%s' for tunnel %s, expected a duration of at least 1s", t.IdleTimeout, name)
+				return
+			}
+		}
+
+		if err = expandHostTemplates(t, vars, name); err != nil {
+			return
 		}
 
 		// use the name of the tunnel as the subdomain if none is specified
@@ -134,6 +374,7 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 
 	// override configuration with command-line options
 	config.LogTo = opts.logto
+	config.Json = opts.json
 	config.Path = configPath
 	if opts.authtoken != "" {
 		config.AuthToken = opts.authtoken
@@ -150,12 +391,25 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 			Protocols: make(map[string]string),
 		}
 
+		if err = expandHostTemplates(config.Tunnels["default"], vars, "default"); err != nil {
+			return
+		}
+
 		for _, proto := range strings.Split(opts.protocol, "+") {
 			if err = validateProtocol(proto, "default"); err != nil {
 				return
 			}
 
-			if config.Tunnels["default"].Protocols[proto], err = normalizeAddress(opts.args[0], ""); err != nil {
+			var addr string
+			if len(opts.args) > 0 {
+				addr = opts.args[0]
+			}
+
+			if config.Tunnels["default"].Protocols[proto], err = normalizeTunnelAddress(proto, addr, ""); err != nil {
+				return
+			}
+
+			if err = validateSocksAuth(proto, opts.httpauth, "for tunnel default"); err != nil {
 				return
 			}
 		}
@@ -167,6 +421,10 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 		}
 		os.Exit(0)
 
+	// report on the client that's already running
+	case "status":
+		os.Exit(printStatus(config.InspectAddr))
+
 	// start tunnels
 	case "start":
 		if len(opts.args) == 0 {
@@ -198,6 +456,38 @@ func LoadConfiguration(opts *Options) (config *Configuration, err error) {
 	return
 }
 
+func expandHostTemplates(t *TunnelConfiguration, vars *templateData, name string) (err error) {
+	if t.Subdomain, err = expandHostTemplate(t.Subdomain, vars); err != nil {
+		return fmt.Errorf("Invalid subdomain template for tunnel %s: %v", name, err)
+	}
+
+	if t.Hostname, err = expandHostTemplate(t.Hostname, vars); err != nil {
+		return fmt.Errorf("Invalid hostname template for tunnel %s: %v", name, err)
+	}
+	return
+}
+
+func loadUpdateKey(updateUrl, keyPath string) (*rsa.PublicKey, error) {
+	if u, err := url.Parse(updateUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid update_url '%s', expected an http(s) URL", updateUrl)
+	}
+
+	if keyPath == "" {
+		return nil, fmt.Errorf("update_public_key is required to verify the releases from %s", updateUrl)
+	}
+
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read update_public_key %s: %v", keyPath, err)
+	}
+
+	key, err := parseUpdateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid update_public_key %s: %v", keyPath, err)
+	}
+	return key, nil
+}
+
 func defaultPath() string {
 	user, err := user.Current()
 
@@ -231,9 +521,130 @@ func normalizeAddress(addr string, propName string) (string, error) {
 	return fmt.Sprintf("%s:%s", host, port), nil
 }
 
+// DNS servers may be specified with or without a port, defaulting to 53
+func normalizeDNSServer(server string) (string, error) {
+	if ip := net.ParseIP(server); ip != nil {
+		return net.JoinHostPort(ip.String(), "53"), nil
+	}
+
+	host, port, err := net.SplitHostPort(server)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("Invalid DNS server '%s', expected an IP address with an optional port", server)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+func validateRewrite(r *RewriteConfiguration) error {
+	if r == nil {
+		return fmt.Errorf("it is empty")
+	}
+
+	kinds := 0
+	for _, v := range []string{r.StripPrefix, r.AddPrefix, r.Match} {
+		if v != "" {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("it must have exactly one of strip_prefix, add_prefix or match")
+	}
+
+	for _, prefix := range []string{r.StripPrefix, r.AddPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("prefix '%s' must start with /", prefix)
+		}
+	}
+
+	if r.Match != "" {
+		if _, err := regexp.Compile(r.Match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maps the connections named in the configuration to their types
+var socketConnTypes = map[string]string{"control": "ctl", "proxy": "pxy", "local": "prv"}
+
+func parseSocketOptions(specs map[string]string) (map[string]*conn.SocketOptions, error) {
+	parsed := make(map[string]*conn.SocketOptions)
+	for name, spec := range specs {
+		typ, ok := socketConnTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("Invalid socket_options connection '%s', expected one of: control, proxy, local", name)
+		}
+
+		opts, err := conn.ParseSocketOptions(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid socket_options for %s connections: %v", name, err)
+		}
+		parsed[typ] = opts
+	}
+	return parsed, nil
+}
+
+func normalizeReconnect(r *ReconnectConfiguration) (err error) {
+	if r.baseDelay, err = time.ParseDuration(r.BaseDelay); err != nil {
+		return fmt.Errorf("Invalid reconnect base_delay '%s': %v", r.BaseDelay, err)
+	}
+
+	if r.maxDelay, err = time.ParseDuration(r.MaxDelay); err != nil {
+		return fmt.Errorf("Invalid reconnect max_delay '%s': %v", r.MaxDelay, err)
+	}
+
+	if r.baseDelay <= 0 || r.maxDelay < r.baseDelay {
+		return fmt.Errorf("Reconnect delays must satisfy 0 < base_delay <= max_delay, got %s and %s", r.BaseDelay, r.MaxDelay)
+	}
+
+	if r.MaxRetries < 0 {
+		return fmt.Errorf("Reconnect max_retries must not be negative, got %d", r.MaxRetries)
+	}
+
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return fmt.Errorf("Reconnect jitter must be between 0 and 1, got %v", r.Jitter)
+	}
+
+	return
+}
+
+// The address of a socks tunnel is the list of networks it may connect to,
+// for every other protocol it's the local address to forward to
+func normalizeTunnelAddress(proto, addr, propName string) (string, error) {
+	if conn.IsNamedPipe(addr) && proto != "socks" {
+		if _, err := conn.PipePath(addr); err != nil {
+			return "", fmt.Errorf("Invalid named pipe %s '%s': %s", propName, addr, err.Error())
+		}
+		return addr, nil
+	}
+
+	if proto != "socks" {
+		return normalizeAddress(addr, propName)
+	}
+
+	if addr == "" {
+		return defaultSocksNetworks, nil
+	}
+
+	if _, err := util.ParseNetworks(addr); err != nil {
+		return "", fmt.Errorf("Invalid networks %s '%s': %s", propName, addr, err.Error())
+	}
+
+	return addr, nil
+}
+
+// A socks tunnel is a proxy into the client's networks that anyone who finds
+// its port could use, so it must always ask for credentials
+func validateSocksAuth(proto, auth, propName string) error {
+	if proto == "socks" && auth == "" {
+		return fmt.Errorf("Missing auth %s, socks tunnels must require a user:password (-httpauth on the command line)", propName)
+	}
+	return nil
+}
+
 func validateProtocol(proto, propName string) (err error) {
 	switch proto {
-	case "http", "https", "http+https", "tcp":
+	case "http", "https", "http+https", "tcp", "socks":
 	default:
 		err = fmt.Errorf("Invalid protocol for %s: %s", propName, proto)
 	}
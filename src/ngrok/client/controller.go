@@ -3,11 +3,14 @@ package client
 import (
 	"fmt"
 	"ngrok/client/mvc"
+	"ngrok/client/views/events"
 	"ngrok/client/views/term"
 	"ngrok/client/views/web"
 	"ngrok/log"
 	"ngrok/proto"
+	"ngrok/service"
 	"ngrok/util"
+	"os"
 	"sync"
 )
 
@@ -24,6 +27,9 @@ type cmdPlayRequest struct {
 
 	// the bytes of the request to issue
 	payload []byte
+
+	// the id of the transaction that is replayed
+	replayOf string
 }
 
 // The MVC Controller
@@ -79,8 +85,8 @@ func (ctl *Controller) Shutdown(message string) {
 	ctl.cmds <- cmdQuit{message: message}
 }
 
-func (ctl *Controller) PlayRequest(tunnel mvc.Tunnel, payload []byte) {
-	ctl.cmds <- cmdPlayRequest{tunnel: tunnel, payload: payload}
+func (ctl *Controller) PlayRequest(tunnel mvc.Tunnel, payload []byte, replayOf string) {
+	ctl.cmds <- cmdPlayRequest{tunnel: tunnel, payload: payload, replayOf: replayOf}
 }
 
 func (ctl *Controller) Go(fn func()) {
@@ -100,6 +106,7 @@ func (ctl *Controller) Go(fn func()) {
 // private functions
 func (ctl *Controller) doShutdown() {
 	ctl.Info("Shutting down")
+	util.SdNotify("STOPPING=1")
 
 	var wg sync.WaitGroup
 
@@ -122,6 +129,46 @@ func (ctl *Controller) doShutdown() {
 	wg.Wait()
 }
 
+// Tells systemd we're ready once the tunnels are online, and keeps the
+// service's status line up to date after that
+func (ctl *Controller) notifySystemd() {
+	updates := ctl.updates.Reg()
+	defer ctl.updates.UnReg(updates)
+
+	ready := false
+	last := ""
+	for obj := range updates {
+		state := obj.(mvc.State)
+
+		notice := ""
+		switch state.GetConnStatus() {
+		case mvc.ConnConnecting:
+			notice = "STATUS=Connecting to " + ctl.config.ServerAddr
+		case mvc.ConnReconnecting:
+			notice = "STATUS=Reconnecting to " + ctl.config.ServerAddr
+		case mvc.ConnOnline:
+			notice = fmt.Sprintf("STATUS=Online with %d tunnels", len(state.GetTunnels()))
+		}
+
+		if notice == last {
+			continue
+		}
+		last = notice
+
+		if !ready && state.GetConnStatus() == mvc.ConnOnline {
+			notice = "READY=1\n" + notice
+			ready = true
+		}
+
+		if ok, err := util.SdNotify(notice); !ok {
+			if err != nil {
+				ctl.Warn("Failed to notify systemd: %v", err)
+			}
+			return
+		}
+	}
+}
+
 func (ctl *Controller) AddView(v mvc.View) {
 	ctl.views = append(ctl.views, v)
 }
@@ -158,13 +205,25 @@ func (ctl *Controller) Run(config *Configuration) {
 	// init web ui
 	var webView *web.WebView
 	if config.InspectAddr != "disabled" {
-		webView = web.NewWebView(ctl, config.InspectAddr)
+		var history *web.History
+		if config.History != nil {
+			var err error
+			if history, err = web.OpenHistory(config.History.Path, config.History.MaxRequests); err != nil {
+				log.Error("Failed to open request history %s: %v", config.History.Path, err)
+			}
+		}
+
+		webView = web.NewWebView(ctl, config.InspectAddr, history)
 		ctl.AddView(webView)
 	}
 
-	// init term ui
+	// init term ui, or events for scripts instead
 	var termView *term.TermView
-	if config.LogTo != "stdout" {
+	var eventsView *events.EventsView
+	if config.Json {
+		eventsView = events.NewEventsView(ctl)
+		ctl.AddView(eventsView)
+	} else if config.LogTo != "stdout" && !service.IsService() {
 		termView = term.NewTermView(ctl)
 		ctl.AddView(termView)
 	}
@@ -179,12 +238,20 @@ func (ctl *Controller) Run(config *Configuration) {
 			if webView != nil {
 				ctl.AddView(webView.NewHttpView(p))
 			}
+
+			if eventsView != nil {
+				ctl.AddView(eventsView.NewHttpView(p))
+			}
 		default:
 		}
 	}
 
-	ctl.Go(func() { autoUpdate(state, config.AuthToken) })
+	ctl.Go(func() { autoUpdate(state, config) })
 	ctl.Go(ctl.model.Run)
+	ctl.Go(ctl.notifySystemd)
+
+	// systemd restarts us if the loop below stops answering
+	go util.SdWatchdog(func() { ctl.State() })
 
 	updates := ctl.updates.Reg()
 	defer ctl.updates.UnReg(updates)
@@ -198,12 +265,18 @@ func (ctl *Controller) Run(config *Configuration) {
 				msg := cmd.message
 				go func() {
 					ctl.doShutdown()
-					fmt.Println(msg)
+
+					// stdout only carries events in json mode
+					if config.Json {
+						fmt.Fprintln(os.Stderr, msg)
+					} else {
+						fmt.Println(msg)
+					}
 					done <- 1
 				}()
 
 			case cmdPlayRequest:
-				ctl.Go(func() { ctl.model.PlayRequest(cmd.tunnel, cmd.payload) })
+				ctl.Go(func() { ctl.model.PlayRequest(cmd.tunnel, cmd.payload, cmd.replayOf) })
 			}
 
 		case obj := <-updates:
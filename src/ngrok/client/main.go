@@ -5,6 +5,7 @@ import (
 	"github.com/inconshreveable/mousetrap"
 	"math/rand"
 	"ngrok/log"
+	"ngrok/service"
 	"ngrok/util"
 	"os"
 	"runtime"
@@ -30,8 +31,22 @@ func Main() {
 		os.Exit(1)
 	}
 
-	// set up logging
-	log.LogTo(opts.logto, opts.loglevel)
+	// install and control the Windows service
+	if opts.command == "service" {
+		if err = service.Command("ngrok", "ngrok tunnels", opts.args); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// set up logging, services log to the event log unless told otherwise
+	if service.IsService() && opts.logto == "none" {
+		// there's nowhere to report it if that fails
+		log.LogToEventLog("ngrok", opts.loglevel)
+	} else {
+		log.LogTo(opts.logto, opts.loglevel)
+	}
 
 	// read configuration file
 	config, err := LoadConfiguration(opts)
@@ -48,5 +63,15 @@ func Main() {
 	}
 	rand.Seed(seed)
 
-	NewController().Run(config)
+	ctl := NewController()
+	if service.IsService() {
+		err = service.Run("ngrok", func() { ctl.Run(config) }, func() { ctl.Shutdown("") })
+		if err != nil {
+			log.Error("Failed to run as a service: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctl.Run(config)
 }
@@ -15,6 +15,7 @@ type ClientMetrics struct {
 	connMeter       metrics.Meter
 	connTimer       metrics.Timer
 	proxySetupTimer metrics.Timer
+	heartbeatTimer  metrics.Timer
 	bytesIn         metrics.Histogram
 	bytesOut        metrics.Histogram
 	bytesInCount    metrics.Counter
@@ -27,6 +28,7 @@ func NewClientMetrics() *ClientMetrics {
 		connMeter:       metrics.NewMeter(),
 		connTimer:       metrics.NewTimer(),
 		proxySetupTimer: metrics.NewTimer(),
+		heartbeatTimer:  metrics.NewTimer(),
 		bytesIn:         metrics.NewHistogram(metrics.NewExpDecaySample(sampleSize, sampleAlpha)),
 		bytesOut:        metrics.NewHistogram(metrics.NewExpDecaySample(sampleSize, sampleAlpha)),
 		bytesInCount:    metrics.NewCounter(),
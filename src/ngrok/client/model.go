@@ -1,11 +1,16 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	metrics "github.com/rcrowley/go-metrics"
+	"io"
 	"io/ioutil"
 	"math"
+	"math/rand"
+	"net/http"
 	"ngrok/client/mvc"
 	"ngrok/conn"
 	"ngrok/log"
@@ -15,6 +20,7 @@ import (
 	"ngrok/version"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -50,6 +56,13 @@ type ClientModel struct {
 	tlsConfig     *tls.Config
 	tunnelConfig  map[string]*TunnelConfiguration
 	configPath    string
+	reconnect     *ReconnectConfiguration
+	resolver      *resolver
+
+	// the configuration of each tunnel by public url, read by the proxy
+	// connections while the control connection updates it
+	tunnelConfigs     map[string]*TunnelConfiguration
+	tunnelConfigsLock *sync.RWMutex
 }
 
 func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
@@ -57,7 +70,8 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 	protoMap["http"] = proto.NewHttp()
 	protoMap["https"] = protoMap["http"]
 	protoMap["tcp"] = proto.NewTcp()
-	protocols := []proto.Protocol{protoMap["http"], protoMap["tcp"]}
+	protoMap["socks"] = proto.NewSocks()
+	protocols := []proto.Protocol{protoMap["http"], protoMap["tcp"], protoMap["socks"]}
 
 	m := &ClientModel{
 		Logger: log.NewPrefixLogger("client"),
@@ -89,6 +103,10 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 		// open tunnels
 		tunnels: make(map[string]mvc.Tunnel),
 
+		// configuration of the open tunnels
+		tunnelConfigs:     make(map[string]*TunnelConfiguration),
+		tunnelConfigsLock: new(sync.RWMutex),
+
 		// controller
 		ctl: ctl,
 
@@ -97,6 +115,17 @@ func newClientModel(config *Configuration, ctl mvc.Controller) *ClientModel {
 
 		// config path
 		configPath: config.Path,
+
+		// reconnect backoff
+		reconnect: config.Reconnect,
+
+		// resolver for the server address
+		resolver: newResolver(config.Hosts, config.DNSServers),
+	}
+
+	// tune the sockets of our connections
+	for typ, opts := range config.socketOptions {
+		conn.SetSocketOptions(typ, opts)
 	}
 
 	// configure TLS
@@ -142,22 +171,40 @@ func (c ClientModel) GetBytesInMetrics() (metrics.Counter, metrics.Histogram) {
 func (c ClientModel) GetBytesOutMetrics() (metrics.Counter, metrics.Histogram) {
 	return c.metrics.bytesOutCount, c.metrics.bytesOut
 }
+
+// heartbeat round trip time to the server and the time the local service
+// takes to answer http requests
+func (c ClientModel) GetLatencyMetrics() (metrics.Timer, metrics.Timer) {
+	return c.metrics.heartbeatTimer, c.protoMap["http"].(*proto.Http).ReqTimer
+}
 func (c ClientModel) SetUpdateStatus(updateStatus mvc.UpdateStatus) {
 	c.updateStatus = updateStatus
 	c.update()
 }
 
 // mvc.Model interface
-func (c *ClientModel) PlayRequest(tunnel mvc.Tunnel, payload []byte) {
+func (c *ClientModel) PlayRequest(tunnel mvc.Tunnel, payload []byte, replayOf string) {
+	// replay to the local service the request was routed to by its path
+	addr := tunnel.LocalAddr
+	var tlsCfg *tls.Config
+	if cfg := c.tunnelConfigFor(tunnel); cfg != nil {
+		if len(cfg.Paths) > 0 {
+			if req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload))); err == nil {
+				addr = routePath(pathRoutes(cfg), req.URL.Path, addr)
+			}
+		}
+		tlsCfg = cfg.LocalTls.forAddr(addr)
+	}
+
 	var localConn conn.Conn
-	localConn, err := conn.Dial(tunnel.LocalAddr, "prv", nil)
+	localConn, err := conn.Dial(addr, "prv", tlsCfg)
 	if err != nil {
-		c.Warn("Failed to open private leg to %s: %v", tunnel.LocalAddr, err)
+		c.Warn("Failed to open private leg to %s: %v", addr, err)
 		return
 	}
 
 	defer localConn.Close()
-	localConn = tunnel.Protocol.WrapConn(localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: "127.0.0.1"})
+	localConn = tunnel.Protocol.WrapConn(localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: "127.0.0.1", ReplayOf: replayOf})
 	localConn.Write(payload)
 	ioutil.ReadAll(localConn)
 }
@@ -171,8 +218,8 @@ func (c *ClientModel) update() {
 
 func (c *ClientModel) Run() {
 	// how long we should wait before we reconnect
-	maxWait := 30 * time.Second
-	wait := 1 * time.Second
+	wait := c.reconnect.baseDelay
+	failures := 0
 
 	for {
 		// run the control channel
@@ -180,19 +227,37 @@ func (c *ClientModel) Run() {
 
 		// control only returns when a failure has occurred, so we're going to try to reconnect
 		if c.connStatus == mvc.ConnOnline {
-			wait = 1 * time.Second
+			wait = c.reconnect.baseDelay
+			failures = 0
 		}
 
-		log.Info("Waiting %d seconds before reconnecting", int(wait.Seconds()))
-		time.Sleep(wait)
+		failures++
+		if c.reconnect.MaxRetries > 0 && failures > c.reconnect.MaxRetries {
+			c.ctl.Shutdown(fmt.Sprintf("Giving up after %d failed attempts to connect to %s", c.reconnect.MaxRetries, c.serverAddr))
+			return
+		}
+
+		sleep := jitter(wait, c.reconnect.Jitter)
+		log.Info("Waiting %.1f seconds before reconnecting", sleep.Seconds())
+		time.Sleep(sleep)
 		// exponentially increase wait time
 		wait = 2 * wait
-		wait = time.Duration(math.Min(float64(wait), float64(maxWait)))
+		wait = time.Duration(math.Min(float64(wait), float64(c.reconnect.maxDelay)))
 		c.connStatus = mvc.ConnReconnecting
 		c.update()
 	}
 }
 
+// randomizes d by up to +/- fraction of itself so that many clients
+// which lost their connection at the same time don't reconnect in lockstep
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+
+	return d + time.Duration(fraction*float64(d)*(2*rand.Float64()-1))
+}
+
 // Establishes and manages a tunnel control connection with the server
 func (c *ClientModel) control() {
 	defer func() {
@@ -208,7 +273,7 @@ func (c *ClientModel) control() {
 	)
 	if c.proxyUrl == "" {
 		// simple non-proxied case, just connect to the server
-		ctlConn, err = conn.Dial(c.serverAddr, "ctl", c.tlsConfig)
+		ctlConn, err = c.dialServer("ctl")
 	} else {
 		ctlConn, err = conn.DialHttpProxy(c.proxyUrl, c.serverAddr, "ctl", c.tlsConfig)
 	}
@@ -225,6 +290,7 @@ func (c *ClientModel) control() {
 		Version:   version.Proto,
 		MmVersion: version.MajorMinor(),
 		User:      c.authToken,
+		Encodings: msg.CodecNames(),
 	}
 
 	if err = msg.WriteMsg(ctlConn, auth); err != nil {
@@ -239,10 +305,19 @@ func (c *ClientModel) control() {
 
 	if authResp.Error != "" {
 		emsg := fmt.Sprintf("Failed to authenticate to server: %s", authResp.Error)
-		c.ctl.Shutdown(emsg)
+		c.fail(emsg)
 		return
 	}
 
+	// the server picks how the rest of the conversation is encoded
+	codec := msg.JSON
+	if authResp.Encoding != "" {
+		if codec = msg.CodecByName(authResp.Encoding); codec == nil {
+			c.fail(fmt.Sprintf("Server picked unknown encoding %s", authResp.Encoding))
+			return
+		}
+	}
+
 	c.id = authResp.ClientId
 	c.serverVersion = authResp.MmVersion
 	c.Info("Authenticated with server, client id: %v", c.id)
@@ -251,6 +326,12 @@ func (c *ClientModel) control() {
 		c.Error("Failed to save auth token: %v", err)
 	}
 
+	// the tunnels of the previous session are gone, the server tells us the
+	// urls of this session's tunnels as it opens them
+	c.tunnelConfigsLock.Lock()
+	c.tunnelConfigs = make(map[string]*TunnelConfiguration)
+	c.tunnelConfigsLock.Unlock()
+
 	// request tunnels
 	reqIdToTunnelConfig := make(map[string]*TunnelConfiguration)
 	for _, config := range c.tunnelConfig {
@@ -261,16 +342,23 @@ func (c *ClientModel) control() {
 		}
 
 		reqTunnel := &msg.ReqTunnel{
-			ReqId:      util.RandId(8),
-			Protocol:   strings.Join(protocols, "+"),
-			Hostname:   config.Hostname,
-			Subdomain:  config.Subdomain,
-			HttpAuth:   config.HttpAuth,
-			RemotePort: config.RemotePort,
+			ReqId:           util.RandId(8),
+			Protocol:        strings.Join(protocols, "+"),
+			Hostname:        config.Hostname,
+			Subdomain:       config.Subdomain,
+			HttpAuth:        config.HttpAuth,
+			RemotePort:      config.RemotePort,
+			RemoteIp:        config.RemoteIp,
+			Tls:             config.Tls,
+			Cache:           config.Cache,
+			CorsOrigins:     corsOrigins(config),
+			Rewrites:        rewriteRules(config),
+			RewriteLocation: config.RewriteLocation,
+			IdleTimeout:     int64(config.idleTimeout / time.Second),
 		}
 
 		// send the tunnel request
-		if err = msg.WriteMsg(ctlConn, reqTunnel); err != nil {
+		if err = msg.WriteMsgWith(ctlConn, codec, reqTunnel); err != nil {
 			panic(err)
 		}
 
@@ -279,14 +367,22 @@ func (c *ClientModel) control() {
 		reqIdToTunnelConfig[reqTunnel.ReqId] = config
 	}
 
+	// the heartbeat and the control loop both write from here on
+	var writeLock sync.Mutex
+	writeMsg := func(m interface{}) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		return msg.WriteMsgWith(ctlConn, codec, m)
+	}
+
 	// start the heartbeat
 	lastPong := time.Now().UnixNano()
-	c.ctl.Go(func() { c.heartbeat(&lastPong, ctlConn) })
+	c.ctl.Go(func() { c.heartbeat(&lastPong, ctlConn, writeMsg) })
 
 	// main control loop
 	for {
 		var rawMsg msg.Message
-		if rawMsg, err = msg.ReadMsg(ctlConn); err != nil {
+		if rawMsg, err = msg.ReadMsgWith(ctlConn, codec); err != nil {
 			panic(err)
 		}
 
@@ -297,11 +393,16 @@ func (c *ClientModel) control() {
 		case *msg.Pong:
 			atomic.StoreInt64(&lastPong, time.Now().UnixNano())
 
+		case *msg.Ping:
+			// the server times these to measure our round trip
+			if err = writeMsg(&msg.Pong{}); err != nil {
+				panic(err)
+			}
+
 		case *msg.NewTunnel:
 			if m.Error != "" {
 				emsg := fmt.Sprintf("Server failed to allocate tunnel: %s", m.Error)
-				c.Error(emsg)
-				c.ctl.Shutdown(emsg)
+				c.fail(emsg)
 				continue
 			}
 
@@ -312,6 +413,9 @@ func (c *ClientModel) control() {
 			}
 
 			c.tunnels[tunnel.PublicUrl] = tunnel
+			c.tunnelConfigsLock.Lock()
+			c.tunnelConfigs[tunnel.PublicUrl] = reqIdToTunnelConfig[m.ReqId]
+			c.tunnelConfigsLock.Unlock()
 			c.connStatus = mvc.ConnOnline
 			c.Info("Tunnel established at %v", tunnel.PublicUrl)
 			c.update()
@@ -322,6 +426,27 @@ func (c *ClientModel) control() {
 	}
 }
 
+// Shuts down the client because of an error reported by the server, unless
+// we were configured to keep retrying forever. In that case the server hangs
+// up on us and the reconnect loop in Run() takes it from there.
+func (c *ClientModel) fail(emsg string) {
+	c.Error(emsg)
+	if !c.reconnect.Forever {
+		c.ctl.Shutdown(emsg)
+	}
+}
+
+// Connects directly to the server, resolving its address with the configured
+// resolver. When connecting through an http proxy, the proxy resolves it instead.
+func (c *ClientModel) dialServer(typ string) (conn.Conn, error) {
+	addr, err := c.resolver.resolveAddr(c.serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve server address %s: %v", c.serverAddr, err)
+	}
+
+	return conn.Dial(addr, typ, c.tlsConfig)
+}
+
 // Establishes and manages a tunnel proxy connection with the server
 func (c *ClientModel) proxy() {
 	var (
@@ -330,7 +455,7 @@ func (c *ClientModel) proxy() {
 	)
 
 	if c.proxyUrl == "" {
-		remoteConn, err = conn.Dial(c.serverAddr, "pxy", c.tlsConfig)
+		remoteConn, err = c.dialServer("pxy")
 	} else {
 		remoteConn, err = conn.DialHttpProxy(c.proxyUrl, c.serverAddr, "pxy", c.tlsConfig)
 	}
@@ -362,29 +487,51 @@ func (c *ClientModel) proxy() {
 
 	// start up the private connection
 	start := time.Now()
-	localConn, err := conn.Dial(tunnel.LocalAddr, "prv", nil)
+	var localConn conn.Conn
+	cfg := c.tunnelConfigFor(tunnel)
+	if tunnel.Protocol.GetName() == "socks" {
+		// socksConnect has already answered the remote user with a SOCKS
+		// reply, nothing else may be written on the stream
+		if localConn, err = c.socks(remoteConn, tunnel); err != nil {
+			remoteConn.Warn("Failed to open SOCKS connection: %v", err)
+			return
+		}
+	} else if cfg != nil && len(cfg.Paths) > 0 {
+		localConn = routePaths(tunnel, cfg, startPxy.ClientAddr)
+	} else {
+		localConn, err = conn.Dial(tunnel.LocalAddr, "prv", c.localTls(tunnel))
+	}
+	dial := time.Since(start)
 	if err != nil {
 		remoteConn.Warn("Failed to open private leg %s: %v", tunnel.LocalAddr, err)
 
 		if tunnel.Protocol.GetName() == "http" {
 			// try to be helpful when you're in HTTP mode and a human might see the output
-			badGatewayBody := fmt.Sprintf(BadGateway, tunnel.PublicUrl, tunnel.LocalAddr, tunnel.LocalAddr)
-			remoteConn.Write([]byte(fmt.Sprintf(`HTTP/1.0 502 Bad Gateway
-Content-Type: text/html
-Content-Length: %d
-
-%s`, len(badGatewayBody), badGatewayBody)))
+			writeBadGateway(remoteConn, tunnel.PublicUrl, tunnel.LocalAddr)
 		}
 		return
 	}
 	defer localConn.Close()
 
+	if cfg != nil && cfg.ProxyProtocol && tunnel.Protocol.GetName() != "socks" && len(cfg.Paths) == 0 {
+		if _, err = localConn.Write([]byte(conn.ProxyHeader(startPxy.ClientAddr, localConn.RemoteAddr()))); err != nil {
+			localConn.Warn("Failed to write PROXY header: %v", err)
+			return
+		}
+	}
+
 	m := c.metrics
 	m.proxySetupTimer.Update(time.Since(start))
 	m.connMeter.Mark(1)
 	c.update()
 	m.connTimer.Time(func() {
-		localConn := tunnel.Protocol.WrapConn(localConn, mvc.ConnectionContext{Tunnel: tunnel, ClientAddr: startPxy.ClientAddr})
+		ctx := mvc.ConnectionContext{
+			Tunnel:     tunnel,
+			ClientAddr: startPxy.ClientAddr,
+			Queued:     time.Duration(startPxy.Queued),
+			Dial:       dial,
+		}
+		localConn := tunnel.Protocol.WrapConn(localConn, ctx)
 		bytesIn, bytesOut := conn.Join(localConn, remoteConn)
 		m.bytesIn.Update(bytesIn)
 		m.bytesOut.Update(bytesOut)
@@ -394,9 +541,75 @@ Content-Length: %d
 	c.update()
 }
 
+func (c *ClientModel) tunnelConfigFor(tunnel mvc.Tunnel) *TunnelConfiguration {
+	c.tunnelConfigsLock.RLock()
+	defer c.tunnelConfigsLock.RUnlock()
+	return c.tunnelConfigs[tunnel.PublicUrl]
+}
+
+// How to connect to the local service of the tunnel, nil for plain connections
+func (c *ClientModel) localTls(tunnel mvc.Tunnel) *tls.Config {
+	if cfg := c.tunnelConfigFor(tunnel); cfg != nil {
+		return cfg.LocalTls.forAddr(tunnel.LocalAddr)
+	}
+	return nil
+}
+
+// Explains an http visitor that the local service isn't reachable
+func writeBadGateway(c io.Writer, publicUrl, localAddr string) {
+	body := fmt.Sprintf(BadGateway, publicUrl, localAddr, localAddr)
+	fmt.Fprintf(c, `HTTP/1.0 502 Bad Gateway
+Content-Type: text/html
+Content-Length: %d
+
+%s`, len(body), body)
+}
+
+// The origins the server should allow cross-origin requests from
+func corsOrigins(config *TunnelConfiguration) []string {
+	if len(config.CorsOrigins) > 0 {
+		return config.CorsOrigins
+	}
+
+	if config.Cors {
+		return []string{"*"}
+	}
+
+	return nil
+}
+
+func rewriteRules(config *TunnelConfiguration) []msg.RewriteRule {
+	var rules []msg.RewriteRule
+	for _, r := range config.Rewrite {
+		rules = append(rules, msg.RewriteRule{
+			StripPrefix: r.StripPrefix,
+			AddPrefix:   r.AddPrefix,
+			Match:       r.Match,
+			Replace:     r.Replace,
+		})
+	}
+	return rules
+}
+
+// Lets the remote user choose where to connect through a socks tunnel
+func (c *ClientModel) socks(remoteConn conn.Conn, tunnel mvc.Tunnel) (conn.Conn, error) {
+	allowed, err := util.ParseNetworks(tunnel.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := c.tunnelConfigFor(tunnel)
+	if cfg == nil || cfg.HttpAuth == "" {
+		return nil, fmt.Errorf("Refusing unauthenticated SOCKS connection for %s", tunnel.PublicUrl)
+	}
+
+	return socksConnect(remoteConn, cfg.HttpAuth, allowed)
+}
+
 // Hearbeating to ensure our connection ngrokd is still live
-func (c *ClientModel) heartbeat(lastPongAddr *int64, conn conn.Conn) {
+func (c *ClientModel) heartbeat(lastPongAddr *int64, conn conn.Conn, writeMsg func(interface{}) error) {
 	lastPing := time.Unix(atomic.LoadInt64(lastPongAddr)-1, 0)
+	measured := true
 	ping := time.NewTicker(pingInterval)
 	pongCheck := time.NewTicker(time.Second)
 
@@ -419,13 +632,21 @@ func (c *ClientModel) heartbeat(lastPongAddr *int64, conn conn.Conn) {
 				return
 			}
 
+			// record the round trip time once for every ping we send
+			if !needPong && !measured {
+				c.metrics.heartbeatTimer.Update(lastPong.Sub(lastPing))
+				measured = true
+				c.update()
+			}
+
 		case <-ping.C:
-			err := msg.WriteMsg(conn, &msg.Ping{})
+			err := writeMsg(&msg.Ping{})
 			if err != nil {
 				conn.Debug("Got error %v when writing PingMsg", err)
 				return
 			}
 			lastPing = time.Now()
+			measured = false
 		}
 	}
 }
@@ -11,8 +11,9 @@ type Controller interface {
 	// instructs the controller to shut the app down
 	Shutdown(message string)
 
-	// PlayRequest instructs the model to play requests
-	PlayRequest(tunnel Tunnel, payload []byte)
+	// PlayRequest instructs the model to play requests, replayOf identifies
+	// the transaction that is replayed
+	PlayRequest(tunnel Tunnel, payload []byte, replayOf string)
 
 	// A channel of updates
 	Updates() *util.Broadcast
@@ -3,6 +3,7 @@ package mvc
 import (
 	metrics "github.com/rcrowley/go-metrics"
 	"ngrok/proto"
+	"time"
 )
 
 type UpdateStatus int
@@ -31,6 +32,14 @@ type Tunnel struct {
 type ConnectionContext struct {
 	Tunnel     Tunnel
 	ClientAddr string
+
+	// set on replayed requests, the id of the transaction they replay
+	ReplayOf string
+
+	// how long the connection waited on the server for a proxy connection,
+	// and for the local service to accept it
+	Queued time.Duration
+	Dial   time.Duration
 }
 
 type State interface {
@@ -43,5 +52,6 @@ type State interface {
 	GetConnectionMetrics() (metrics.Meter, metrics.Timer)
 	GetBytesInMetrics() (metrics.Counter, metrics.Histogram)
 	GetBytesOutMetrics() (metrics.Counter, metrics.Histogram)
+	GetLatencyMetrics() (metrics.Timer, metrics.Timer)
 	SetUpdateStatus(UpdateStatus)
 }
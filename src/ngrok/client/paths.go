@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"ngrok/client/mvc"
+	"ngrok/conn"
+	"sort"
+	"strings"
+)
+
+// A local service that gets the requests for a path prefix of an http tunnel
+type pathRoute struct {
+	prefix string
+	addr   string
+}
+
+// Path prefixes of the tunnel, longest first so the most specific one wins
+func pathRoutes(config *TunnelConfiguration) []pathRoute {
+	routes := make([]pathRoute, 0, len(config.Paths))
+	for prefix, addr := range config.Paths {
+		routes = append(routes, pathRoute{strings.TrimSuffix(prefix, "/"), addr})
+	}
+
+	sort.Slice(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+	return routes
+}
+
+// /api matches /api and /api/users but not /apis
+func matchPath(prefix, path string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// Returns the local end of a connection whose requests are each sent to the
+// local service their path is mapped to, or to the tunnel's local address if
+// none matches. The returned connection is what the proxy connection gets
+// joined with, so requests are inspected like those of any other tunnel.
+func routePaths(tunnel mvc.Tunnel, config *TunnelConfiguration, clientAddr string) conn.Conn {
+	local, router := net.Pipe()
+	r := &pathRouter{
+		Conn:       conn.Wrap(router, "prv"),
+		routes:     pathRoutes(config),
+		tunnel:     tunnel,
+		clientAddr: clientAddr,
+		proxyProto: config.ProxyProtocol,
+		localTls:   config.LocalTls,
+		backends:   make(map[string]*pathBackend),
+	}
+	go r.serve()
+
+	return conn.Wrap(local, "prv")
+}
+
+type pathBackend struct {
+	conn.Conn
+	br *bufio.Reader
+}
+
+type pathRouter struct {
+	conn.Conn
+	routes     []pathRoute
+	tunnel     mvc.Tunnel
+	clientAddr string
+	proxyProto bool
+	localTls   *LocalTlsConfiguration
+
+	// connections to the local services, reused for the following requests
+	backends map[string]*pathBackend
+}
+
+func (r *pathRouter) serve() {
+	defer r.Close()
+	defer func() {
+		for _, b := range r.backends {
+			b.Close()
+		}
+	}()
+
+	br := bufio.NewReader(r)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+
+		addr := r.route(req.URL.Path)
+		if !r.forward(req, br, addr) {
+			return
+		}
+	}
+}
+
+func (r *pathRouter) route(path string) string {
+	return routePath(r.routes, path, r.tunnel.LocalAddr)
+}
+
+// The local service of the first route matching path, or addr if none does
+func routePath(routes []pathRoute, path, addr string) string {
+	for _, route := range routes {
+		if matchPath(route.prefix, path) {
+			return route.addr
+		}
+	}
+	return addr
+}
+
+// Sends the request to the local service and copies back its response,
+// returning whether the connection can carry another request
+func (r *pathRouter) forward(req *http.Request, br *bufio.Reader, addr string) (keepAlive bool) {
+	// don't let the request writer add a User-Agent the visitor didn't send
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""}
+	}
+
+	_, reused := r.backends[addr]
+	b, resp, err := r.roundTrip(req, addr)
+	if err != nil && reused && req.ContentLength == 0 && len(req.TransferEncoding) == 0 {
+		// the local service may have closed the idle connection, try a new one
+		b, resp, err = r.roundTrip(req, addr)
+	}
+	if err != nil {
+		r.Warn("Failed to forward %s to %s: %v", req.URL.Path, addr, err)
+		writeBadGateway(r, r.tunnel.PublicUrl, addr)
+		return false
+	}
+
+	err = resp.Write(r)
+	resp.Body.Close()
+	if err != nil {
+		return false
+	}
+
+	// upgraded connections like websockets belong to the local service from now on
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		go io.Copy(b, br)
+		io.Copy(r, b.br)
+		return false
+	}
+
+	if resp.Close || req.Close {
+		r.dropBackend(addr)
+		return false
+	}
+	return true
+}
+
+func (r *pathRouter) roundTrip(req *http.Request, addr string) (b *pathBackend, resp *http.Response, err error) {
+	if b, err = r.backend(addr); err != nil {
+		return
+	}
+
+	if err = req.Write(b); err == nil {
+		resp, err = http.ReadResponse(b.br, req)
+	}
+	if err != nil {
+		r.dropBackend(addr)
+	}
+	return
+}
+
+func (r *pathRouter) backend(addr string) (*pathBackend, error) {
+	if b, ok := r.backends[addr]; ok {
+		return b, nil
+	}
+
+	c, err := conn.Dial(addr, "prv", r.localTls.forAddr(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	if r.proxyProto {
+		if _, err = c.Write([]byte(conn.ProxyHeader(r.clientAddr, c.RemoteAddr()))); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	b := &pathBackend{c, bufio.NewReader(c)}
+	r.backends[addr] = b
+	return b, nil
+}
+
+func (r *pathRouter) dropBackend(addr string) {
+	if b, ok := r.backends[addr]; ok {
+		b.Close()
+		delete(r.backends, addr)
+	}
+}
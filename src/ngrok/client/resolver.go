@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"ngrok/log"
+	"sync/atomic"
+)
+
+// Resolves the server's hostname with a static host mapping or a custom
+// list of DNS servers instead of the system resolver. Useful when the
+// local DNS is broken, captive or split-horizon.
+type resolver struct {
+	log.Logger
+	hosts   map[string]string
+	servers []string
+	next    uint32
+	net.Resolver
+}
+
+func newResolver(hosts map[string]string, servers []string) *resolver {
+	r := &resolver{
+		Logger:  log.NewPrefixLogger("resolver"),
+		hosts:   hosts,
+		servers: servers,
+	}
+
+	if len(servers) > 0 {
+		r.PreferGo = true
+		r.Dial = r.dial
+	}
+
+	return r
+}
+
+// dials the configured DNS servers in rotation, ignoring the system's choice
+func (r *resolver) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	server := r.servers[int(atomic.AddUint32(&r.next, 1)-1)%len(r.servers)]
+	var d net.Dialer
+	return d.DialContext(ctx, network, server)
+}
+
+// Returns addr with its host replaced by an IP address if a static mapping or
+// custom DNS servers are configured. Otherwise addr is returned unchanged so that
+// the system resolver handles it as before.
+func (r *resolver) resolveAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if ip, ok := r.hosts[host]; ok {
+		r.Debug("Resolved %s to %s from static host mapping", host, ip)
+		return net.JoinHostPort(ip, port), nil
+	}
+
+	if len(r.servers) == 0 || net.ParseIP(host) != nil {
+		return addr, nil
+	}
+
+	ips, err := r.LookupHost(context.Background(), host)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ips) == 0 {
+		return "", fmt.Errorf("No addresses found for %s", host)
+	}
+
+	r.Debug("Resolved %s to %s with DNS servers %v", host, ips[0], r.servers)
+	return net.JoinHostPort(ips[0], port), nil
+}
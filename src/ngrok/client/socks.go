@@ -0,0 +1,203 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"ngrok/conn"
+	"ngrok/util"
+	"strconv"
+	"strings"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929
+const (
+	socksVersion         = 5
+	socksAuthVersion     = 1
+	socksAuthNone        = 0
+	socksAuthPassword    = 2
+	socksAuthUnavailable = 0xff
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSuccess          = 0
+	socksRepFailure          = 1
+	socksRepNotAllowed       = 2
+	socksRepHostUnreachable  = 4
+	socksRepCmdNotSupported  = 7
+	socksRepAtypNotSupported = 8
+)
+
+// Speaks the server side of SOCKS5 over a proxy connection and dials the
+// destination requested by the remote user. If auth is a "user:password"
+// pair, the remote user must authenticate with it. Only CONNECT is supported
+// and the destination must fall within the allowed networks.
+func socksConnect(c conn.Conn, auth string, allowed []*net.IPNet) (localConn conn.Conn, err error) {
+	// greeting: version, number of methods, methods
+	hdr := make([]byte, 2)
+	if _, err = io.ReadFull(c, hdr); err != nil {
+		return
+	}
+
+	if hdr[0] != socksVersion {
+		err = fmt.Errorf("Unsupported SOCKS version %d", hdr[0])
+		return
+	}
+
+	methods := make([]byte, hdr[1])
+	if _, err = io.ReadFull(c, methods); err != nil {
+		return
+	}
+
+	method := byte(socksAuthNone)
+	if auth != "" {
+		method = socksAuthPassword
+	}
+
+	if strings.IndexByte(string(methods), method) == -1 {
+		c.Write([]byte{socksVersion, socksAuthUnavailable})
+		err = fmt.Errorf("SOCKS client does not support authentication method %d", method)
+		return
+	}
+
+	if _, err = c.Write([]byte{socksVersion, method}); err != nil {
+		return
+	}
+
+	if method == socksAuthPassword {
+		if err = socksAuthenticate(c, auth); err != nil {
+			return
+		}
+	}
+
+	// request: version, command, reserved, address type, address, port
+	req := make([]byte, 4)
+	if _, err = io.ReadFull(c, req); err != nil {
+		return
+	}
+
+	if req[1] != socksCmdConnect {
+		socksReply(c, socksRepCmdNotSupported, nil)
+		err = fmt.Errorf("Unsupported SOCKS command %d", req[1])
+		return
+	}
+
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socksAtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err = io.ReadFull(c, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull(c, l); err != nil {
+			return
+		}
+		name := make([]byte, l[0])
+		if _, err = io.ReadFull(c, name); err != nil {
+			return
+		}
+		host = string(name)
+
+	default:
+		socksReply(c, socksRepAtypNotSupported, nil)
+		err = fmt.Errorf("Unsupported SOCKS address type %d", req[3])
+		return
+	}
+
+	var port uint16
+	if err = binary.Read(c, binary.BigEndian, &port); err != nil {
+		return
+	}
+
+	// resolve the destination ourselves so that we can check it against
+	// the allowed networks before connecting
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		socksReply(c, socksRepHostUnreachable, nil)
+		return
+	}
+
+	if !util.IpInNetworks(addr.IP, allowed) {
+		socksReply(c, socksRepNotAllowed, nil)
+		err = fmt.Errorf("Destination %s is not allowed for this tunnel", addr)
+		return
+	}
+
+	c.Info("SOCKS connect to %s (%s)", host, addr)
+	if localConn, err = conn.Dial(addr.String(), "prv", nil); err != nil {
+		socksReply(c, socksRepHostUnreachable, nil)
+		return
+	}
+
+	if err = socksReply(c, socksRepSuccess, localConn.LocalAddr().(*net.TCPAddr)); err != nil {
+		localConn.Close()
+		localConn = nil
+	}
+
+	return
+}
+
+// username/password sub-negotiation
+func socksAuthenticate(c conn.Conn, auth string) (err error) {
+	readField := func() (string, error) {
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(c, l); err != nil {
+			return "", err
+		}
+		field := make([]byte, l[0])
+		_, err := io.ReadFull(c, field)
+		return string(field), err
+	}
+
+	ver := make([]byte, 1)
+	if _, err = io.ReadFull(c, ver); err != nil {
+		return
+	}
+
+	user, err := readField()
+	if err != nil {
+		return
+	}
+
+	password, err := readField()
+	if err != nil {
+		return
+	}
+
+	if ver[0] != socksAuthVersion || user+":"+password != auth {
+		c.Write([]byte{socksAuthVersion, 1})
+		return fmt.Errorf("SOCKS authentication failed for user '%s'", user)
+	}
+
+	_, err = c.Write([]byte{socksAuthVersion, 0})
+	return
+}
+
+func socksReply(c conn.Conn, rep byte, bound *net.TCPAddr) error {
+	reply := []byte{socksVersion, rep, 0}
+	if bound == nil {
+		bound = &net.TCPAddr{IP: net.IPv4zero}
+	}
+
+	if ip4 := bound.IP.To4(); ip4 != nil {
+		reply = append(append(reply, socksAtypIPv4), ip4...)
+	} else {
+		reply = append(append(reply, socksAtypIPv6), bound.IP.To16()...)
+	}
+
+	reply = append(reply, byte(bound.Port>>8), byte(bound.Port))
+	_, err := c.Write(reply)
+	return err
+}
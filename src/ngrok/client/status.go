@@ -0,0 +1,59 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"ngrok/client/views/web"
+	"os"
+	"time"
+)
+
+const statusTimeout = 5 * time.Second
+
+// exit codes of ngrok status
+const (
+	statusOnline      = 0
+	statusOffline     = 1
+	statusUnreachable = 2
+)
+
+// Asks the running client's local API about its tunnels and prints them as
+// JSON. Returns the exit code: whether the client is online, isn't, or
+// couldn't be asked.
+func printStatus(inspectAddr string) int {
+	if inspectAddr == "disabled" {
+		fmt.Fprintln(os.Stderr, "The web interface is disabled, so there's no local API to ask for the status")
+		return statusUnreachable
+	}
+
+	client := http.Client{Timeout: statusTimeout}
+	resp, err := client.Get("http://" + inspectAddr + "/api/tunnels")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to reach ngrok at %s: %v\n", inspectAddr, err)
+		return statusUnreachable
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		fmt.Fprintf(os.Stderr, "ngrok at %s responded %s\n", inspectAddr, resp.Status)
+		return statusUnreachable
+	}
+
+	var tunnels web.SerializedTunnels
+	if err = json.NewDecoder(resp.Body).Decode(&tunnels); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the status from %s: %v\n", inspectAddr, err)
+		return statusUnreachable
+	}
+
+	out, err := json.MarshalIndent(tunnels, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(out))
+
+	if tunnels.Status != "online" {
+		return statusOffline
+	}
+	return statusOnline
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// environment variables CI systems put the branch being built in
+var branchVariables = []string{"NGROK_BRANCH", "GITHUB_HEAD_REF", "GITHUB_REF_NAME", "CI_COMMIT_REF_NAME", "BRANCH_NAME", "GIT_BRANCH", "TRAVIS_BRANCH", "CIRCLE_BRANCH"}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// The variables subdomains and hostnames can use, e.g. {{.Username}}-{{.Branch}}
+// or {{.Env.PR_NUMBER}}.example.com
+type templateData struct {
+	Username string
+	Hostname string
+	Branch   string
+	Env      map[string]string
+}
+
+func newTemplateData() *templateData {
+	data := &templateData{Env: make(map[string]string)}
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			data.Env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	if u, err := user.Current(); err == nil {
+		data.Username = u.Username
+	}
+	data.Hostname, _ = os.Hostname()
+
+	for _, name := range branchVariables {
+		if branch := strings.TrimPrefix(data.Env[name], "refs/heads/"); branch != "" {
+			data.Branch = branch
+			break
+		}
+	}
+	return data
+}
+
+// Resolves the template variables in a subdomain or hostname. Every value is
+// made safe for a hostname label, so a branch like feature/Login becomes
+// feature-login.
+func expandHostTemplate(s string, data *templateData) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+
+	tmpl, err := template.New("host").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data.labels()); err != nil {
+		return "", err
+	}
+
+	host := strings.Trim(buf.String(), "-.")
+	if host == "" {
+		return "", fmt.Errorf("'%s' resolves to an empty name", s)
+	}
+	return host, nil
+}
+
+func (d *templateData) labels() *templateData {
+	labels := &templateData{
+		Username: hostLabel(d.Username),
+		Hostname: hostLabel(d.Hostname),
+		Branch:   hostLabel(d.Branch),
+		Env:      make(map[string]string, len(d.Env)),
+	}
+	for k, v := range d.Env {
+		labels.Env[k] = hostLabel(v)
+	}
+	return labels
+}
+
+// Lowercases s and replaces anything that can't be in a hostname label with -
+func hostLabel(s string) string {
+	label := invalidLabelChars.ReplaceAllString(strings.ToLower(s), "-")
+	label = strings.Trim(label, "-")
+	if len(label) > 63 {
+		label = strings.Trim(label[:63], "-")
+	}
+	return label
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"ngrok/client/assets"
 )
 
@@ -33,3 +35,50 @@ func LoadTLSConfig(rootCertPaths []string) (*tls.Config, error) {
 
 	return &tls.Config{RootCAs: pool}, nil
 }
+
+func loadLocalTls(c *LocalTlsConfiguration) (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if (c.Cert == "") != (c.Key == "") {
+		return nil, fmt.Errorf("cert and key must be given together")
+	}
+
+	if c.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.Ca != "" {
+		pem, err := ioutil.ReadFile(c.Ca)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", c.Ca)
+		}
+	}
+
+	return config, nil
+}
+
+// The TLS configuration for connecting to the local service at addr, nil if
+// the tunnel connects to it without TLS
+func (c *LocalTlsConfiguration) forAddr(addr string) *tls.Config {
+	if c == nil {
+		return nil
+	}
+
+	config := c.config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = "localhost"
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config.ServerName = host
+		}
+	}
+	return config
+}
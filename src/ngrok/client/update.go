@@ -0,0 +1,162 @@
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"ngrok/version"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// no client binary is anywhere near this big
+const maxReleaseSize = 256 << 20
+
+var updateClient = &http.Client{Timeout: 10 * time.Minute}
+
+// The latest release for this platform, as described by the release server
+// of a self-hosted ngrokd at update_url
+type releaseInfo struct {
+	Version   string `json:"version"`
+	Url       string `json:"url"`
+	Sha256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// Parses the PEM encoded RSA public key that release signatures are verified with
+func parseUpdateKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded public key found")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an RSA key")
+	}
+	return key, nil
+}
+
+// Asks the release server whether there's a newer release for this platform,
+// nil if there's none
+func checkRelease(updateUrl string) (*releaseInfo, error) {
+	query := url.Values{
+		"os":      {runtime.GOOS},
+		"arch":    {runtime.GOARCH},
+		"version": {version.MajorMinor()},
+	}
+
+	resp, err := updateClient.Get(strings.TrimRight(updateUrl, "/") + "/check?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("release server returned %s", resp.Status)
+	}
+
+	info := new(releaseInfo)
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(info); err != nil {
+		return nil, fmt.Errorf("invalid release description: %v", err)
+	}
+	return info, nil
+}
+
+// Downloads a release and checks it against its checksum and its detached
+// signature. The signature covers the version followed by a newline and the
+// binary, so an older signed release can't be passed off as a newer one. The
+// binary is only returned if the signature was made with the key of the
+// operator and the release is newer than this client.
+func downloadRelease(info *releaseInfo, key *rsa.PublicKey) ([]byte, error) {
+	if !newerVersion(info.Version, version.MajorMinor()) {
+		return nil, fmt.Errorf("release %s is not newer than %s", info.Version, version.MajorMinor())
+	}
+
+	if info.Signature == "" {
+		return nil, fmt.Errorf("release %s is not signed", info.Version)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(info.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature of release %s: %v", info.Version, err)
+	}
+
+	resp, err := updateClient.Get(info.Url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s returned %s", info.Url, resp.Status)
+	}
+
+	bin, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxReleaseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(bin) > maxReleaseSize {
+		return nil, fmt.Errorf("release %s is larger than %d bytes", info.Version, maxReleaseSize)
+	}
+
+	sum := sha256.Sum256(bin)
+	if expected, err := hex.DecodeString(info.Sha256); err != nil || !bytes.Equal(expected, sum[:]) {
+		return nil, fmt.Errorf("checksum of release %s doesn't match", info.Version)
+	}
+
+	signed := sha256.New()
+	signed.Write([]byte(info.Version + "\n"))
+	signed.Write(bin)
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, signed.Sum(nil), sig); err != nil {
+		return nil, fmt.Errorf("signature of release %s doesn't verify: %v", info.Version, err)
+	}
+	return bin, nil
+}
+
+// Whether version v is newer than cur, both like 1.7 or 1.7.2. Versions that
+// don't parse are never newer.
+func newerVersion(v, cur string) bool {
+	a, b := strings.Split(v, "."), strings.Split(cur, ".")
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		var err error
+		if i < len(a) {
+			if x, err = strconv.Atoi(a[i]); err != nil {
+				return false
+			}
+		}
+		if i < len(b) {
+			if y, err = strconv.Atoi(b[i]); err != nil {
+				return false
+			}
+		}
+
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
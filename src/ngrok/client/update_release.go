@@ -3,6 +3,7 @@
 package client
 
 import (
+	"bytes"
 	update "github.com/inconshreveable/go-update"
 	"github.com/inconshreveable/go-update/check"
 	"ngrok/client/mvc"
@@ -26,7 +27,13 @@ d/hHfAl567YhlkQMNz8dawxBjQwCHHekgC8gAvTO7kmXkAm6YAbpa9kjwgnorPEP
 ywIDAQAB
 -----END PUBLIC KEY-----`
 
-func autoUpdate(s mvc.State, token string) {
+func autoUpdate(s mvc.State, config *Configuration) {
+	if config.UpdateUrl != "" {
+		selfHostedUpdate(s, config)
+		return
+	}
+
+	token := config.AuthToken
 	up, err := update.New().VerifySignatureWithPEM([]byte(publicKey))
 	if err != nil {
 		log.Error("Failed to create update with signature: %v", err)
@@ -99,3 +106,55 @@ func applyUpdate(s mvc.State, result *check.Result) {
 	// tell the user to update manually
 	s.SetUpdateStatus(mvc.UpdateAvailable)
 }
+
+// Updates from the release server of a self-hosted ngrokd. Releases are only
+// applied once their signature is verified with the operator's public key.
+func selfHostedUpdate(s mvc.State, config *Configuration) {
+	tryUpdate := func() (tryAgain bool) {
+		log.Info("Checking for update at %s", config.UpdateUrl)
+		info, err := checkRelease(config.UpdateUrl)
+		if err != nil {
+			log.Error("Error while checking for update: %v", err)
+			return true
+		} else if info == nil {
+			log.Info("No update available")
+			return true
+		}
+
+		up := update.New()
+		if err := up.CanUpdate(); err != nil {
+			log.Error("Can't update: insufficient permissions: %v", err)
+			s.SetUpdateStatus(mvc.UpdateAvailable)
+			return false
+		}
+
+		bin, err := downloadRelease(info, config.updateKey)
+		if err != nil {
+			log.Error("Refusing update to %s: %v", info.Version, err)
+			s.SetUpdateStatus(mvc.UpdateAvailable)
+			return false
+		}
+
+		err, errRecover := up.FromStream(bytes.NewReader(bin))
+		if err == nil {
+			log.Info("Update to %s ready!", info.Version)
+			s.SetUpdateStatus(mvc.UpdateReady)
+			return false
+		}
+
+		log.Error("Error while updating ngrok: %v", err)
+		if errRecover != nil {
+			log.Error("Error while recovering from failed ngrok update, your binary may be missing: %v", errRecover.Error())
+		}
+		s.SetUpdateStatus(mvc.UpdateAvailable)
+		return false
+	}
+
+	for {
+		if tryAgain := tryUpdate(); !tryAgain {
+			break
+		}
+
+		time.Sleep(updateCheckInterval)
+	}
+}
@@ -0,0 +1,95 @@
+package events
+
+import (
+	"ngrok/client/mvc"
+	"ngrok/proto"
+	"time"
+)
+
+const (
+	// txns whose response never came are forgotten after this long, once
+	// there are more than maxPendingTxns of them
+	pendingTxnTimeout = time.Minute
+	maxPendingTxns    = 1024
+)
+
+// Summarizes each request once its response is back
+type HttpView struct {
+	events    *EventsView
+	httpProto *proto.Http
+	shutdown  chan int
+
+	// Each txn is broadcast once its request is read and again once its
+	// response is, but by the time the first broadcast is handled the
+	// response may be in already. Txns that were broadcast once map to
+	// whether they were emitted, so each is emitted exactly once.
+	pending map[*proto.HttpTxn]bool
+}
+
+func newHttpView(ev *EventsView, p *proto.Http) *HttpView {
+	v := &HttpView{
+		events:    ev,
+		httpProto: p,
+		shutdown:  make(chan int),
+		pending:   make(map[*proto.HttpTxn]bool),
+	}
+	ev.ctl.Go(v.run)
+	return v
+}
+
+func (v *HttpView) run() {
+	defer close(v.shutdown)
+
+	txns := v.httpProto.Txns.Reg()
+	defer v.httpProto.Txns.UnReg(txns)
+
+	for {
+		select {
+		case obj := <-txns:
+			txn := obj.(*proto.HttpTxn)
+			if !v.firstResponse(txn) {
+				continue
+			}
+
+			ctx := txn.ConnUserCtx.(mvc.ConnectionContext)
+			v.events.emit(Event{
+				Event:      "request",
+				Url:        ctx.Tunnel.PublicUrl,
+				Method:     txn.Req.Method,
+				Path:       txn.Req.URL.RequestURI(),
+				Status:     txn.Resp.StatusCode,
+				Duration:   float64(txn.Duration) / float64(time.Millisecond),
+				RemoteAddr: ctx.ClientAddr,
+			})
+
+		case <-v.shutdown:
+			return
+		}
+	}
+}
+
+// Whether the broadcast of txn is the first one that has its response
+func (v *HttpView) firstResponse(txn *proto.HttpTxn) bool {
+	emitted, seen := v.pending[txn]
+	if seen {
+		// that's both broadcasts
+		delete(v.pending, txn)
+		return !emitted && txn.Resp != nil
+	}
+
+	if len(v.pending) >= maxPendingTxns {
+		for t := range v.pending {
+			if time.Since(t.Start) > pendingTxnTimeout {
+				delete(v.pending, t)
+			}
+		}
+	}
+
+	v.pending[txn] = txn.Resp != nil
+	return txn.Resp != nil
+}
+
+func (v *HttpView) Shutdown() {
+	v.shutdown <- 1
+	<-v.shutdown
+}
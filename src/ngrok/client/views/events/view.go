@@ -0,0 +1,115 @@
+// structured events on stdout for scripts and CI jobs
+package events
+
+import (
+	"encoding/json"
+	"ngrok/client/mvc"
+	"ngrok/log"
+	"ngrok/proto"
+	"os"
+	"sync"
+	"time"
+)
+
+// One JSON object per line. Fields that don't apply to an event are left out.
+type Event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	// the tunnel, for tunnel_established and request
+	Url       string `json:"url,omitempty"`
+	Proto     string `json:"proto,omitempty"`
+	LocalAddr string `json:"local_addr,omitempty"`
+
+	// request summaries
+	Method     string  `json:"method,omitempty"`
+	Path       string  `json:"path,omitempty"`
+	Status     int     `json:"status,omitempty"`
+	Duration   float64 `json:"duration_ms,omitempty"`
+	RemoteAddr string  `json:"remote_addr,omitempty"`
+}
+
+type EventsView struct {
+	log.Logger
+	ctl      mvc.Controller
+	updates  chan interface{}
+	shutdown chan int
+
+	// the http views write events too
+	sync.Mutex
+	out *json.Encoder
+}
+
+func NewEventsView(ctl mvc.Controller) *EventsView {
+	v := &EventsView{
+		Logger:   log.NewPrefixLogger("view", "events"),
+		ctl:      ctl,
+		updates:  ctl.Updates().Reg(),
+		shutdown: make(chan int),
+		out:      json.NewEncoder(os.Stdout),
+	}
+	ctl.Go(v.run)
+	return v
+}
+
+func (v *EventsView) emit(e Event) {
+	e.Time = time.Now()
+
+	v.Lock()
+	defer v.Unlock()
+	if err := v.out.Encode(e); err != nil {
+		v.Warn("Failed to write event: %v", err)
+	}
+}
+
+// Reports the connection to the server going up and down, and every tunnel
+// once each time the connection comes online
+func (v *EventsView) run() {
+	defer close(v.shutdown)
+	defer v.ctl.Updates().UnReg(v.updates)
+
+	var status mvc.ConnStatus = mvc.ConnConnecting
+	announced := make(map[string]bool)
+	for {
+		select {
+		case obj := <-v.updates:
+			state := obj.(mvc.State)
+
+			if s := state.GetConnStatus(); s != status {
+				status = s
+				if status == mvc.ConnReconnecting {
+					v.emit(Event{Event: "reconnecting"})
+					announced = make(map[string]bool)
+				}
+			}
+
+			if status != mvc.ConnOnline {
+				continue
+			}
+
+			for _, t := range state.GetTunnels() {
+				if !announced[t.PublicUrl] {
+					announced[t.PublicUrl] = true
+					v.emit(Event{
+						Event:     "tunnel_established",
+						Url:       t.PublicUrl,
+						Proto:     t.Protocol.GetName(),
+						LocalAddr: t.LocalAddr,
+					})
+				}
+			}
+
+		case <-v.shutdown:
+			return
+		}
+	}
+}
+
+func (v *EventsView) Shutdown() {
+	v.shutdown <- 1
+	<-v.shutdown
+}
+
+func (v *EventsView) NewHttpView(p *proto.Http) *HttpView {
+	return newHttpView(v, p)
+}
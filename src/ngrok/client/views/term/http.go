@@ -1,17 +1,25 @@
 package term
 
 import (
+	"fmt"
 	termbox "github.com/nsf/termbox-go"
+	"net/http"
 	"ngrok/client/mvc"
 	"ngrok/log"
 	"ngrok/proto"
 	"ngrok/util"
+	"sort"
+	"strings"
+	"time"
 	"unicode/utf8"
 )
 
 const (
 	size          = 10
 	pathMaxLength = 25
+
+	// how many requests the request list keeps
+	historySize = 100
 )
 
 type HttpView struct {
@@ -22,6 +30,13 @@ type HttpView struct {
 	HttpRequests *util.Ring
 	shutdown     chan int
 	termView     *TermView
+	keys         chan termbox.Event
+
+	// the request list, toggled with tab, lets you select a request with the
+	// arrow keys and see its headers with enter
+	listMode bool
+	selected *proto.HttpTxn
+	expanded bool
 }
 
 func colorFor(status string) termbox.Attribute {
@@ -40,9 +55,10 @@ func colorFor(status string) termbox.Attribute {
 func newTermHttpView(ctl mvc.Controller, termView *TermView, proto *proto.Http, x, y int) *HttpView {
 	v := &HttpView{
 		httpProto:    proto,
-		HttpRequests: util.NewRing(size),
+		HttpRequests: util.NewRing(historySize),
 		area:         NewArea(x, y, 70, size+5),
 		shutdown:     make(chan int),
+		keys:         make(chan termbox.Event),
 		termView:     termView,
 		Logger:       log.NewPrefixLogger("view", "term", "http"),
 	}
@@ -61,25 +77,176 @@ func (v *HttpView) Run() {
 				v.HttpRequests.Add(txn)
 			}
 			v.Render()
+
+		case ev := <-v.keys:
+			v.handleKey(ev)
+			v.Render()
+
+		case <-v.shutdown:
+			return
 		}
 	}
 }
 
+// Keys are passed on by the TermView, which reads all terminal input
+func (v *HttpView) Key(ev termbox.Event) {
+	select {
+	case v.keys <- ev:
+	case <-v.shutdown:
+	}
+}
+
+func (v *HttpView) handleKey(ev termbox.Event) {
+	if ev.Key == termbox.KeyTab {
+		v.listMode = !v.listMode
+		v.expanded = false
+		return
+	}
+
+	if !v.listMode {
+		return
+	}
+
+	txns := v.HttpRequests.Slice()
+	if len(txns) == 0 {
+		return
+	}
+
+	// the list is newest first, so up selects newer requests
+	idx := v.selectedIndex(txns)
+	switch ev.Key {
+	case termbox.KeyArrowUp:
+		if idx > 0 {
+			idx--
+		}
+	case termbox.KeyArrowDown:
+		if idx < len(txns)-1 {
+			idx++
+		}
+	case termbox.KeyHome:
+		idx = 0
+	case termbox.KeyEnd:
+		idx = len(txns) - 1
+	case termbox.KeyEnter:
+		v.expanded = !v.expanded
+	case termbox.KeyEsc:
+		v.expanded = false
+	}
+	v.selected = txns[idx].(*proto.HttpTxn)
+}
+
+// Where the selected request is in the list, the newest if it dropped out
+func (v *HttpView) selectedIndex(txns []interface{}) int {
+	for i, obj := range txns {
+		if obj.(*proto.HttpTxn) == v.selected {
+			return i
+		}
+	}
+	return 0
+}
+
 func (v *HttpView) Render() {
-	v.Clear()
-	v.Printf(0, 0, "HTTP Requests")
-	v.Printf(0, 1, "-------------")
-	for i, obj := range v.HttpRequests.Slice() {
-		txn := obj.(*proto.HttpTxn)
-		path := truncatePath(txn.Req.URL.Path)
-		v.Printf(0, 3+i, "%s %v", txn.Req.Method, path)
-		if txn.Resp != nil {
-			v.APrintf(colorFor(txn.Resp.Status), 30, 3+i, "%s", txn.Resp.Status)
+	// the list takes the rest of the screen, and what it showed there has
+	// to go when it's closed
+	w, h := termbox.Size()
+	list := NewArea(v.x, v.y, w-v.x, h-v.y)
+	list.Clear()
+
+	if v.listMode {
+		v.renderList(list)
+	} else {
+		v.Printf(0, 0, "HTTP Requests")
+		v.Printf(0, 1, "-------------")
+		for i, obj := range v.HttpRequests.Slice() {
+			if i == size {
+				break
+			}
+
+			txn := obj.(*proto.HttpTxn)
+			path := truncatePath(txn.Req.URL.Path)
+			v.Printf(0, 3+i, "%s %v", txn.Req.Method, path)
+			if txn.Resp != nil {
+				v.APrintf(colorFor(txn.Resp.Status), 30, 3+i, "%s", txn.Resp.Status)
+			}
 		}
 	}
 	v.termView.Flush()
 }
 
+func (v *HttpView) renderList(list *area) {
+	txns := v.HttpRequests.Slice()
+	list.Printf(0, 0, "HTTP Requests (up/down to select, enter for headers, tab to close)")
+	list.Printf(0, 1, "-------------")
+	if len(txns) == 0 {
+		return
+	}
+
+	idx := v.selectedIndex(txns)
+	if v.expanded {
+		v.renderDetails(list, txns[idx].(*proto.HttpTxn))
+		return
+	}
+
+	// scroll so that the selected request is visible
+	rows := list.h - 3
+	first := 0
+	if idx >= rows {
+		first = idx - rows + 1
+	}
+
+	for i := first; i < len(txns) && i-first < rows; i++ {
+		txn := txns[i].(*proto.HttpTxn)
+		fg := list.fgColor
+		if i == idx {
+			fg |= termbox.AttrReverse
+		}
+
+		y := 3 + i - first
+		list.APrintf(fg, 0, y, "%-7s %-30s", txn.Req.Method, truncatePath(txn.Req.URL.Path))
+		if txn.Resp != nil {
+			list.APrintf(colorFor(txn.Resp.Status)|(fg&termbox.AttrReverse), 40, y, "%-20s", txn.Resp.Status)
+			list.APrintf(fg, 62, y, "%s", formatDuration(txn.Duration))
+		}
+	}
+}
+
+func (v *HttpView) renderDetails(list *area, txn *proto.HttpTxn) {
+	lines := []string{fmt.Sprintf("%s %s", txn.Req.Method, txn.Req.URL.RequestURI()), ""}
+	lines = append(lines, headerLines(txn.Req.Header)...)
+
+	if txn.Resp != nil {
+		lines = append(lines, "", fmt.Sprintf("%s (%s)", txn.Resp.Status, formatDuration(txn.Duration)), "")
+		lines = append(lines, headerLines(txn.Resp.Header)...)
+	}
+
+	for i, line := range lines {
+		if 3+i >= list.h {
+			break
+		}
+
+		if utf8.RuneCountInString(line) > list.w {
+			line = string([]rune(line)[:list.w])
+		}
+		list.Printf(0, 3+i, "%s", line)
+	}
+}
+
+func headerLines(h http.Header) []string {
+	var lines []string
+	for name, values := range h {
+		lines = append(lines, name+": "+strings.Join(values, ", "))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func formatDuration(d time.Duration) string {
+	if d > time.Second {
+		return fmt.Sprintf("%.2fs", d.Seconds())
+	}
+	return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+}
+
 func (v *HttpView) Shutdown() {
 	close(v.shutdown)
 }
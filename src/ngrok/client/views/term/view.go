@@ -17,6 +17,9 @@ type TermView struct {
 	shutdown chan int
 	redraw   *util.Broadcast
 	subviews []mvc.View
+
+	// http views get the keys for their request lists
+	httpViews []*HttpView
 	log.Logger
 	*area
 }
@@ -34,7 +37,7 @@ func NewTermView(ctl mvc.Controller) *TermView {
 		flush:    make(chan int),
 		shutdown: make(chan int),
 		Logger:   log.NewPrefixLogger("view", "term"),
-		area:     NewArea(0, 0, w, 10),
+		area:     NewArea(0, 0, w, 12),
 	}
 
 	ctl.Go(v.run)
@@ -115,6 +118,13 @@ func (v *TermView) draw() {
 	msec := float64(time.Millisecond)
 	v.Printf(0, i+2, "%-30s%.2fms", "Avg Conn Time", connTimer.Mean()/msec)
 
+	// p50/p95 latencies let you tell a slow tunnel apart from a slow app
+	rttTimer, reqTimer := state.GetLatencyMetrics()
+	rtt := rttTimer.Percentiles([]float64{0.5, 0.95})
+	v.Printf(0, i+3, "%-30s%.2fms / %.2fms", "Tunnel RTT (p50/p95)", rtt[0]/msec, rtt[1]/msec)
+	req := reqTimer.Percentiles([]float64{0.5, 0.95})
+	v.Printf(0, i+4, "%-30s%.2fms / %.2fms", "Local Response (p50/p95)", req[0]/msec, req[1]/msec)
+
 	termbox.Flush()
 }
 
@@ -154,7 +164,9 @@ func (v *TermView) Flush() {
 }
 
 func (v *TermView) NewHttpView(p *proto.Http) *HttpView {
-	return newTermHttpView(v.ctl, v, p, 0, 12)
+	httpView := newTermHttpView(v.ctl, v, p, 0, 12)
+	v.httpViews = append(v.httpViews, httpView)
+	return httpView
 }
 
 func (v *TermView) input() {
@@ -166,6 +178,11 @@ func (v *TermView) input() {
 			case termbox.KeyCtrlC:
 				v.Info("Got quit command")
 				v.ctl.Shutdown("")
+
+			default:
+				for _, httpView := range v.httpViews {
+					httpView.Key(ev)
+				}
 			}
 
 		case termbox.EventResize:
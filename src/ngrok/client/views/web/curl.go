@@ -0,0 +1,62 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"ngrok/proto"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// headers curl sets itself from the URL and the body
+var curlSkipHeaders = map[string]bool{"Host": true, "Content-Length": true, "Connection": true}
+
+// Renders a captured request as a curl command that sends it to the tunnel's
+// public URL again
+func curlCommand(publicUrl string, req *proto.HttpRequest) string {
+	url := strings.TrimRight(publicUrl, "/") + req.URL.RequestURI()
+	args := []string{"curl"}
+
+	hasBody := len(req.BodyBytes) > 0
+	if req.Method != "GET" && !(req.Method == "POST" && hasBody) {
+		args = append(args, "-X", shellQuote(req.Method))
+	}
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		if !curlSkipHeaders[http.CanonicalHeaderKey(name)] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			args = append(args, "-H", shellQuote(name+": "+value))
+		}
+	}
+
+	var stdin string
+	if hasBody {
+		// curl would read a body starting with @ from a file
+		if utf8.Valid(req.BodyBytes) && req.BodyBytes[0] != '@' {
+			args = append(args, "--data-binary", shellQuote(string(req.BodyBytes)))
+		} else {
+			// other bodies are piped in with their bytes escaped
+			var escaped strings.Builder
+			for _, b := range req.BodyBytes {
+				fmt.Fprintf(&escaped, `\%03o`, b)
+			}
+			stdin = "printf '" + escaped.String() + "' | "
+			args = append(args, "--data-binary", "@-")
+		}
+	}
+
+	args = append(args, shellQuote(url))
+	return stdin + strings.Join(args, " ")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,183 @@
+package web
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// bodies with more lines than this are only compared as a whole
+const maxDiffLines = 2000
+
+const (
+	DiffSame    = "same"
+	DiffChanged = "changed"
+	DiffRemoved = "removed"
+	DiffAdded   = "added"
+)
+
+// One row of a side-by-side comparison of the original and the replayed response
+type DiffRow struct {
+	Name     string `json:",omitempty"`
+	Original string
+	Replayed string
+	Op       string
+}
+
+// How the response to a replayed request differs from the original response
+type SerializedDiff struct {
+	OriginalId string
+	Status     DiffRow
+	Header     []DiffRow
+	Body       []DiffRow
+	Changed    bool
+}
+
+func diffResponses(originalId string, orig, replayed *SerializedTxn) *SerializedDiff {
+	d := &SerializedDiff{
+		OriginalId: originalId,
+		Status:     diffRow("", orig.Resp.Status, replayed.Resp.Status),
+		Header:     diffHeaders(orig.Resp.Header, replayed.Resp.Header),
+		Body:       diffBodies(orig.HttpTxn.Resp.BodyBytes, replayed.HttpTxn.Resp.BodyBytes),
+	}
+
+	rows := append([]DiffRow{d.Status}, d.Header...)
+	for _, r := range append(rows, d.Body...) {
+		if r.Op != DiffSame {
+			d.Changed = true
+			break
+		}
+	}
+	return d
+}
+
+func diffRow(name, original, replayed string) DiffRow {
+	op := DiffSame
+	if original != replayed {
+		op = DiffChanged
+	}
+	return DiffRow{Name: name, Original: original, Replayed: replayed, Op: op}
+}
+
+// headers that change with every response don't count as differences
+var volatileHeaders = map[string]bool{"Date": true, "Expires": true, "Last-Modified": true, "Etag": true, "Set-Cookie": true}
+
+func diffHeaders(orig, replayed http.Header) []DiffRow {
+	names := make(map[string]bool)
+	for name := range orig {
+		names[name] = true
+	}
+	for name := range replayed {
+		names[name] = true
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	rows := make([]DiffRow, 0, len(sorted))
+	for _, name := range sorted {
+		o, inOrig := orig[name]
+		r, inReplayed := replayed[name]
+		row := diffRow(name, strings.Join(o, ", "), strings.Join(r, ", "))
+
+		switch {
+		case !inOrig:
+			row.Op = DiffAdded
+		case !inReplayed:
+			row.Op = DiffRemoved
+		case volatileHeaders[name]:
+			row.Op = DiffSame
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// Compares bodies line by line, binary or very long bodies only as a whole
+func diffBodies(orig, replayed []byte) []DiffRow {
+	if !utf8.Valid(orig) || !utf8.Valid(replayed) {
+		if bytes.Equal(orig, replayed) {
+			return []DiffRow{{Original: "(binary body)", Replayed: "(binary body)", Op: DiffSame}}
+		}
+		return []DiffRow{{Original: "(binary body)", Replayed: "(binary body)", Op: DiffChanged}}
+	}
+
+	a := strings.Split(string(orig), "\n")
+	b := strings.Split(string(replayed), "\n")
+	if len(a) > maxDiffLines || len(b) > maxDiffLines {
+		return []DiffRow{diffRow("", "(body too long to compare)", "(body too long to compare)")}
+	}
+
+	// longest common subsequence of lines
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var rows []DiffRow
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			rows = append(rows, DiffRow{Original: a[i], Replayed: b[j], Op: DiffSame})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			rows = append(rows, DiffRow{Original: a[i], Op: DiffRemoved})
+			i++
+		default:
+			rows = append(rows, DiffRow{Replayed: b[j], Op: DiffAdded})
+			j++
+		}
+	}
+	return pairChanges(rows)
+}
+
+// Shows removed lines followed by added ones side by side as changed lines
+func pairChanges(rows []DiffRow) []DiffRow {
+	var paired []DiffRow
+	for i := 0; i < len(rows); {
+		if rows[i].Op != DiffRemoved {
+			paired = append(paired, rows[i])
+			i++
+			continue
+		}
+
+		removed := i
+		for i < len(rows) && rows[i].Op == DiffRemoved {
+			i++
+		}
+		added := i
+		for i < len(rows) && rows[i].Op == DiffAdded {
+			i++
+		}
+
+		for k := 0; k < added-removed || k < i-added; k++ {
+			switch {
+			case k < added-removed && k < i-added:
+				paired = append(paired, DiffRow{Original: rows[removed+k].Original, Replayed: rows[added+k].Replayed, Op: DiffChanged})
+			case k < added-removed:
+				paired = append(paired, rows[removed+k])
+			default:
+				paired = append(paired, rows[added+k])
+			}
+		}
+	}
+	return paired
+}
@@ -0,0 +1,173 @@
+package web
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"ngrok/log"
+	"time"
+)
+
+var (
+	historyBucket = []byte("txns")
+	historyIds    = []byte("ids")
+)
+
+// Keeps the requests that drop out of the web interface's window in a BoltDB
+// file, so they can still be looked at and replayed later. Only the most
+// recent max requests are kept.
+type History struct {
+	db    *bolt.DB
+	max   int
+	count int
+	log.Logger
+}
+
+// What's needed to replay a request from the history
+type historyTxn struct {
+	Id  string
+	Req struct {
+		Raw string
+	}
+	ConnCtx struct {
+		Tunnel struct {
+			PublicUrl string
+		}
+	}
+}
+
+type historyPage struct {
+	Txns []json.RawMessage
+
+	// pass as before to get the next page, 0 when there are no older requests
+	Next uint64
+}
+
+func OpenHistory(path string, max int) (h *History, err error) {
+	h = &History{max: max, Logger: log.NewPrefixLogger("view", "web", "history")}
+	if h.db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second}); err != nil {
+		return nil, err
+	}
+
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists(historyIds); err != nil {
+			return err
+		}
+
+		h.count = b.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		h.db.Close()
+		return nil, err
+	}
+
+	h.Info("Keeping up to %d requests in %s, %d so far", max, path, h.count)
+	return h, nil
+}
+
+func historyKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// Saves a transaction, dropping the oldest ones beyond the limit. A
+// transaction that's already saved is updated in place, e.g. when its
+// response arrives after it dropped out of the window.
+func (h *History) Put(txn *SerializedTxn) error {
+	value, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		b, ids := tx.Bucket(historyBucket), tx.Bucket(historyIds)
+		if key := append([]byte(nil), ids.Get([]byte(txn.Id))...); len(key) > 0 && b.Get(key) != nil {
+			return b.Put(key, value)
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := historyKey(seq)
+		if err = b.Put(key, value); err != nil {
+			return err
+		}
+		if err = ids.Put([]byte(txn.Id), key); err != nil {
+			return err
+		}
+		h.count++
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil && h.count > h.max; k, v = c.First() {
+			var old historyTxn
+			if json.Unmarshal(v, &old) == nil {
+				ids.Delete([]byte(old.Id))
+			}
+			if err = c.Delete(); err != nil {
+				return err
+			}
+			h.count--
+		}
+		return nil
+	})
+}
+
+// Looks up a saved transaction, nil if it isn't in the history
+func (h *History) Get(id string) (txn *historyTxn, err error) {
+	err = h.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(historyIds).Get([]byte(id))
+		if key == nil {
+			return nil
+		}
+
+		value := tx.Bucket(historyBucket).Get(key)
+		if value == nil {
+			return nil
+		}
+
+		txn = new(historyTxn)
+		return json.Unmarshal(value, txn)
+	})
+	return
+}
+
+// Returns up to limit transactions older than before, newest first. A before
+// of 0 starts with the newest.
+func (h *History) Page(before uint64, limit int) (page historyPage, err error) {
+	page.Txns = make([]json.RawMessage, 0, limit)
+	err = h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+
+		var k, v []byte
+		if before == 0 {
+			k, v = c.Last()
+		} else {
+			c.Seek(historyKey(before))
+			k, v = c.Prev()
+		}
+
+		for ; k != nil && len(page.Txns) < limit; k, v = c.Prev() {
+			page.Txns = append(page.Txns, append(json.RawMessage(nil), v...))
+			page.Next = binary.BigEndian.Uint64(k)
+		}
+
+		// no more pages if the oldest one was reached
+		if k == nil {
+			page.Next = 0
+		}
+		return nil
+	})
+	return
+}
+
+func (h *History) Close() error {
+	return h.db.Close()
+}
@@ -14,7 +14,9 @@ import (
 	"ngrok/log"
 	"ngrok/proto"
 	"ngrok/util"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode/utf8"
 )
 
@@ -26,6 +28,28 @@ type SerializedTxn struct {
 	*proto.HttpTxn `json:"-"`
 	Req            SerializedRequest
 	Resp           SerializedResponse
+
+	// replayed requests are compared with the response to the original
+	ReplayOf string
+	Diff     *SerializedDiff
+
+	Timing SerializedTiming
+}
+
+// Where the time of a request went, in nanoseconds. Queued and Dial are 0 for
+// requests on a connection that was already set up.
+type SerializedTiming struct {
+	// waiting on the server for a proxy connection
+	Queued int64
+
+	// connecting to the local service
+	Dial int64
+
+	// from forwarding the request until the local service started to respond
+	FirstByte int64
+
+	// from forwarding the request until the whole response was read
+	Total int64
 }
 
 type SerializedBody struct {
@@ -41,18 +65,22 @@ type SerializedBody struct {
 type SerializedRequest struct {
 	Raw        string
 	MethodPath string
+	RequestId  string
 	Params     url.Values
 	Header     http.Header
 	Body       SerializedBody
 	Binary     bool
+	Curl       string
+	Tokens     []SerializedJwt
 }
 
 type SerializedResponse struct {
-	Raw    string
-	Status string
-	Header http.Header
-	Body   SerializedBody
-	Binary bool
+	Raw       string
+	Status    string
+	Header    http.Header
+	Body      SerializedBody
+	Binary    bool
+	Streaming bool
 }
 
 type WebHttpView struct {
@@ -63,11 +91,20 @@ type WebHttpView struct {
 	httpProto    *proto.Http
 	state        chan SerializedUiState
 	HttpRequests *util.Ring
-	idToTxn      map[string]*SerializedTxn
+
+	// the transactions in HttpRequests by id
+	idToTxn map[string]*SerializedTxn
+	sync.RWMutex
+
+	// asks updateHttp to save the window to the history before it's closed
+	flush chan chan struct{}
 }
 
 type SerializedUiState struct {
 	Tunnels []mvc.Tunnel
+
+	// whether older requests can be loaded from the history
+	History bool
 }
 
 type SerializedPayload struct {
@@ -83,6 +120,7 @@ func newWebHttpView(ctl mvc.Controller, wv *WebView, proto *proto.Http) *WebHttp
 		httpProto:    proto,
 		idToTxn:      make(map[string]*SerializedTxn),
 		HttpRequests: util.NewRing(20),
+		flush:        make(chan chan struct{}),
 	}
 	ctl.Go(whv.updateHttp)
 	whv.register()
@@ -146,68 +184,140 @@ func (whv *WebHttpView) updateHttp() {
 	// open channels for incoming http state changes
 	// and broadcasts
 	txnUpdates := whv.httpProto.Txns.Reg()
-	for txn := range txnUpdates {
-		// XXX: it's not safe for proto.Http and this code
-		// to be accessing txn and txn.(req/resp) without synchronization
-		htxn := txn.(*proto.HttpTxn)
-
-		// we haven't processed this transaction yet if we haven't set the
-		// user data
-		if htxn.UserCtx == nil {
-			rawReq, err := proto.DumpRequestOut(htxn.Req.Request, true)
-			if err != nil {
-				whv.Error("Failed to dump request: %v", err)
-				continue
-			}
 
-			body := makeBody(htxn.Req.Header, htxn.Req.BodyBytes)
-			whtxn := &SerializedTxn{
-				Id:      util.RandId(8),
-				HttpTxn: htxn,
-				Req: SerializedRequest{
-					MethodPath: htxn.Req.Method + " " + htxn.Req.URL.Path,
-					Raw:        base64.StdEncoding.EncodeToString(rawReq),
-					Params:     htxn.Req.URL.Query(),
-					Header:     htxn.Req.Header,
-					Body:       body,
-					Binary:     !utf8.Valid(rawReq),
-				},
-				Start:   htxn.Start.Unix(),
-				ConnCtx: htxn.ConnUserCtx.(mvc.ConnectionContext),
+	// nil once the history was closed
+	history := whv.webview.history
+	for {
+		select {
+		case txn := <-txnUpdates:
+			// XXX: it's not safe for proto.Http and this code
+			// to be accessing txn and txn.(req/resp) without synchronization
+			whv.updateTxn(txn.(*proto.HttpTxn), history)
+
+		case done := <-whv.flush:
+			if history != nil {
+				whv.saveWindow(history)
+				history = nil
 			}
+			close(done)
+		}
+	}
+}
 
-			htxn.UserCtx = whtxn
-			// XXX: unsafe map access from multiple go routines
-			whv.idToTxn[whtxn.Id] = whtxn
-			// XXX: use return value to delete from map so we don't leak memory
-			whv.HttpRequests.Add(whtxn)
-		} else {
-			rawResp, err := httputil.DumpResponse(htxn.Resp.Response, true)
-			if err != nil {
-				whv.Error("Failed to dump response: %v", err)
-				continue
-			}
+func (whv *WebHttpView) updateTxn(htxn *proto.HttpTxn, history *History) {
+	// we haven't processed this transaction yet if we haven't set the
+	// user data
+	if htxn.UserCtx == nil {
+		rawReq, err := proto.DumpRequestOut(htxn.Req.Request, true)
+		if err != nil {
+			whv.Error("Failed to dump request: %v", err)
+			return
+		}
 
-			txn := htxn.UserCtx.(*SerializedTxn)
-			body := makeBody(htxn.Resp.Header, htxn.Resp.BodyBytes)
-			txn.Duration = htxn.Duration.Nanoseconds()
-			txn.Resp = SerializedResponse{
-				Status: htxn.Resp.Status,
-				Raw:    base64.StdEncoding.EncodeToString(rawResp),
-				Header: htxn.Resp.Header,
-				Body:   body,
-				Binary: !utf8.Valid(rawResp),
+		body := makeBody(htxn.Req.Header, htxn.Req.BodyBytes)
+		whtxn := &SerializedTxn{
+			Id:      util.RandId(8),
+			HttpTxn: htxn,
+			Req: SerializedRequest{
+				MethodPath: htxn.Req.Method + " " + htxn.Req.URL.Path,
+				RequestId:  htxn.Req.Header.Get("X-Request-Id"),
+				Raw:        base64.StdEncoding.EncodeToString(rawReq),
+				Params:     htxn.Req.URL.Query(),
+				Header:     htxn.Req.Header,
+				Body:       body,
+				Binary:     !utf8.Valid(rawReq),
+				Curl:       curlCommand(htxn.ConnUserCtx.(mvc.ConnectionContext).Tunnel.PublicUrl, htxn.Req),
+				Tokens:     findJwts(htxn.Req.Request),
+			},
+			Start:   htxn.Start.Unix(),
+			ConnCtx: htxn.ConnUserCtx.(mvc.ConnectionContext),
+		}
+		whtxn.ReplayOf = whtxn.ConnCtx.ReplayOf
+
+		htxn.UserCtx = whtxn
+		whv.Lock()
+		whv.idToTxn[whtxn.Id] = whtxn
+		old := whv.HttpRequests.Add(whtxn)
+		if old != nil {
+			delete(whv.idToTxn, old.(*SerializedTxn).Id)
+		}
+		whv.Unlock()
+
+		if old != nil && history != nil {
+			if err := history.Put(old.(*SerializedTxn)); err != nil {
+				whv.Error("Failed to save request to history: %v", err)
 			}
+		}
+	} else {
+		rawResp, err := httputil.DumpResponse(htxn.Resp.Response, true)
+		if err != nil {
+			whv.Error("Failed to dump response: %v", err)
+			return
+		}
 
-			payload, err := json.Marshal(txn)
-			if err != nil {
-				whv.Error("Failed to serialized txn payload for websocket: %v", err)
+		txn := htxn.UserCtx.(*SerializedTxn)
+		body := makeBody(htxn.Resp.Header, htxn.Resp.BodyBytes)
+		txn.Duration = htxn.Duration.Nanoseconds()
+		txn.Timing = SerializedTiming{
+			FirstByte: htxn.FirstByte.Nanoseconds(),
+			Total:     htxn.Duration.Nanoseconds(),
+		}
+		if !htxn.Reused {
+			txn.Timing.Queued = txn.ConnCtx.Queued.Nanoseconds()
+			txn.Timing.Dial = txn.ConnCtx.Dial.Nanoseconds()
+		}
+		txn.Resp = SerializedResponse{
+			Status:    htxn.Resp.Status,
+			Raw:       base64.StdEncoding.EncodeToString(rawResp),
+			Header:    htxn.Resp.Header,
+			Body:      body,
+			Binary:    !utf8.Valid(rawResp),
+			Streaming: htxn.Resp.Streaming,
+		}
+
+		if orig, ok := whv.txnById(txn.ReplayOf); ok && orig.HttpTxn.Resp != nil {
+			txn.Diff = diffResponses(orig.Id, orig, txn)
+		}
+
+		// a request that dropped out of the window was saved without its response
+		if _, ok := whv.txnById(txn.Id); !ok && history != nil {
+			if err := history.Put(txn); err != nil {
+				whv.Error("Failed to save response to history: %v", err)
 			}
-			whv.webview.wsMessages.In() <- payload
+		}
+
+		payload, err := json.Marshal(txn)
+		if err != nil {
+			whv.Error("Failed to serialized txn payload for websocket: %v", err)
+		}
+		whv.webview.wsMessages.In() <- payload
+	}
+}
+
+// Saves the requests that are still in the window to the history, oldest first
+func (whv *WebHttpView) saveWindow(history *History) {
+	txns := whv.HttpRequests.Slice()
+	for i := len(txns) - 1; i >= 0; i-- {
+		if err := history.Put(txns[i].(*SerializedTxn)); err != nil {
+			whv.Error("Failed to save request to history: %v", err)
 		}
 	}
 }
 
+// Saves the window before the history is closed, and stops saving to it
+func (whv *WebHttpView) flushHistory() {
+	done := make(chan struct{})
+	whv.flush <- done
+	<-done
+}
+
+func (whv *WebHttpView) txnById(id string) (txn *SerializedTxn, ok bool) {
+	whv.RLock()
+	defer whv.RUnlock()
+	txn, ok = whv.idToTxn[id]
+	return
+}
+
 func (whv *WebHttpView) register() {
 	http.HandleFunc("/http/in/replay", func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -220,18 +330,60 @@ func (whv *WebHttpView) register() {
 
 		r.ParseForm()
 		txnid := r.Form.Get("txnid")
-		if txn, ok := whv.idToTxn[txnid]; ok {
+		if txn, ok := whv.txnById(txnid); ok {
 			reqBytes, err := base64.StdEncoding.DecodeString(txn.Req.Raw)
 			if err != nil {
 				panic(err)
 			}
-			whv.ctl.PlayRequest(txn.ConnCtx.Tunnel, reqBytes)
+			whv.ctl.PlayRequest(txn.ConnCtx.Tunnel, reqBytes, txn.Id)
+			w.Write([]byte(http.StatusText(200)))
+		} else if tunnel, reqBytes, ok := whv.fromHistory(txnid); ok {
+			whv.ctl.PlayRequest(tunnel, reqBytes, txnid)
 			w.Write([]byte(http.StatusText(200)))
 		} else {
 			http.Error(w, http.StatusText(400), 400)
 		}
 	})
 
+	http.HandleFunc("/http/in/history", func(w http.ResponseWriter, r *http.Request) {
+		if whv.webview.history == nil {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+
+		r.ParseForm()
+		before, _ := strconv.ParseUint(r.Form.Get("before"), 10, 64)
+		limit, err := strconv.Atoi(r.Form.Get("limit"))
+		if err != nil || limit <= 0 || limit > 100 {
+			limit = 20
+		}
+
+		page, err := whv.webview.history.Page(before, limit)
+		if err != nil {
+			whv.Error("Failed to read history: %v", err)
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+
+		payload, err := json.Marshal(page)
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payload)
+	})
+
+	http.HandleFunc("/http/in/curl", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if txn, ok := whv.txnById(r.Form.Get("txnid")); ok {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(txn.Req.Curl + "\n"))
+		} else {
+			http.Error(w, http.StatusText(404), 404)
+		}
+	})
+
 	http.HandleFunc("/http/in", func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if r := recover(); r != nil {
@@ -250,7 +402,7 @@ func (whv *WebHttpView) register() {
 
 		payloadData := SerializedPayload{
 			Txns:    whv.HttpRequests.Slice(),
-			UiState: SerializedUiState{Tunnels: whv.ctl.State().GetTunnels()},
+			UiState: SerializedUiState{Tunnels: whv.ctl.State().GetTunnels(), History: whv.webview.history != nil},
 		}
 
 		payload, err := json.Marshal(payloadData)
@@ -265,5 +417,29 @@ func (whv *WebHttpView) register() {
 	})
 }
 
+// Finds a request from the history and the tunnel it can be replayed on, if
+// that tunnel is still open
+func (whv *WebHttpView) fromHistory(txnid string) (tunnel mvc.Tunnel, reqBytes []byte, ok bool) {
+	if whv.webview.history == nil {
+		return
+	}
+
+	txn, err := whv.webview.history.Get(txnid)
+	if err != nil || txn == nil {
+		return
+	}
+
+	if reqBytes, err = base64.StdEncoding.DecodeString(txn.Req.Raw); err != nil {
+		return
+	}
+
+	for _, t := range whv.ctl.State().GetTunnels() {
+		if t.PublicUrl == txn.ConnCtx.Tunnel.PublicUrl {
+			return t, reqBytes, true
+		}
+	}
+	return
+}
+
 func (whv *WebHttpView) Shutdown() {
 }
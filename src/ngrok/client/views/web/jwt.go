@@ -0,0 +1,99 @@
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var jwtPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*$`)
+
+// A JSON Web Token found in a request. The signature isn't verified.
+type SerializedJwt struct {
+	// where the token was found, e.g. Authorization or the name of a cookie
+	Source string
+	Header string
+	Claims string
+
+	// unix times from the exp and nbf claims, 0 if the token doesn't have them
+	Expires   int64 `json:",omitempty"`
+	NotBefore int64 `json:",omitempty"`
+}
+
+// Finds and decodes the tokens in the Authorization header and the cookies
+func findJwts(req *http.Request) []SerializedJwt {
+	var tokens []SerializedJwt
+
+	for _, auth := range req.Header["Authorization"] {
+		// the token is usually a Bearer credential, but not always
+		fields := strings.Fields(auth)
+		if len(fields) > 0 {
+			if t, ok := decodeJwt("Authorization", fields[len(fields)-1]); ok {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+
+	for _, cookie := range req.Cookies() {
+		if t, ok := decodeJwt("Cookie "+cookie.Name, cookie.Value); ok {
+			tokens = append(tokens, t)
+		}
+	}
+
+	return tokens
+}
+
+func decodeJwt(source, token string) (t SerializedJwt, ok bool) {
+	if !jwtPattern.MatchString(token) {
+		return
+	}
+	parts := strings.Split(token, ".")
+
+	header, ok := decodeJwtPart(parts[0])
+	if !ok {
+		return
+	}
+
+	// only something with an alg header is taken for a token
+	var alg struct{ Alg string }
+	if json.Unmarshal(header, &alg) != nil || alg.Alg == "" {
+		return t, false
+	}
+
+	claims, ok := decodeJwtPart(parts[1])
+	if !ok {
+		return
+	}
+
+	var times struct {
+		Exp float64
+		Nbf float64
+	}
+	json.Unmarshal(claims, &times)
+
+	return SerializedJwt{
+		Source:    source,
+		Header:    string(header),
+		Claims:    string(claims),
+		Expires:   int64(times.Exp),
+		NotBefore: int64(times.Nbf),
+	}, true
+}
+
+// Decodes a base64url part of a token that must hold a JSON object, indented
+// for display
+func decodeJwtPart(part string) ([]byte, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil || len(raw) == 0 || raw[0] != '{' {
+		return nil, false
+	}
+
+	var indented bytes.Buffer
+	if json.Indent(&indented, raw, "", "  ") != nil {
+		return nil, false
+	}
+	return indented.Bytes(), true
+}
@@ -2,7 +2,9 @@
 package web
 
 import (
+	"encoding/json"
 	"github.com/gorilla/websocket"
+	metrics "github.com/rcrowley/go-metrics"
 	"net/http"
 	"ngrok/client/assets"
 	"ngrok/client/mvc"
@@ -10,8 +12,57 @@ import (
 	"ngrok/proto"
 	"ngrok/util"
 	"path"
+	"sort"
+	"time"
 )
 
+// latencies are reported in milliseconds
+type SerializedLatency struct {
+	Count int64
+	Mean  float64
+	P50   float64
+	P95   float64
+}
+
+type SerializedStats struct {
+	ConnCount     int64
+	HeartbeatRtt  SerializedLatency
+	LocalResponse SerializedLatency
+
+	// updates that never reached a web socket because it fell behind
+	DroppedMessages uint64
+}
+
+type SerializedTunnel struct {
+	PublicUrl string
+	Protocol  string
+	LocalAddr string
+}
+
+// The connection to the server and the tunnels it carries
+type SerializedTunnels struct {
+	// one of connecting, reconnecting or online
+	Status  string
+	Tunnels []SerializedTunnel
+}
+
+var connStatusNames = map[mvc.ConnStatus]string{
+	mvc.ConnConnecting:   "connecting",
+	mvc.ConnReconnecting: "reconnecting",
+	mvc.ConnOnline:       "online",
+}
+
+func serializeLatency(t metrics.Timer) SerializedLatency {
+	msec := float64(time.Millisecond)
+	ps := t.Percentiles([]float64{0.5, 0.95})
+	return SerializedLatency{
+		Count: t.Count(),
+		Mean:  t.Mean() / msec,
+		P50:   ps[0] / msec,
+		P95:   ps[1] / msec,
+	}
+}
+
 type WebView struct {
 	log.Logger
 
@@ -19,13 +70,20 @@ type WebView struct {
 
 	// messages sent over this broadcast are sent to all websocket connections
 	wsMessages *util.Broadcast
+
+	// where requests go when they drop out of the window, nil if they're dropped
+	history *History
+
+	// the http views, whose windows are saved to the history on shutdown
+	httpViews []*WebHttpView
 }
 
-func NewWebView(ctl mvc.Controller, addr string) *WebView {
+func NewWebView(ctl mvc.Controller, addr string, history *History) *WebView {
 	wv := &WebView{
 		Logger:     log.NewPrefixLogger("view", "web"),
 		wsMessages: util.NewBroadcast(),
 		ctl:        ctl,
+		history:    history,
 	}
 
 	// for now, always redirect to the http view
@@ -54,6 +112,57 @@ func NewWebView(ctl mvc.Controller, addr string) *WebView {
 		}
 	})
 
+	// latency and connection statistics for the local api
+	http.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		state := wv.ctl.State()
+		connMeter, _ := state.GetConnectionMetrics()
+		rttTimer, reqTimer := state.GetLatencyMetrics()
+
+		payload, err := json.Marshal(SerializedStats{
+			ConnCount:       connMeter.Count(),
+			HeartbeatRtt:    serializeLatency(rttTimer),
+			LocalResponse:   serializeLatency(reqTimer),
+			DroppedMessages: wv.wsMessages.Dropped(),
+		})
+		if err != nil {
+			wv.Error("Failed to serialize stats: %v", err)
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payload)
+	})
+
+	// the tunnels and whether we're connected, for ngrok status
+	http.HandleFunc("/api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+		state := wv.ctl.State()
+		tunnels := SerializedTunnels{
+			Status:  connStatusNames[state.GetConnStatus()],
+			Tunnels: make([]SerializedTunnel, 0),
+		}
+		for _, t := range state.GetTunnels() {
+			tunnels.Tunnels = append(tunnels.Tunnels, SerializedTunnel{
+				PublicUrl: t.PublicUrl,
+				Protocol:  t.Protocol.GetName(),
+				LocalAddr: t.LocalAddr,
+			})
+		}
+		sort.Slice(tunnels.Tunnels, func(i, j int) bool {
+			return tunnels.Tunnels[i].PublicUrl < tunnels.Tunnels[j].PublicUrl
+		})
+
+		payload, err := json.Marshal(tunnels)
+		if err != nil {
+			wv.Error("Failed to serialize tunnels: %v", err)
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payload)
+	})
+
 	// serve static assets
 	http.HandleFunc("/static/", func(w http.ResponseWriter, r *http.Request) {
 		buf, err := assets.Asset(path.Join("assets", "client", r.URL.Path[1:]))
@@ -71,8 +180,16 @@ func NewWebView(ctl mvc.Controller, addr string) *WebView {
 }
 
 func (wv *WebView) NewHttpView(proto *proto.Http) *WebHttpView {
-	return newWebHttpView(wv.ctl, wv, proto)
+	whv := newWebHttpView(wv.ctl, wv, proto)
+	wv.httpViews = append(wv.httpViews, whv)
+	return whv
 }
 
 func (wv *WebView) Shutdown() {
+	if wv.history != nil {
+		for _, whv := range wv.httpViews {
+			whv.flushHistory()
+		}
+		wv.history.Close()
+	}
 }
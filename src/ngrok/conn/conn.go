@@ -7,12 +7,17 @@ import (
 	"fmt"
 	vhost "github.com/inconshreveable/go-vhost"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"ngrok/log"
+	"ngrok/util"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Conn interface {
@@ -21,6 +26,7 @@ type Conn interface {
 	Id() string
 	SetType(string)
 	CloseRead() error
+	LimitReads(int64) func() bool
 }
 
 type loggedConn struct {
@@ -46,13 +52,23 @@ func wrapConn(conn net.Conn, typ string) *loggedConn {
 	case *net.TCPConn:
 		wrapped := &loggedConn{c, conn, log.NewPrefixLogger(), rand.Int31(), typ}
 		wrapped.AddLogPrefix(wrapped.Id())
+		wrapped.applySocketOptions()
+		return wrapped
+	default:
+		// in-process connections like net.Pipe() don't support CloseRead
+		wrapped := &loggedConn{nil, conn, log.NewPrefixLogger(), rand.Int31(), typ}
+		wrapped.AddLogPrefix(wrapped.Id())
 		return wrapped
 	}
-
-	return nil
 }
 
 func Listen(addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
+	return ListenProxied(addr, typ, tlsCfg, nil)
+}
+
+// Like Listen, but connections from the trusted networks may start with a
+// PROXY protocol header, which sets their remote address
+func ListenProxied(addr, typ string, tlsCfg *tls.Config, trusted []*net.IPNet) (l *Listener, err error) {
 	// listen for incoming connections
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -73,23 +89,48 @@ func Listen(addr, typ string, tlsCfg *tls.Config) (l *Listener, err error) {
 			}
 
 			c := wrapConn(rawConn, typ)
-			if tlsCfg != nil {
-				c.Conn = tls.Server(c.Conn, tlsCfg)
+			if tcpAddr, ok := rawConn.RemoteAddr().(*net.TCPAddr); ok && util.IpInNetworks(tcpAddr.IP, trusted) {
+				// don't hold up the accept loop waiting for the header
+				go func() {
+					if err := c.readProxyHeader(); err != nil {
+						c.Warn("Failed to read PROXY header: %v", err)
+						c.Close()
+						return
+					}
+					l.accept(c, tlsCfg)
+				}()
+				continue
 			}
-			c.Info("New connection from %v", c.RemoteAddr())
-			l.Conns <- c
+
+			l.accept(c, tlsCfg)
 		}
 	}()
 	return
 }
 
+func (l *Listener) accept(c *loggedConn, tlsCfg *tls.Config) {
+	if tlsCfg != nil {
+		c.Conn = tls.Server(c.Conn, tlsCfg)
+	}
+	c.Info("New connection from %v", c.RemoteAddr())
+	l.Conns <- c
+}
+
 func Wrap(conn net.Conn, typ string) *loggedConn {
 	return wrapConn(conn, typ)
 }
 
 func Dial(addr, typ string, tlsCfg *tls.Config) (conn *loggedConn, err error) {
 	var rawConn net.Conn
-	if rawConn, err = net.Dial("tcp", addr); err != nil {
+	if IsNamedPipe(addr) {
+		var path string
+		if path, err = PipePath(addr); err != nil {
+			return
+		}
+		if rawConn, err = dialPipe(path); err != nil {
+			return
+		}
+	} else if rawConn, err = net.Dial("tcp", addr); err != nil {
 		return
 	}
 
@@ -110,11 +151,6 @@ func DialHttpProxy(proxyUrl, addr, typ string, tlsCfg *tls.Config) (conn *logged
 		return
 	}
 
-	var proxyAuth string
-	if parsedUrl.User != nil {
-		proxyAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(parsedUrl.User.String()))
-	}
-
 	var proxyTlsConfig *tls.Config
 	switch parsedUrl.Scheme {
 	case "http":
@@ -131,24 +167,37 @@ func DialHttpProxy(proxyUrl, addr, typ string, tlsCfg *tls.Config) (conn *logged
 		return
 	}
 
-	// send an HTTP proxy CONNECT message
-	req, err := http.NewRequest("CONNECT", "https://"+addr, nil)
+	br := bufio.NewReader(conn)
+	resp, err := proxyConnect(conn, br, addr, "")
 	if err != nil {
 		return
 	}
 
-	if proxyAuth != "" {
-		req.Header.Set("Proxy-Authorization", proxyAuth)
-	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; ngrok)")
-	req.Write(conn)
+	// credentials are only sent once the proxy said how it wants them, so
+	// that a password meant for NTLM never goes out in the clear with Basic.
+	// Corporate proxies may only accept NTLM or Negotiate, we answer both
+	// with NTLM.
+	scheme := proxyAuthScheme(resp)
+	if scheme != "" && parsedUrl.User != nil {
+		if resp.Close {
+			conn.Close()
+			if conn, err = Dial(parsedUrl.Host, typ, proxyTlsConfig); err != nil {
+				return
+			}
+			br = bufio.NewReader(conn)
+		}
 
-	// read the proxy's response
-	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
-	if err != nil {
-		return
+		password, _ := parsedUrl.User.Password()
+		if strings.EqualFold(scheme, "Basic") {
+			auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(parsedUrl.User.Username()+":"+password))
+			resp, err = proxyConnect(conn, br, addr, auth)
+		} else {
+			resp, err = proxyNtlm(conn, br, addr, scheme, parsedUrl.User.Username(), password)
+		}
+		if err != nil {
+			return
+		}
 	}
-	resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		err = fmt.Errorf("Non-200 response from proxy server: %s", resp.Status)
@@ -161,10 +210,101 @@ func DialHttpProxy(proxyUrl, addr, typ string, tlsCfg *tls.Config) (conn *logged
 	return
 }
 
+// Sends a CONNECT request for addr and reads the proxy's response. The body
+// of an error response is read so the connection can be used again.
+func proxyConnect(c net.Conn, br *bufio.Reader, addr, auth string) (*http.Response, error) {
+	req, err := http.NewRequest("CONNECT", "https://"+addr, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; ngrok)")
+	if err = req.Write(c); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// a successful CONNECT has no body, the tunnel starts right away
+	if resp.StatusCode != 200 {
+		io.Copy(ioutil.Discard, resp.Body)
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// Returns the scheme to authenticate to the proxy with if it asked for
+// credentials: NTLM or Negotiate if it offers one of them, else Basic
+func proxyAuthScheme(resp *http.Response) string {
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		return ""
+	}
+
+	basic := ""
+	for _, challenge := range resp.Header["Proxy-Authenticate"] {
+		scheme := strings.TrimSpace(strings.SplitN(strings.TrimSpace(challenge), " ", 2)[0])
+		switch {
+		case strings.EqualFold(scheme, "NTLM"), strings.EqualFold(scheme, "Negotiate"):
+			return scheme
+		case strings.EqualFold(scheme, "Basic"):
+			basic = scheme
+		}
+	}
+	return basic
+}
+
+// Authenticates with NTLM over the connection, which has to stay open for
+// the whole exchange, and returns the response to the last CONNECT
+func proxyNtlm(c net.Conn, br *bufio.Reader, addr, scheme, user, password string) (*http.Response, error) {
+	resp, err := proxyConnect(c, br, addr, scheme+" "+base64.StdEncoding.EncodeToString(ntlmNegotiate()))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Close {
+		return nil, fmt.Errorf("Proxy didn't send an NTLM challenge: %s", resp.Status)
+	}
+
+	var challenge *ntlmChallenge
+	for _, h := range resp.Header["Proxy-Authenticate"] {
+		fields := strings.Fields(h)
+		if len(fields) != 2 || !strings.EqualFold(fields[0], scheme) {
+			continue
+		}
+
+		msg, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		if challenge, err = parseNtlmChallenge(msg); err != nil {
+			return nil, err
+		}
+	}
+	if challenge == nil {
+		return nil, fmt.Errorf("Proxy didn't send an NTLM challenge")
+	}
+
+	msg, err := ntlmAuthenticate(challenge, user, password)
+	if err != nil {
+		return nil, err
+	}
+	return proxyConnect(c, br, addr, scheme+" "+base64.StdEncoding.EncodeToString(msg))
+}
+
 func (c *loggedConn) StartTLS(tlsCfg *tls.Config) {
 	c.Conn = tls.Client(c.Conn, tlsCfg)
 }
 
+// Terminates TLS on an accepted connection
+func (c *loggedConn) StartTLSServer(tlsCfg *tls.Config) {
+	c.Conn = tls.Server(c.Conn, tlsCfg)
+}
+
 func (c *loggedConn) Close() (err error) {
 	if err := c.Conn.Close(); err == nil {
 		c.Debug("Closing")
@@ -182,6 +322,7 @@ func (c *loggedConn) SetType(typ string) {
 	c.ClearLogPrefixes()
 	c.AddLogPrefix(c.Id())
 	c.Info("Renamed connection %s", oldId)
+	c.applySocketOptions()
 }
 
 func (c *loggedConn) CloseRead() error {
@@ -189,11 +330,66 @@ func (c *loggedConn) CloseRead() error {
 	// connection termination. Unfortunately, when I've tried that, I've observed
 	// failures where the connection was closed *before* flushing its write buffer,
 	// set with SetLinger() set properly (which it is by default).
+	if c.tcp == nil {
+		return fmt.Errorf("CloseRead is not supported on %s", c.Id())
+	}
 	return c.tcp.CloseRead()
 }
 
+// Fails reads once n more bytes were read, until the returned function is
+// called. It lifts the limit and reports whether a read was refused.
+func (c *loggedConn) LimitReads(n int64) func() bool {
+	limited := &limitedConn{Conn: c.Conn, remaining: n}
+	c.Conn = limited
+	return func() bool {
+		c.Conn = limited.Conn
+		return limited.exceeded
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	remaining int64
+	exceeded  bool
+}
+
+func (c *limitedConn) Read(p []byte) (n int, err error) {
+	if c.remaining == 0 {
+		c.exceeded = true
+		return 0, fmt.Errorf("Read limit reached")
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err = c.Conn.Read(p)
+	c.remaining -= int64(n)
+	return
+}
+
 func Join(c Conn, c2 Conn) (int64, int64) {
+	return JoinIdle(c, c2, 0)
+}
+
+// counts reads so that idle joined connections can be noticed
+type activityReader struct {
+	io.Reader
+	last *int64
+}
+
+func (r *activityReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	if n > 0 {
+		atomic.StoreInt64(r.last, time.Now().UnixNano())
+	}
+	return
+}
+
+// Like Join, but closes both connections once no data has passed
+// in either direction for the idle timeout. A zero timeout never does.
+func JoinIdle(c Conn, c2 Conn, idle time.Duration) (int64, int64) {
 	var wait sync.WaitGroup
+	last := time.Now().UnixNano()
 
 	pipe := func(to Conn, from Conn, bytesCopied *int64) {
 		defer to.Close()
@@ -201,7 +397,7 @@ func Join(c Conn, c2 Conn) (int64, int64) {
 		defer wait.Done()
 
 		var err error
-		*bytesCopied, err = io.Copy(to, from)
+		*bytesCopied, err = io.Copy(to, &activityReader{from, &last})
 		if err != nil {
 			from.Warn("Copied %d bytes to %s before failing with error %v", *bytesCopied, to.Id(), err)
 		} else {
@@ -214,6 +410,38 @@ func Join(c Conn, c2 Conn) (int64, int64) {
 	go pipe(c, c2, &fromBytes)
 	go pipe(c2, c, &toBytes)
 	c.Info("Joined with connection %s", c2.Id())
+
+	if idle > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go watchIdle(c, c2, idle, &last, done)
+	}
+
 	wait.Wait()
 	return fromBytes, toBytes
 }
+
+func watchIdle(c Conn, c2 Conn, idle time.Duration, last *int64, done chan struct{}) {
+	check := idle / 4
+	if check < time.Second {
+		check = time.Second
+	}
+
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(last))) >= idle {
+				c.Info("Closing connection to %s after being idle for %s", c2.Id(), idle)
+				c.Close()
+				c2.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package conn
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Local addresses like npipe:////./pipe/docker_engine are Windows named pipes
+const NamedPipePrefix = "npipe://"
+
+var pipePattern = regexp.MustCompile(`^\\\\[^\\]+\\pipe\\[^\\]+$`)
+
+func IsNamedPipe(addr string) bool {
+	return strings.HasPrefix(addr, NamedPipePrefix)
+}
+
+// Translates npipe:////./pipe/name to the pipe's path \\.\pipe\name
+func PipePath(addr string) (string, error) {
+	path := strings.Replace(strings.TrimPrefix(addr, NamedPipePrefix), "/", `\`, -1)
+	if !pipePattern.MatchString(path) {
+		return "", fmt.Errorf("expected a named pipe like npipe:////./pipe/name")
+	}
+	return path, nil
+}
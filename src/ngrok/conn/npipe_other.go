@@ -0,0 +1,12 @@
+// +build !windows
+
+package conn
+
+import (
+	"fmt"
+	"net"
+)
+
+func dialPipe(path string) (net.Conn, error) {
+	return nil, fmt.Errorf("named pipes are only supported on Windows")
+}
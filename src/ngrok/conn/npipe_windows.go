@@ -0,0 +1,14 @@
+package conn
+
+import (
+	"github.com/Microsoft/go-winio"
+	"net"
+	"time"
+)
+
+const pipeTimeout = 10 * time.Second
+
+func dialPipe(path string) (net.Conn, error) {
+	timeout := pipeTimeout
+	return winio.DialPipe(path, &timeout)
+}
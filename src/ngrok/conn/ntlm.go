@@ -0,0 +1,173 @@
+package conn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/md4"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLM authentication with corporate proxies, as described in [MS-NLMP],
+// with the credentials from the proxy URL. Only NTLMv2 responses are sent.
+// Proxies that offer Negotiate get the same raw NTLM messages, not wrapped in
+// SPNEGO, which Windows proxies accept in place of a Kerberos ticket. There's
+// no Kerberos and no single sign-on with the user's Windows login.
+
+const (
+	ntlmNegotiateUnicode          = 0x00000001
+	ntlmNegotiateOEM              = 0x00000002
+	ntlmRequestTarget             = 0x00000004
+	ntlmNegotiateNTLM             = 0x00000200
+	ntlmNegotiateAlwaysSign       = 0x00008000
+	ntlmNegotiateExtendedSecurity = 0x00080000
+
+	ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget | ntlmNegotiateNTLM | ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSecurity
+
+	// the MsvAvTimestamp pair of the target info
+	ntlmAvTimestamp = 7
+
+	// between 1601 and 1970 in units of 100ns, for Windows timestamps
+	ntlmEpochOffset = 116444736000000000
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// The first message, asking the proxy for a challenge
+func ntlmNegotiate() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmNegotiateFlags)
+	return msg
+}
+
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+func parseNtlmChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, fmt.Errorf("Not an NTLM challenge")
+	}
+
+	c := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(msg[20:]),
+		challenge: msg[24:32],
+	}
+
+	// older servers leave out the target info
+	if len(msg) >= 48 {
+		length := int(binary.LittleEndian.Uint16(msg[40:]))
+		offset := int(binary.LittleEndian.Uint32(msg[44:]))
+		if offset+length > len(msg) {
+			return nil, fmt.Errorf("Malformed NTLM challenge")
+		}
+		c.targetInfo = msg[offset : offset+length]
+	}
+
+	return c, nil
+}
+
+// The server's timestamp from the target info, if it sent one
+func (c *ntlmChallenge) timestamp() []byte {
+	info := c.targetInfo
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == 0 || len(info) < 4+length {
+			break
+		}
+		if id == ntlmAvTimestamp && length == 8 {
+			return info[4:12]
+		}
+		info = info[4+length:]
+	}
+	return nil
+}
+
+// The last message, answering the challenge with the credentials. The user
+// may include the domain as DOMAIN\user.
+func ntlmAuthenticate(c *ntlmChallenge, user, password string) ([]byte, error) {
+	var domain string
+	if i := strings.Index(user, `\`); i >= 0 {
+		domain, user = user[:i], user[i+1:]
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	timestamp := c.timestamp()
+	serverTimestamp := timestamp != nil
+	if !serverTimestamp {
+		timestamp = make([]byte, 8)
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+ntlmEpochOffset))
+	}
+
+	// NTOWFv2
+	hash := md4.New()
+	hash.Write(utf16le(password))
+	key := hmacMd5(hash.Sum(nil), utf16le(strings.ToUpper(user)+domain))
+
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(c.targetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+
+	ntProof := hmacMd5(key, append(append([]byte(nil), c.challenge...), temp.Bytes()...))
+	ntResponse := append(ntProof, temp.Bytes()...)
+
+	// the LMv2 response is left empty when the server sent a timestamp
+	lmResponse := make([]byte, 24)
+	if !serverTimestamp {
+		lmResponse = append(hmacMd5(key, append(append([]byte(nil), c.challenge...), clientChallenge...)), clientChallenge...)
+	}
+
+	fields := [][]byte{lmResponse, ntResponse, utf16le(domain), utf16le(user), utf16le(""), nil}
+
+	const headerLen = 64
+	msg := make([]byte, headerLen)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+
+	offset := headerLen
+	for i, f := range fields {
+		binary.LittleEndian.PutUint16(msg[12+8*i:], uint16(len(f)))
+		binary.LittleEndian.PutUint16(msg[14+8*i:], uint16(len(f)))
+		binary.LittleEndian.PutUint32(msg[16+8*i:], uint32(offset))
+		offset += len(f)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], c.flags&ntlmNegotiateFlags|ntlmNegotiateUnicode)
+
+	for _, f := range fields {
+		msg = append(msg, f...)
+	}
+	return msg, nil
+}
+
+func hmacMd5(key, data []byte) []byte {
+	mac := hmac.New(md5.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
@@ -0,0 +1,116 @@
+package conn
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyHeaderPrefix  = "PROXY "
+	proxyHeaderMaxLen  = 107
+	proxyHeaderTimeout = 10 * time.Second
+)
+
+// A connection whose first bytes were already read looking for a PROXY
+// header and whose client address may come from that header
+type proxiedConn struct {
+	net.Conn
+	r      io.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Reads a PROXY protocol v1 header, if the connection starts with one, and
+// reports the client address it carries as the connection's remote address
+// from then on. The header is read byte by byte so nothing past it is consumed,
+// and the bytes read from connections without one are replayed.
+func (c *loggedConn) readProxyHeader() error {
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	line := make([]byte, 0, proxyHeaderMaxLen)
+	b := make([]byte, 1)
+	for len(line) < proxyHeaderMaxLen {
+		if _, err := c.Conn.Read(b); err != nil {
+			return err
+		}
+		line = append(line, b[0])
+
+		if len(line) <= len(proxyHeaderPrefix) && b[0] != proxyHeaderPrefix[len(line)-1] {
+			// not a PROXY header, give back what we've read
+			c.Conn = &proxiedConn{c.Conn, io.MultiReader(strings.NewReader(string(line)), c.Conn), nil}
+			return nil
+		}
+
+		if b[0] == '\n' {
+			remote, err := parseProxyHeader(string(line))
+			if err != nil {
+				return err
+			}
+
+			c.Conn = &proxiedConn{c.Conn, c.Conn, remote}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("PROXY header is longer than %d bytes", proxyHeaderMaxLen)
+}
+
+// Parses a line like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n" and
+// returns the source address. UNKNOWN headers return a nil address.
+func parseProxyHeader(line string) (net.Addr, error) {
+	fields := strings.Fields(strings.TrimSuffix(line, "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Malformed PROXY header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("Malformed PROXY header: %q", line)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// Builds a PROXY protocol v1 header announcing the visitor's address as the
+// source of the connection. The destination is the address dialed to reach
+// the receiving end, since the original one isn't always known, e.g. the
+// local service's address on the client.
+func ProxyHeader(clientAddr string, dstAddr net.Addr) string {
+	srcHost, srcPort, err := net.SplitHostPort(clientAddr)
+	srcIp := net.ParseIP(srcHost)
+	dst, ok := dstAddr.(*net.TCPAddr)
+	if err != nil || srcIp == nil || !ok {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	// the header can't mix address families
+	family := "TCP4"
+	if srcIp.To4() == nil {
+		family = "TCP6"
+	}
+	if (srcIp.To4() == nil) != (dst.IP.To4() == nil) {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	return fmt.Sprintf("PROXY %s %s %s %s %d\r\n", family, srcIp, dst.IP, srcPort, dst.Port)
+}
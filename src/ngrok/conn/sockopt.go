@@ -0,0 +1,128 @@
+package conn
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tuning of the TCP sockets of one type of connection
+type SocketOptions struct {
+	// interval of keepalive probes, 0 keeps the default, negative disables them
+	KeepAlive time.Duration
+
+	// set TCP_NODELAY, nil keeps the default (on)
+	NoDelay *bool
+
+	// sizes of the kernel buffers in bytes, 0 keeps the OS default
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+var (
+	socketOptions      = make(map[string]*SocketOptions)
+	socketOptionsMutex sync.RWMutex
+)
+
+// Sets the options applied to every TCP connection of the given type,
+// e.g. "pub", "ctl", "pxy" or "prv"
+func SetSocketOptions(typ string, opts *SocketOptions) {
+	socketOptionsMutex.Lock()
+	defer socketOptionsMutex.Unlock()
+	socketOptions[typ] = opts
+}
+
+func getSocketOptions(typ string) *SocketOptions {
+	socketOptionsMutex.RLock()
+	defer socketOptionsMutex.RUnlock()
+	return socketOptions[typ]
+}
+
+// Parses socket options like "keepalive=30s,nodelay=false,readbuf=262144,writebuf=262144"
+func ParseSocketOptions(spec string) (*SocketOptions, error) {
+	opts := new(SocketOptions)
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid socket option '%s', expected name=value", field)
+		}
+
+		name, value := strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1])
+		var err error
+		switch name {
+		case "keepalive":
+			if value == "off" {
+				opts.KeepAlive = -1
+			} else if opts.KeepAlive, err = time.ParseDuration(value); err == nil && opts.KeepAlive <= 0 {
+				err = fmt.Errorf("it must be positive or 'off'")
+			}
+		case "nodelay":
+			var noDelay bool
+			if noDelay, err = strconv.ParseBool(value); err == nil {
+				opts.NoDelay = &noDelay
+			}
+		case "readbuf":
+			if opts.ReadBuffer, err = strconv.Atoi(value); err == nil && opts.ReadBuffer <= 0 {
+				err = fmt.Errorf("it must be positive")
+			}
+		case "writebuf":
+			if opts.WriteBuffer, err = strconv.Atoi(value); err == nil && opts.WriteBuffer <= 0 {
+				err = fmt.Errorf("it must be positive")
+			}
+		default:
+			return nil, fmt.Errorf("Unknown socket option '%s', expected one of: keepalive, nodelay, readbuf, writebuf", name)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value '%s' for socket option %s: %v", value, name, err)
+		}
+	}
+
+	return opts, nil
+}
+
+func (o *SocketOptions) apply(c *net.TCPConn) (err error) {
+	switch {
+	case o.KeepAlive < 0:
+		err = c.SetKeepAlive(false)
+	case o.KeepAlive > 0:
+		if err = c.SetKeepAlive(true); err == nil {
+			err = c.SetKeepAlivePeriod(o.KeepAlive)
+		}
+	}
+
+	if err == nil && o.NoDelay != nil {
+		err = c.SetNoDelay(*o.NoDelay)
+	}
+
+	if err == nil && o.ReadBuffer > 0 {
+		err = c.SetReadBuffer(o.ReadBuffer)
+	}
+
+	if err == nil && o.WriteBuffer > 0 {
+		err = c.SetWriteBuffer(o.WriteBuffer)
+	}
+
+	return
+}
+
+// applies the socket options configured for the connection's current type
+func (c *loggedConn) applySocketOptions() {
+	if c.tcp == nil {
+		return
+	}
+
+	if opts := getSocketOptions(c.typ); opts != nil {
+		if err := opts.apply(c.tcp); err != nil {
+			c.Warn("Failed to set socket options: %v", err)
+		}
+	}
+}
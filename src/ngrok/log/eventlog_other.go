@@ -0,0 +1,12 @@
+// +build !windows
+
+package log
+
+import (
+	log "code.google.com/p/log4go"
+	"fmt"
+)
+
+func newEventLogWriter(source string) (log.LogWriter, error) {
+	return nil, fmt.Errorf("The event log is only available on Windows")
+}
@@ -0,0 +1,36 @@
+package log
+
+import (
+	log "code.google.com/p/log4go"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// the event id of all our messages, the event log wants one
+const eventId = 1
+
+type eventLogWriter struct {
+	*eventlog.Log
+}
+
+func newEventLogWriter(source string) (log.LogWriter, error) {
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	return &eventLogWriter{l}, nil
+}
+
+func (w *eventLogWriter) LogWrite(rec *log.LogRecord) {
+	switch {
+	case rec.Level >= log.ERROR:
+		w.Error(eventId, rec.Message)
+	case rec.Level >= log.WARNING:
+		w.Warning(eventId, rec.Message)
+	default:
+		w.Info(eventId, rec.Message)
+	}
+}
+
+func (w *eventLogWriter) Close() {
+	w.Log.Close()
+}
@@ -3,10 +3,75 @@ package log
 import (
 	log "code.google.com/p/log4go"
 	"fmt"
+	"strings"
 )
 
 var root log.Logger = make(log.Logger)
 
+// level names in increasing order of severity, like log4go's levels
+var levelNames = []string{"FINEST", "FINE", "DEBUG", "TRACE", "INFO", "WARNING", "ERROR", "CRITICAL"}
+
+// subsystems whose loggers are named after their connection types
+var subsystemAliases = map[string][]string{
+	"control": {"ctl"},
+	"proxy":   {"pxy", "pub", "prv"},
+}
+
+var (
+	// the default level and the levels of subsystems, by the log prefixes of
+	// their loggers
+	defaultLevel    = int(log.DEBUG)
+	subsystemLevels = make(map[string]int)
+)
+
+func parseLevel(name string) (int, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == "WARN" {
+		name = "WARNING"
+	}
+
+	for i, n := range levelNames {
+		if n == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid log level %s, must be one of: %s", name, strings.Join(levelNames, ", "))
+}
+
+// Parses levels like INFO or INFO,control=DEBUG,proxy=WARN. Subsystems are
+// the prefixes of their log messages, like registry or extauth, and entries
+// without one set the default level.
+func ParseLevels(spec string) (def int, subsystems map[string]int, err error) {
+	def = int(log.DEBUG)
+	subsystems = make(map[string]int)
+
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 1 {
+			if def, err = parseLevel(parts[0]); err != nil {
+				return
+			}
+			continue
+		}
+
+		var lvl int
+		if lvl, err = parseLevel(parts[1]); err != nil {
+			return
+		}
+
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		subsystems[name] = lvl
+		for _, alias := range subsystemAliases[name] {
+			subsystems[alias] = lvl
+		}
+	}
+	return
+}
+
 func LogTo(target string, level_name string) {
 	var writer log.LogWriter = nil
 
@@ -20,31 +85,42 @@ func LogTo(target string, level_name string) {
 	}
 
 	if writer != nil {
-		var level = log.DEBUG
-
-		switch level_name {
-		case "FINEST":
-			level = log.FINEST
-		case "FINE":
-			level = log.FINE
-		case "DEBUG":
-			level = log.DEBUG
-		case "TRACE":
-			level = log.TRACE
-		case "INFO":
-			level = log.INFO
-		case "WARNING":
-			level = log.WARNING
-		case "ERROR":
-			level = log.ERROR
-		case "CRITICAL":
-			level = log.CRITICAL
-		default:
-			level = log.DEBUG
+		logToWriter(writer, level_name)
+	}
+}
+
+// Logs to the Windows event log, as the source called source
+func LogToEventLog(source string, level_name string) error {
+	writer, err := newEventLogWriter(source)
+	if err != nil {
+		return err
+	}
+
+	logToWriter(writer, level_name)
+	return nil
+}
+
+func logToWriter(writer log.LogWriter, level_name string) {
+	def, subsystems, err := ParseLevels(level_name)
+	if err != nil {
+		def, subsystems = int(log.DEBUG), make(map[string]int)
+	}
+	defaultLevel, subsystemLevels = def, subsystems
+
+	// let through everything some logger wants, the loggers filter the rest
+	min := def
+	for _, lvl := range subsystems {
+		if lvl < min {
+			min = lvl
 		}
+	}
 
-		root.AddFilter("log", level, writer)
+	level := log.FINEST
+	for int(level) < min {
+		level++
 	}
+
+	root.AddFilter("log", level, writer)
 }
 
 type Logger interface {
@@ -59,6 +135,9 @@ type Logger interface {
 type PrefixLogger struct {
 	*log.Logger
 	prefix string
+
+	// the prefixes without connection ids, to look up subsystem levels
+	names []string
 }
 
 func NewPrefixLogger(prefixes ...string) Logger {
@@ -75,19 +154,39 @@ func (pl *PrefixLogger) pfx(fmtstr string) interface{} {
 	return fmt.Sprintf("%s %s", pl.prefix, fmtstr)
 }
 
+// The level of the first prefix that has one, the default level otherwise
+func (pl *PrefixLogger) enabled(lvl int) bool {
+	for _, name := range pl.names {
+		if l, ok := subsystemLevels[name]; ok {
+			return lvl >= l
+		}
+	}
+	return lvl >= defaultLevel
+}
+
 func (pl *PrefixLogger) Debug(arg0 string, args ...interface{}) {
-	pl.Logger.Debug(pl.pfx(arg0), args...)
+	if pl.enabled(int(log.DEBUG)) {
+		pl.Logger.Debug(pl.pfx(arg0), args...)
+	}
 }
 
 func (pl *PrefixLogger) Info(arg0 string, args ...interface{}) {
-	pl.Logger.Info(pl.pfx(arg0), args...)
+	if pl.enabled(int(log.INFO)) {
+		pl.Logger.Info(pl.pfx(arg0), args...)
+	}
 }
 
 func (pl *PrefixLogger) Warn(arg0 string, args ...interface{}) error {
+	if !pl.enabled(int(log.WARNING)) {
+		return fmt.Errorf(pl.prefix+" "+arg0, args...)
+	}
 	return pl.Logger.Warn(pl.pfx(arg0), args...)
 }
 
 func (pl *PrefixLogger) Error(arg0 string, args ...interface{}) error {
+	if !pl.enabled(int(log.ERROR)) {
+		return fmt.Errorf(pl.prefix+" "+arg0, args...)
+	}
 	return pl.Logger.Error(pl.pfx(arg0), args...)
 }
 
@@ -97,19 +196,27 @@ func (pl *PrefixLogger) AddLogPrefix(prefix string) {
 	}
 
 	pl.prefix += "[" + prefix + "]"
+
+	// connections log with their type and id, like ctl:1a2b3c
+	pl.names = append(pl.names, strings.SplitN(prefix, ":", 2)[0])
 }
 
 func (pl *PrefixLogger) ClearLogPrefixes() {
 	pl.prefix = ""
+	pl.names = nil
 }
 
 // we should never really use these . . . always prefer logging through a prefix logger
 func Debug(arg0 string, args ...interface{}) {
-	root.Debug(arg0, args...)
+	if int(log.DEBUG) >= defaultLevel {
+		root.Debug(arg0, args...)
+	}
 }
 
 func Info(arg0 string, args ...interface{}) {
-	root.Info(arg0, args...)
+	if int(log.INFO) >= defaultLevel {
+		root.Info(arg0, args...)
+	}
 }
 
 func Warn(arg0 string, args ...interface{}) error {
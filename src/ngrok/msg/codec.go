@@ -0,0 +1,93 @@
+package msg
+
+import (
+	"encoding/json"
+	"github.com/ugorji/go/codec"
+)
+
+// A Codec encodes messages on the wire. Control channels start out with JSON
+// and switch to the encoding the server picks from those the client offers
+// in its Auth message once the AuthResp is sent.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	Msgpack Codec = newMsgpackCodec()
+
+	// all supported codecs, in order of preference
+	Codecs = []Codec{Msgpack, JSON}
+)
+
+// Returns the supported codec with the given name, nil if there's none
+func CodecByName(name string) Codec {
+	for _, c := range Codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Returns the names of all supported codecs, in order of preference
+func CodecNames() []string {
+	names := make([]string, len(Codecs))
+	for i, c := range Codecs {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// Picks the first of the offered codecs that is allowed, JSON if there's none
+func Negotiate(offered []string, allowed []string) Codec {
+	for _, name := range offered {
+		for _, a := range allowed {
+			if name == a {
+				if c := CodecByName(name); c != nil {
+					return c
+				}
+			}
+		}
+	}
+	return JSON
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return strictUnmarshal(data, v)
+}
+
+type msgpackCodec struct {
+	handle *codec.MsgpackHandle
+}
+
+func newMsgpackCodec() msgpackCodec {
+	h := new(codec.MsgpackHandle)
+	h.WriteExt = true
+	h.RawToString = true
+
+	// the schema is strict, messages with fields we don't know are invalid
+	h.ErrorIfNoField = true
+	return msgpackCodec{h}
+}
+
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (c msgpackCodec) Marshal(v interface{}) (buf []byte, err error) {
+	err = codec.NewEncoderBytes(&buf, c.handle).Encode(v)
+	return
+}
+
+func (c msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, c.handle).Decode(v)
+}
@@ -4,10 +4,22 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"ngrok/conn"
 )
 
+// Largest message accepted, anything longer is an error
+var MaxMsgSize int64 = 256 * 1024
+
+// Largest message accepted from cluster peers. Their gossip lists all the
+// tunnels and reservations of a node, so it outgrows MaxMsgSize on busy nodes.
+var MaxPeerMsgSize int64 = 64 * 1024 * 1024
+
 func readMsgShared(c conn.Conn) (buffer []byte, err error) {
+	return readMsgLimit(c, MaxMsgSize)
+}
+
+func readMsgLimit(c conn.Conn, max int64) (buffer []byte, err error) {
 	c.Debug("Waiting to read message")
 
 	var sz int64
@@ -17,16 +29,17 @@ func readMsgShared(c conn.Conn) (buffer []byte, err error) {
 	}
 	c.Debug("Reading message with length: %d", sz)
 
+	if sz < 0 || sz > max {
+		err = errors.New(fmt.Sprintf("Message length %d is not between 0 and %d bytes", sz, max))
+		return
+	}
+
 	buffer = make([]byte, sz)
-	n, err := c.Read(buffer)
+	n, err := io.ReadFull(c, buffer)
 	c.Debug("Read message %s", buffer)
 
 	if err != nil {
-		return
-	}
-
-	if int64(n) != sz {
-		err = errors.New(fmt.Sprintf("Expected to read %d bytes, but only read %d", sz, n))
+		err = errors.New(fmt.Sprintf("Expected to read %d bytes, but only read %d: %v", sz, n, err))
 		return
 	}
 
@@ -34,12 +47,16 @@ func readMsgShared(c conn.Conn) (buffer []byte, err error) {
 }
 
 func ReadMsg(c conn.Conn) (msg Message, err error) {
+	return ReadMsgWith(c, JSON)
+}
+
+func ReadMsgWith(c conn.Conn, codec Codec) (msg Message, err error) {
 	buffer, err := readMsgShared(c)
 	if err != nil {
 		return
 	}
 
-	return Unpack(buffer)
+	return UnpackWith(codec, buffer)
 }
 
 func ReadMsgInto(c conn.Conn, msg Message) (err error) {
@@ -50,13 +67,39 @@ func ReadMsgInto(c conn.Conn, msg Message) (err error) {
 	return UnpackInto(buffer, msg)
 }
 
+// Like ReadMsg, for connections between cluster peers
+func ReadPeerMsg(c conn.Conn) (msg Message, err error) {
+	buffer, err := readMsgLimit(c, MaxPeerMsgSize)
+	if err != nil {
+		return
+	}
+	return Unpack(buffer)
+}
+
+// Like ReadMsgInto, for connections between cluster peers
+func ReadPeerMsgInto(c conn.Conn, msg Message) (err error) {
+	buffer, err := readMsgLimit(c, MaxPeerMsgSize)
+	if err != nil {
+		return
+	}
+	return UnpackInto(buffer, msg)
+}
+
 func WriteMsg(c conn.Conn, msg interface{}) (err error) {
-	buffer, err := Pack(msg)
+	return WriteMsgWith(c, JSON, msg)
+}
+
+func WriteMsgWith(c conn.Conn, codec Codec, msg interface{}) (err error) {
+	buffer, err := PackWith(codec, msg)
 	if err != nil {
 		return
 	}
 
-	c.Debug("Writing message: %s", string(buffer))
+	if codec == JSON {
+		c.Debug("Writing message: %s", string(buffer))
+	} else {
+		c.Debug("Writing %s message: %+v", codec.Name(), msg)
+	}
 	err = binary.Write(c, binary.LittleEndian, int64(len(buffer)))
 
 	if err != nil {
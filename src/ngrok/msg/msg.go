@@ -20,6 +20,9 @@ func init() {
 	TypeMap["StartProxy"] = t((*StartProxy)(nil))
 	TypeMap["Ping"] = t((*Ping)(nil))
 	TypeMap["Pong"] = t((*Pong)(nil))
+	TypeMap["PeerForward"] = t((*PeerForward)(nil))
+	TypeMap["PeerForwardResp"] = t((*PeerForwardResp)(nil))
+	TypeMap["PeerGossip"] = t((*PeerGossip)(nil))
 }
 
 type Message interface{}
@@ -38,7 +41,8 @@ type Auth struct {
 	Password  string
 	OS        string
 	Arch      string
-	ClientId  string // empty for new sessions
+	ClientId  string   // empty for new sessions
+	Encodings []string // codecs the client supports, in order of preference
 }
 
 // A server responds to an Auth message with an
@@ -51,11 +55,15 @@ type Auth struct {
 // The server response includes a unique ClientId
 // that is used to associate and authenticate future
 // proxy connections via the same field in RegProxy messages.
+//
+// The AuthResp is always JSON, the messages after it on
+// the control channel use the Encoding the server picked.
 type AuthResp struct {
 	Version   string
 	MmVersion string
 	ClientId  string
 	Error     string
+	Encoding  string // codec of the following messages, JSON if empty
 }
 
 // A client sends this message to the server over the control channel
@@ -70,9 +78,41 @@ type ReqTunnel struct {
 	Hostname  string
 	Subdomain string
 	HttpAuth  string
+	Cache     bool // cache responses at the server when they allow it
+
+	// origins allowed to make cross-origin requests, "*" for any. The server
+	// answers preflights and adds the CORS headers to responses.
+	CorsOrigins []string
+
+	// applied in order to the path of each request before it's forwarded
+	Rewrites []RewriteRule
+
+	// point redirects to localhost at the public URL instead
+	RewriteLocation bool
 
-	// tcp only
+	// tcp and socks only
 	RemotePort uint16
+
+	// tcp and socks only, the server's public IP to bind the remote port on,
+	// all of them if empty
+	RemoteIp string
+
+	// tcp only, terminate TLS at the server before proxying
+	Tls bool
+
+	// seconds a proxied connection may stay idle before the server
+	// closes it, 0 for the server's default
+	IdleTimeout int64
+}
+
+// A rewrite of request paths, only one of StripPrefix, AddPrefix or
+// Match may be set. Match is a regular expression whose matches are
+// replaced with Replace, which may refer to groups like $1.
+type RewriteRule struct {
+	StripPrefix string
+	AddPrefix   string
+	Match       string
+	Replace     string
 }
 
 // When the server opens a new tunnel on behalf of
@@ -106,6 +146,7 @@ type RegProxy struct {
 type StartProxy struct {
 	Url        string // URL of the tunnel this connection connection is being proxied for
 	ClientAddr string // Network address of the client initiating the connection to the tunnel
+	Queued     int64  // Nanoseconds the connection waited on the server for this proxy connection
 }
 
 // A client or server may send this message periodically over
@@ -118,3 +159,38 @@ type Ping struct {
 // it received a Ping.
 type Pong struct {
 }
+
+// When a server of a cluster receives a public connection for a tunnel it
+// doesn't have, it relays the connection to the other servers. It connects
+// to a peer, sends a PROXY header with the visitor's address, then this
+// message with the URL of the tunnel and the secret shared by the cluster.
+type PeerForward struct {
+	Url    string
+	Secret string
+}
+
+// A peer responds to a PeerForward message with an empty Error if it has the
+// tunnel, after which the connection carries the visitor's stream.
+type PeerForwardResp struct {
+	Error string
+}
+
+// The servers of a cluster regularly exchange what they know with PeerGossip
+// messages. A server connects to a peer and sends its own state, the peer
+// responds with its own.
+//
+// Node is a random id of the sender, which tells it when it reached itself.
+// Addr is where the sender listens for peers, empty if it doesn't. A sender
+// listening on all interfaces leaves the host out, e.g. ":4444".
+// Members lists the addresses of the other servers the sender knows about.
+// Tunnels lists the URLs of the tunnels connected to the sender.
+// Reservations maps the affinity keys of recently connected clients to
+// their URLs, so that they get them back from any server.
+type PeerGossip struct {
+	Secret       string
+	Node         string
+	Addr         string
+	Members      []string
+	Tunnels      []string
+	Reservations map[string]string
+}
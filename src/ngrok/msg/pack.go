@@ -1,51 +1,111 @@
 package msg
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
 )
 
-func unpack(buffer []byte, msgIn Message) (msg Message, err error) {
-	var env Envelope
-	if err = json.Unmarshal(buffer, &env); err != nil {
+// The envelope of codecs other than JSON, whose payloads are encoded separately
+type binaryEnvelope struct {
+	Type    string
+	Payload []byte
+}
+
+func newMessage(typ string) (msg Message, err error) {
+	t, ok := TypeMap[typ]
+	if !ok {
+		err = errors.New(fmt.Sprintf("Unsupported message type %s", typ))
 		return
 	}
 
-	if msgIn == nil {
-		t, ok := TypeMap[env.Type]
+	// guess type
+	return reflect.New(t).Interface().(Message), nil
+}
 
-		if !ok {
-			err = errors.New(fmt.Sprintf("Unsupported message type %s", env.Type))
+func unpack(codec Codec, buffer []byte, msgIn Message) (msg Message, err error) {
+	var typ string
+	var payload []byte
+	if codec == JSON {
+		var env Envelope
+		if err = strictUnmarshal(buffer, &env); err != nil {
+			return
+		}
+		typ, payload = env.Type, env.Payload
+	} else {
+		var env binaryEnvelope
+		if err = codec.Unmarshal(buffer, &env); err != nil {
 			return
 		}
+		typ, payload = env.Type, env.Payload
+	}
 
-		// guess type
-		msg = reflect.New(t).Interface().(Message)
+	if msgIn == nil {
+		if msg, err = newMessage(typ); err != nil {
+			return
+		}
 	} else {
 		msg = msgIn
 	}
 
-	err = json.Unmarshal(env.Payload, &msg)
+	if codec == JSON {
+		err = strictUnmarshal(payload, msg)
+	} else {
+		err = codec.Unmarshal(payload, msg)
+	}
+	if err != nil {
+		return
+	}
+
+	if v, ok := msg.(validator); ok {
+		if err = v.Validate(); err != nil {
+			err = fmt.Errorf("Invalid %s message: %v", typ, err)
+		}
+	}
 	return
 }
 
+// Like json.Unmarshal, but fields the message doesn't have are an error
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
 func UnpackInto(buffer []byte, msg Message) (err error) {
-	_, err = unpack(buffer, msg)
+	_, err = unpack(JSON, buffer, msg)
 	return
 }
 
 func Unpack(buffer []byte) (msg Message, err error) {
-	return unpack(buffer, nil)
+	return unpack(JSON, buffer, nil)
+}
+
+func UnpackWith(codec Codec, buffer []byte) (msg Message, err error) {
+	return unpack(codec, buffer, nil)
 }
 
 func Pack(payload interface{}) ([]byte, error) {
-	return json.Marshal(struct {
-		Type    string
-		Payload interface{}
-	}{
-		Type:    reflect.TypeOf(payload).Elem().Name(),
-		Payload: payload,
-	})
+	return PackWith(JSON, payload)
+}
+
+func PackWith(codec Codec, payload interface{}) ([]byte, error) {
+	typ := reflect.TypeOf(payload).Elem().Name()
+	if codec == JSON {
+		return json.Marshal(struct {
+			Type    string
+			Payload interface{}
+		}{
+			Type:    typ,
+			Payload: payload,
+		})
+	}
+
+	buf, err := codec.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Marshal(&binaryEnvelope{Type: typ, Payload: buf})
 }
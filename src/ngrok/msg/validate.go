@@ -0,0 +1,142 @@
+package msg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxIdLen     = 64
+	maxNameLen   = 64
+	maxSecretLen = 1024
+	maxUrlLen    = 2048
+	maxListLen   = 32
+)
+
+var (
+	hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?\.)*[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?$`)
+	idPattern       = regexp.MustCompile(`^[a-zA-Z0-9_-]*$`)
+
+	protocols = map[string]bool{"http": true, "https": true, "tcp": true, "socks": true}
+)
+
+// Messages are checked syntactically as soon as they're read, so malformed
+// ones never reach the code handling them
+type validator interface {
+	Validate() error
+}
+
+func checkLen(field, value string, max int) error {
+	if len(value) > max {
+		return fmt.Errorf("%s is longer than %d bytes", field, max)
+	}
+	return nil
+}
+
+func checkId(field, value string) error {
+	if err := checkLen(field, value, maxIdLen); err != nil {
+		return err
+	}
+	if !idPattern.MatchString(value) {
+		return fmt.Errorf("%s '%s' may only contain letters, digits, '-' and '_'", field, value)
+	}
+	return nil
+}
+
+func checkHostname(field, value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	if err := checkLen(field, value, 253); err != nil {
+		return err
+	}
+	if !hostnamePattern.MatchString(value) {
+		return fmt.Errorf("%s '%s' is not a valid hostname", field, value)
+	}
+	return nil
+}
+
+func checkList(field string, values []string, maxItem int) error {
+	if len(values) > maxListLen {
+		return fmt.Errorf("%s has more than %d entries", field, maxListLen)
+	}
+	for _, v := range values {
+		if err := checkLen(field, v, maxItem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Auth) Validate() error {
+	for field, value := range map[string]string{"Version": m.Version, "MmVersion": m.MmVersion, "OS": m.OS, "Arch": m.Arch} {
+		if err := checkLen(field, value, maxNameLen); err != nil {
+			return err
+		}
+	}
+
+	if err := checkLen("User", m.User, maxSecretLen); err != nil {
+		return err
+	}
+	if err := checkLen("Password", m.Password, maxSecretLen); err != nil {
+		return err
+	}
+	if err := checkId("ClientId", m.ClientId); err != nil {
+		return err
+	}
+	return checkList("Encodings", m.Encodings, maxNameLen)
+}
+
+func (m *ReqTunnel) Validate() error {
+	if err := checkId("ReqId", m.ReqId); err != nil {
+		return err
+	}
+
+	for _, proto := range strings.Split(m.Protocol, "+") {
+		if !protocols[proto] {
+			return fmt.Errorf("Protocol '%s' is not supported", m.Protocol)
+		}
+	}
+
+	if err := checkHostname("Hostname", m.Hostname); err != nil {
+		return err
+	}
+	if err := checkHostname("Subdomain", m.Subdomain); err != nil {
+		return err
+	}
+	if err := checkLen("HttpAuth", m.HttpAuth, maxSecretLen); err != nil {
+		return err
+	}
+	if err := checkList("CorsOrigins", m.CorsOrigins, maxUrlLen); err != nil {
+		return err
+	}
+
+	if len(m.Rewrites) > maxListLen {
+		return fmt.Errorf("Rewrites has more than %d entries", maxListLen)
+	}
+	for _, r := range m.Rewrites {
+		for field, value := range map[string]string{"StripPrefix": r.StripPrefix, "AddPrefix": r.AddPrefix, "Match": r.Match, "Replace": r.Replace} {
+			if err := checkLen(field, value, maxUrlLen); err != nil {
+				return err
+			}
+		}
+	}
+
+	if m.IdleTimeout < 0 {
+		return fmt.Errorf("IdleTimeout must not be negative")
+	}
+	return nil
+}
+
+func (m *RegProxy) Validate() error {
+	return checkId("ClientId", m.ClientId)
+}
+
+func (m *PeerForward) Validate() error {
+	if err := checkLen("Url", m.Url, maxUrlLen); err != nil {
+		return err
+	}
+	return checkLen("Secret", m.Secret, maxSecretLen)
+}
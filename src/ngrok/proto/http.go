@@ -26,30 +26,50 @@ type HttpRequest struct {
 type HttpResponse struct {
 	*http.Response
 	BodyBytes []byte
+
+	// the body was streamed, BodyBytes only has the start of it
+	Streaming bool
 }
 
+const (
+	// streamed responses only keep this much of their body for inspection
+	maxStreamCapture = 64 * 1024
+
+	// and are shown after this long even if the stream goes on
+	streamCaptureWindow = 2 * time.Second
+)
+
 type HttpTxn struct {
-	Req         *HttpRequest
-	Resp        *HttpResponse
-	Start       time.Time
-	Duration    time.Duration
+	Req      *HttpRequest
+	Resp     *HttpResponse
+	Start    time.Time
+	Duration time.Duration
+
+	// until the response headers were read
+	FirstByte time.Duration
+
+	// sent on a connection that carried an earlier request, not a new one
+	Reused bool
+
 	UserCtx     interface{}
 	ConnUserCtx interface{}
 }
 
 type Http struct {
+	// each txn is sent once for its request and once for its response, the
+	// views rely on getting both
 	Txns     *util.Broadcast
+	ReqTimer metrics.Timer
 	reqGauge metrics.Gauge
 	reqMeter metrics.Meter
-	reqTimer metrics.Timer
 }
 
 func NewHttp() *Http {
 	return &Http{
-		Txns:     util.NewBroadcast(),
+		Txns:     util.NewLosslessBroadcast(),
+		ReqTimer: metrics.NewTimer(),
 		reqGauge: metrics.NewGauge(),
 		reqMeter: metrics.NewMeter(),
-		reqTimer: metrics.NewTimer(),
 	}
 }
 
@@ -72,7 +92,7 @@ func (h *Http) WrapConn(c conn.Conn, ctx interface{}) conn.Conn {
 func (h *Http) readRequests(tee *conn.Tee, lastTxn chan *HttpTxn, connCtx interface{}) {
 	defer close(lastTxn)
 
-	for {
+	for reused := false; ; reused = true {
 		req, err := http.ReadRequest(tee.WriteBuffer())
 		if err != nil {
 			// no more requests to be read, we're done
@@ -92,7 +112,7 @@ func (h *Http) readRequests(tee *conn.Tee, lastTxn chan *HttpTxn, connCtx interf
 		req.URL.Scheme = "http"
 		req.URL.Host = req.Host
 
-		txn := &HttpTxn{Start: time.Now(), ConnUserCtx: connCtx}
+		txn := &HttpTxn{Start: time.Now(), Reused: reused, ConnUserCtx: connCtx}
 		txn.Req = &HttpRequest{Request: req}
 		if req.Body != nil {
 			txn.Req.BodyBytes, txn.Req.Body, err = extractBody(req.Body)
@@ -109,27 +129,33 @@ func (h *Http) readRequests(tee *conn.Tee, lastTxn chan *HttpTxn, connCtx interf
 func (h *Http) readResponses(tee *conn.Tee, lastTxn chan *HttpTxn) {
 	for txn := range lastTxn {
 		resp, err := http.ReadResponse(tee.ReadBuffer(), txn.Req.Request)
-		txn.Duration = time.Since(txn.Start)
-		h.reqTimer.Update(txn.Duration)
+		txn.FirstByte = time.Since(txn.Start)
 		if err != nil {
 			tee.Warn("Error reading response from server: %v", err)
 			// no more responses to be read, we're done
 			break
 		}
-		// make sure we read the body of the response so that
-		// we don't block the reader
-		_, _ = httputil.DumpResponse(resp, true)
-
-		txn.Resp = &HttpResponse{Response: resp}
-		// apparently, Body can be nil in some cases
-		if resp.Body != nil {
-			txn.Resp.BodyBytes, txn.Resp.Body, err = extractBody(resp.Body)
-			if err != nil {
-				tee.Warn("Failed to extract response body: %v", err)
+
+		if isStreaming(resp) {
+			h.captureStream(txn, resp)
+		} else {
+			// make sure we read the body of the response so that
+			// we don't block the reader
+			_, _ = httputil.DumpResponse(resp, true)
+
+			txn.Resp = &HttpResponse{Response: resp}
+			// apparently, Body can be nil in some cases
+			if resp.Body != nil {
+				txn.Resp.BodyBytes, txn.Resp.Body, err = extractBody(resp.Body)
+				if err != nil {
+					tee.Warn("Failed to extract response body: %v", err)
+				}
 			}
-		}
 
-		h.Txns.In() <- txn
+			txn.Duration = time.Since(txn.Start)
+			h.ReqTimer.Update(txn.Duration)
+			h.Txns.In() <- txn
+		}
 
 		// XXX: remove web socket shim in favor of a real websocket protocol analyzer
 		if txn.Req.Header.Get("Upgrade") == "websocket" {
@@ -157,6 +183,79 @@ func (h *Http) readResponses(tee *conn.Tee, lastTxn chan *HttpTxn) {
 	}
 }
 
+// Responses like server-sent events may go on for as long as the connection
+// is open, so their bodies can't be buffered before they're inspected
+func isStreaming(resp *http.Response) bool {
+	if resp.Body == nil {
+		return false
+	}
+
+	contentType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if contentType == "text/event-stream" {
+		return true
+	}
+
+	return resp.ContentLength < 0 && len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+}
+
+// Keeps reading a streamed body so the stream flows on, but only captures its
+// start. The transaction is published once the stream ends or the capture is
+// full or has waited long enough.
+func (h *Http) captureStream(txn *HttpTxn, resp *http.Response) {
+	var (
+		mu      sync.Mutex
+		capture bytes.Buffer
+	)
+
+	stream := resp.Body
+	done := make(chan int)
+	full := make(chan int)
+	go func() {
+		defer close(done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := stream.Read(buf)
+
+			mu.Lock()
+			if room := maxStreamCapture - capture.Len(); room > 0 {
+				if n > room {
+					n = room
+				}
+				capture.Write(buf[:n])
+				if n == room {
+					close(full)
+				}
+			}
+			mu.Unlock()
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-full:
+	case <-time.After(streamCaptureWindow):
+	}
+
+	mu.Lock()
+	body := append([]byte(nil), capture.Bytes()...)
+	mu.Unlock()
+
+	txn.Resp = &HttpResponse{Response: resp, BodyBytes: body, Streaming: true}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	// the stream may go on, so this is only as long as it was captured
+	txn.Duration = time.Since(txn.Start)
+	h.ReqTimer.Update(txn.Duration)
+	h.Txns.In() <- txn
+
+	// the next response only starts after this one
+	<-done
+}
+
 // we have to vendor DumpRequestOut because it's broken and the fix won't be in until at least 1.4
 // XXX: remove this all in favor of actually parsing the HTTP traffic ourselves for more transparent
 // replay and inspection, regardless of when it gets fixed in stdlib
@@ -0,0 +1,20 @@
+package proto
+
+import (
+	"ngrok/conn"
+)
+
+// The public side of a socks tunnel is a SOCKS5 endpoint. The client
+// speaks SOCKS5 on each proxy connection to learn where to connect,
+// after which the traffic is opaque like in a tcp tunnel.
+type Socks struct{}
+
+func NewSocks() *Socks {
+	return new(Socks)
+}
+
+func (h *Socks) GetName() string { return "socks" }
+
+func (h *Socks) WrapConn(c conn.Conn, ctx interface{}) conn.Conn {
+	return c
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"ngrok/log"
+	"strconv"
+	"sync/atomic"
+)
+
+// Counters and sizes of one of the server's caches. Sizes are in bytes.
+type cacheStatus struct {
+	Length    uint64 `json:"length"`
+	Size      uint64 `json:"size"`
+	Capacity  uint64 `json:"capacity"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+
+	// how many tunnels have their own cache, for the edge caches
+	Caches *int `json:"caches,omitempty"`
+}
+
+// Reports the registry affinity cache and the sum of the tunnels' edge caches,
+// whose capacity is the one each new tunnel gets
+func cacheStatuses() map[string]*cacheStatus {
+	registry := new(cacheStatus)
+	registry.Length, registry.Size, registry.Capacity, _ = tunnelRegistry.affinity.Stats()
+	registry.Hits, registry.Misses, registry.Evictions = tunnelRegistry.affinity.Counters()
+
+	caches := tunnelRegistry.EdgeCaches()
+	count := len(caches)
+	edge := &cacheStatus{Capacity: atomic.LoadUint64(&edgeCacheSize), Caches: &count}
+	for _, c := range caches {
+		length, size, _, _ := c.Stats()
+		hits, misses, evictions := c.Counters()
+		edge.Length += length
+		edge.Size += size
+		edge.Hits += hits
+		edge.Misses += misses
+		edge.Evictions += evictions
+	}
+
+	return map[string]*cacheStatus{"registry": registry, "edge": edge}
+}
+
+// Serves the admin API for operators. It's meant for a private address and
+// requires the admin token as a bearer token, which may only be left unset
+// on a loopback address.
+func startAdminListener(addr, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/caches", cachesHandler)
+	mux.HandleFunc("/controls", controlsHandler)
+	mux.HandleFunc("/maintenance", maintenanceHandler)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+
+	log.Info("Serving the admin API on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			log.Error("Admin API stopped: %v", err)
+		}
+	}()
+}
+
+// GET reports the caches. POST changes their capacity in bytes with the
+// registry and edge form values, then reports them. The edge caches of
+// running tunnels are resized too; setting edge to 0 empties them and stops
+// caching for new tunnels.
+func cachesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if err := resizeCaches(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf, err := json.Marshal(cacheStatuses())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+func resizeCaches(r *http.Request) error {
+	sizes := make(map[string]uint64)
+	for _, name := range []string{"registry", "edge"} {
+		if v := r.FormValue(name); v != "" {
+			size, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid %s cache size %s", name, v)
+			}
+			sizes[name] = size
+		}
+	}
+
+	if size, ok := sizes["registry"]; ok {
+		log.Info("Resizing the registry cache to %d bytes", size)
+		tunnelRegistry.affinity.SetCapacity(size)
+	}
+
+	if size, ok := sizes["edge"]; ok {
+		log.Info("Resizing the edge caches to %d bytes", size)
+		atomic.StoreUint64(&edgeCacheSize, size)
+		for _, c := range tunnelRegistry.EdgeCaches() {
+			c.resize(size)
+		}
+	}
+	return nil
+}
+
+// A connected client and the round trip times of its heartbeats
+type controlStatus struct {
+	Id      string   `json:"id"`
+	Addr    string   `json:"addr"`
+	OS      string   `json:"os"`
+	Arch    string   `json:"arch"`
+	Version string   `json:"version"`
+	Rtt     rttStats `json:"rtt"`
+}
+
+func controlStatuses() []controlStatus {
+	controls := controlRegistry.All()
+	statuses := make([]controlStatus, len(controls))
+	for i, ctl := range controls {
+		statuses[i] = controlStatus{
+			Id:      ctl.id,
+			Addr:    ctl.conn.RemoteAddr().String(),
+			OS:      ctl.auth.OS,
+			Arch:    ctl.auth.Arch,
+			Version: ctl.auth.MmVersion,
+			Rtt:     ctl.rtt.stats(),
+		}
+	}
+	return statuses
+}
+
+// GET lists the connected clients with the round trip times of the last
+// pings the server sent them
+func controlsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf, err := json.Marshal(controlStatuses())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// GET reports whether the server is in maintenance mode and how many tunnels
+// and public connections are left. POST turns it on or off with the enabled
+// form value.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		on, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid enabled value %s", r.FormValue("enabled")), http.StatusBadRequest)
+			return
+		}
+		maintenance.set(on)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf, err := json.Marshal(maintenance.status())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
@@ -2,19 +2,73 @@ package server
 
 import (
 	"flag"
+	"fmt"
+	"net"
+	"ngrok/cache"
+	"ngrok/conn"
+	"ngrok/log"
+	"ngrok/msg"
+	"os"
+	"path"
+	"strings"
+	"time"
 )
 
 type Options struct {
-	httpAddr      string
-	httpsAddr     string
-	tunnelAddr    string
-	domain        string
-	tlsCrt        string
-	tlsKey        string
-	logto         string
-	loglevel      string
-	authurl       string
-	authpostform  bool
+	httpAddr               string
+	httpsAddr              string
+	tunnelAddr             string
+	domain                 string
+	tlsCrts                []string
+	tlsKeys                []string
+	logto                  string
+	loglevel               string
+	authurl                string
+	authpostform           bool
+	sshAddr                string
+	sshKey                 string
+	findme                 []string
+	findmeMode             string
+	trustedProxies         string
+	maxHeaderBytes         int64
+	maxBodyBytes           int64
+	edgeCacheSize          uint64
+	registryCacheSize      uint64
+	registryCacheTtl       time.Duration
+	registryCachePolicy    cache.EvictionPolicy
+	statusHost             string
+	webhookUrl             string
+	webhookSecret          string
+	requestIds             bool
+	otlpEndpoint           string
+	subdomainScheme        string
+	subdomainLength        int
+	subdomainCharset       string
+	subdomainAttempts      int
+	reservedSubdomains     string
+	reservedSubdomainsFile string
+	namespaces             bool
+	idleTimeout            time.Duration
+	reconnectGrace         time.Duration
+	maintenancePage        string
+	maxSessionsPerToken    int
+	tcpBindIps             []net.IP
+	tcpDefaultIp           net.IP
+	socketOptions          map[string]*conn.SocketOptions
+	httpKeepAlive          time.Duration
+	peerAddr               string
+	peers                  []string
+	peerSecret             string
+	encodings              []string
+	maxMsgBytes            int64
+	releaseHost            string
+	releaseDir             string
+	adminAddr              string
+	adminToken             string
+	ocspStapling           bool
+
+	// the arguments of the service command, e.g. install -domain=example.com
+	service []string
 }
 
 func parseArgs() *Options {
@@ -22,24 +76,277 @@ func parseArgs() *Options {
 	httpsAddr := flag.String("httpsAddr", ":443", "Public address listening for HTTPS connections, emptry string to disable")
 	tunnelAddr := flag.String("tunnelAddr", ":4443", "Public address listening for ngrok client")
 	domain := flag.String("domain", "ngrok.com", "Domain where the tunnels are hosted")
-	tlsCrt := flag.String("tlsCrt", "", "Path to a TLS certificate file")
-	tlsKey := flag.String("tlsKey", "", "Path to a TLS key file")
+	tlsCrt := flag.String("tlsCrt", "", "Path to a TLS certificate file, or comma-separated paths to several that are picked by the name visitors ask for (SNI)")
+	tlsKey := flag.String("tlsKey", "", "Path to a TLS key file, or comma-separated paths to the keys of each tlsCrt in the same order")
 	logto := flag.String("log", "stdout", "Write log messages to this file. 'stdout' and 'none' have special meanings")
-	loglevel := flag.String("log-level", "DEBUG", "The level of messages to log. One of: DEBUG, INFO, WARNING, ERROR")
+	loglevel := flag.String("log-level", "DEBUG", "The level of messages to log. One of: DEBUG, INFO, WARNING, ERROR. Subsystems can have their own, e.g. INFO,control=DEBUG,proxy=WARNING,registry=DEBUG,extauth=DEBUG")
 	authurl := flag.String("auth-url", "", "URL for external authentification")
 	authpostform := flag.Bool("postform", false, "Post token as a form rather than sending JSON data")
+	sshAddr := flag.String("sshAddr", "", "Public address listening for SSH reverse tunnels (ssh -R), empty string to disable")
+	sshKey := flag.String("sshKey", "", "Path to the SSH host key, a temporary key is generated if empty")
+	findme := flag.String("findme", "", "Comma-separated hostnames or patterns like findme-*.example.com that find the tunnel opened from the caller's IP address, empty string to disable")
+	findmeMode := flag.String("findmeMode", "route", "What the findme hostname does. One of: route (redirect to the caller's tunnel), info (return the caller's address)")
+	trustedProxies := flag.String("trustedProxies", "", "Comma-separated CIDR networks of load balancers whose X-Forwarded-For headers and PROXY protocol headers are trusted")
+	maxHeaderBytes := flag.Int64("maxHeaderBytes", 0, "Largest request headers accepted on http(s) tunnels in bytes, larger ones get a 431 response. 0 for the default of 1MB, which doesn't make the server read the requests of every tunnel")
+	maxBodyBytes := flag.Int64("maxBodyBytes", 0, "Largest request body accepted on http(s) tunnels in bytes, 0 for no limit")
+	edgeCacheSize := flag.Uint64("edgeCacheSize", 16<<20, "Size in bytes of the response cache of each http(s) tunnel that asks for one, 0 to disable caching")
+	registryCacheSize := flag.Uint64("registryCacheSize", 1024*1024, "Size in bytes of the cache that gives clients back the URLs they had before")
+	registryCacheTtl := flag.Duration("registryCacheTtl", 0, "How long clients can get back the URLs they had before, 0 for as long as they stay in the cache")
+	registryCacheEviction := flag.String("registryCacheEviction", "lru", "Which URLs are forgotten first when the registry cache is full. One of: lru (least recently used), fifo (oldest)")
+	statusHost := flag.String("statusHost", "", "Hostname that serves a public page with the server's aggregate status, empty string to disable")
+	webhookUrl := flag.String("webhookUrl", "", "URL to POST tunnel_opened, tunnel_closed, client_connected and auth_failed events to")
+	webhookSecret := flag.String("webhookSecret", "", "Secret used to sign the X-Ngrok-Timestamp header and body of webhook requests with HMAC-SHA256 in the X-Ngrok-Signature header")
+	requestIds := flag.Bool("requestIds", false, "Tag each http(s) request with an X-Request-Id header that's logged and passed to the client")
+	otlpEndpoint := flag.String("otlpEndpoint", "", "Base URL of an OpenTelemetry collector to export traces to with OTLP/HTTP, e.g. http://localhost:4318")
+	subdomainScheme := flag.String("subdomainScheme", "hex", "How random subdomains are generated. One of: hex (like 5b3a1f2c), random (subdomainLength characters from subdomainCharset), words (like quiet-otter-42)")
+	subdomainLength := flag.Int("subdomainLength", 8, "Length of random subdomains with the random scheme")
+	subdomainCharset := flag.String("subdomainCharset", defaultSubdomainCharset, "Characters of random subdomains with the random scheme")
+	subdomainAttempts := flag.Int("subdomainAttempts", 5, "How many random subdomains are tried before giving up when they're taken")
+	reservedSubdomains := flag.String("reservedSubdomains", "", "Comma-separated subdomains or patterns like admin* that clients may not claim, e.g. www,mail,admin,api,login")
+	reservedSubdomainsFile := flag.String("reservedSubdomainsFile", "", "File with more reserved subdomains, one per line")
+	namespaces := flag.Bool("namespaces", false, "Register the subdomains of each auth token under its own namespace, e.g. app.alice.example.com")
+	tcpBindIps := flag.String("tcpBindIps", "", "Comma-separated public IPs of this server that tcp tunnels may ask to bind their port on, e.g. to give customers dedicated addresses. Requires tcpDefaultIp")
+	tcpDefaultIp := flag.String("tcpDefaultIp", "", "Public IP of this server that tcp tunnels which don't ask for one of tcpBindIps are bound on. Empty to bind them on all IPs, which only works without tcpBindIps")
+	maxSessionsPerToken := flag.Int("maxSessionsPerToken", 0, "How many clients may be connected to this server with the same auth token at once, unless the auth-url response sets MaxSessions. 0 for no limit")
+	maintenancePage := flag.String("maintenancePage", "", "HTML file public http(s) connections get while the server is in maintenance mode, which the admin API turns on. Empty for a short built-in page")
+	reconnectGrace := flag.Duration("reconnectGrace", 0, "How long public connections wait for a client whose control connection dropped to reconnect, instead of failing right away. 0 to not wait")
+	idleTimeout := flag.Duration("idleTimeout", 0, "Close proxied connections idle for this long unless their tunnel asks for another timeout, 0 for no limit")
+	publicSocket := flag.String("publicSocket", "", "Socket options of public connections, e.g. keepalive=30s,nodelay=false,readbuf=262144,writebuf=262144")
+	controlSocket := flag.String("controlSocket", "", "Socket options of client control connections, same format as publicSocket")
+	proxySocket := flag.String("proxySocket", "", "Socket options of client proxy connections, same format as publicSocket")
+	httpKeepAlive := flag.Duration("httpKeepAlive", 0, "How long public http(s) connections are kept open waiting for another request, which may be for another tunnel. 0 to close them after one request")
+	peerAddr := flag.String("peerAddr", "", "Address listening for public connections relayed by the other servers of the cluster, empty string to disable. Keep it on a private network")
+	peers := flag.String("peers", "", "Comma-separated peerAddr of other servers of the cluster, the rest are learned from them. They share which tunnels they have and get relayed connections for tunnels that aren't connected here")
+	peerSecret := flag.String("peerSecret", "", "Secret shared by the servers of the cluster to authenticate relayed connections")
+	encodings := flag.String("encodings", strings.Join(msg.CodecNames(), ","), "Comma-separated encodings of the control protocol clients may pick, in addition to json")
+	maxMsgBytes := flag.Int64("maxMsgBytes", msg.MaxMsgSize, "Largest protocol message accepted from clients in bytes")
+	releaseHost := flag.String("releaseHost", "", "Hostname that serves client binaries and update checks so clients can update from this server, empty string to disable")
+	releaseDir := flag.String("releaseDir", "", "Directory with the client binaries served on releaseHost, named like ngrok-1.8-linux-amd64 with an optional .sig signature file next to each")
+	adminAddr := flag.String("adminAddr", "", "Address serving the admin API for operators, e.g. 127.0.0.1:4445, empty string to disable. Keep it on a private network")
+	adminToken := flag.String("adminToken", "", "Bearer token required by the admin API, empty string to not require one if adminAddr is a loopback address")
+	ocspStapling := flag.Bool("ocspStapling", true, "Staple OCSP responses from the certificate's CA to TLS handshakes so visitors' browsers don't have to look them up")
 	flag.Parse()
 
+	if _, _, err := log.ParseLevels(*loglevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch *findmeMode {
+	case "route", "info":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid findmeMode %s, must be one of: route, info\n", *findmeMode)
+		os.Exit(1)
+	}
+
+	if *subdomainAttempts < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid subdomainAttempts %d, must be at least 1\n", *subdomainAttempts)
+		os.Exit(1)
+	}
+
+	var bindIps []net.IP
+	for _, s := range splitPaths(*tcpBindIps) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			fmt.Fprintf(os.Stderr, "Invalid IP %s in tcpBindIps\n", s)
+			os.Exit(1)
+		}
+		bindIps = append(bindIps, ip)
+	}
+
+	// tunnels that didn't ask for a dedicated IP mustn't take ports on them
+	var defaultIp net.IP
+	if *tcpDefaultIp != "" {
+		if defaultIp = net.ParseIP(*tcpDefaultIp); defaultIp == nil {
+			fmt.Fprintf(os.Stderr, "Invalid tcpDefaultIp %s\n", *tcpDefaultIp)
+			os.Exit(1)
+		}
+	}
+	for _, ip := range bindIps {
+		if defaultIp == nil {
+			fmt.Fprintf(os.Stderr, "tcpBindIps requires a tcpDefaultIp that isn't one of them\n")
+			os.Exit(1)
+		}
+		if ip.Equal(defaultIp) {
+			fmt.Fprintf(os.Stderr, "tcpDefaultIp %s must not be one of tcpBindIps\n", defaultIp)
+			os.Exit(1)
+		}
+	}
+
+	if *adminAddr != "" && *adminToken == "" && !isLoopback(*adminAddr) {
+		fmt.Fprintf(os.Stderr, "Refusing to serve the admin API on %s without an adminToken, set one or use a loopback address\n", *adminAddr)
+		os.Exit(1)
+	}
+
+	if *maxSessionsPerToken < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid maxSessionsPerToken %d, must not be negative\n", *maxSessionsPerToken)
+		os.Exit(1)
+	}
+
+	registryCachePolicy, err := cache.ParseEvictionPolicy(*registryCacheEviction)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	socketOptions := make(map[string]*conn.SocketOptions)
+	for typ, spec := range map[string]string{"pub": *publicSocket, "ctl": *controlSocket, "pxy": *proxySocket} {
+		if spec == "" {
+			continue
+		}
+
+		if socketOptions[typ], err = conn.ParseSocketOptions(spec); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	var peerAddrs []string
+	for _, addr := range strings.Split(*peers, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			peerAddrs = append(peerAddrs, addr)
+		}
+	}
+
+	if (*peerAddr != "" || len(peerAddrs) > 0) && *peerSecret == "" {
+		fmt.Fprintf(os.Stderr, "A peerSecret is required to relay connections between servers\n")
+		os.Exit(1)
+	}
+
+	if *maxMsgBytes <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid maxMsgBytes %d, must be positive\n", *maxMsgBytes)
+		os.Exit(1)
+	}
+
+	if *releaseHost != "" && *releaseDir == "" {
+		fmt.Fprintf(os.Stderr, "A releaseDir is required to serve releases on %s\n", *releaseHost)
+		os.Exit(1)
+	}
+
+	tlsCrts, tlsKeys := splitPaths(*tlsCrt), splitPaths(*tlsKey)
+	if len(tlsCrts) != len(tlsKeys) {
+		fmt.Fprintf(os.Stderr, "Got %d TLS certificates but %d keys, each tlsCrt needs a tlsKey\n", len(tlsCrts), len(tlsKeys))
+		os.Exit(1)
+	}
+
+	encodingNames := []string{msg.JSON.Name()}
+	for _, name := range strings.Split(*encodings, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+
+		if msg.CodecByName(name) == nil {
+			fmt.Fprintf(os.Stderr, "Unknown encoding %s, must be one of: %s\n", name, strings.Join(msg.CodecNames(), ", "))
+			os.Exit(1)
+		}
+		encodingNames = append(encodingNames, name)
+	}
+
+	var findmeHostnames []string
+	for _, name := range strings.Split(*findme, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if _, err := path.Match(name, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid findme pattern %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		findmeHostnames = append(findmeHostnames, name)
+	}
+
+	var service []string
+	if flag.Arg(0) == "service" {
+		service = flag.Args()[1:]
+	}
+
 	return &Options{
-		httpAddr:     *httpAddr,
-		httpsAddr:    *httpsAddr,
-		tunnelAddr:   *tunnelAddr,
-		domain:       *domain,
-		tlsCrt:       *tlsCrt,
-		tlsKey:       *tlsKey,
-		logto:        *logto,
-		loglevel:     *loglevel,
-		authurl:      *authurl,
-		authpostform: *authpostform,
+		service:                service,
+		httpAddr:               *httpAddr,
+		httpsAddr:              *httpsAddr,
+		tunnelAddr:             *tunnelAddr,
+		domain:                 *domain,
+		tlsCrts:                tlsCrts,
+		tlsKeys:                tlsKeys,
+		logto:                  *logto,
+		loglevel:               *loglevel,
+		authurl:                *authurl,
+		authpostform:           *authpostform,
+		sshAddr:                *sshAddr,
+		sshKey:                 *sshKey,
+		findme:                 findmeHostnames,
+		findmeMode:             *findmeMode,
+		trustedProxies:         *trustedProxies,
+		maxHeaderBytes:         *maxHeaderBytes,
+		maxBodyBytes:           *maxBodyBytes,
+		edgeCacheSize:          *edgeCacheSize,
+		registryCacheSize:      *registryCacheSize,
+		registryCacheTtl:       *registryCacheTtl,
+		registryCachePolicy:    registryCachePolicy,
+		statusHost:             strings.ToLower(*statusHost),
+		webhookUrl:             *webhookUrl,
+		webhookSecret:          *webhookSecret,
+		requestIds:             *requestIds,
+		otlpEndpoint:           *otlpEndpoint,
+		subdomainScheme:        *subdomainScheme,
+		subdomainLength:        *subdomainLength,
+		subdomainCharset:       *subdomainCharset,
+		subdomainAttempts:      *subdomainAttempts,
+		reservedSubdomains:     *reservedSubdomains,
+		reservedSubdomainsFile: *reservedSubdomainsFile,
+		namespaces:             *namespaces,
+		idleTimeout:            *idleTimeout,
+		reconnectGrace:         *reconnectGrace,
+		maintenancePage:        *maintenancePage,
+		maxSessionsPerToken:    *maxSessionsPerToken,
+		tcpBindIps:             bindIps,
+		tcpDefaultIp:           defaultIp,
+		socketOptions:          socketOptions,
+		httpKeepAlive:          *httpKeepAlive,
+		peerAddr:               *peerAddr,
+		peers:                  peerAddrs,
+		peerSecret:             *peerSecret,
+		encodings:              encodingNames,
+		maxMsgBytes:            *maxMsgBytes,
+		releaseHost:            strings.ToLower(*releaseHost),
+		releaseDir:             *releaseDir,
+		adminAddr:              *adminAddr,
+		adminToken:             *adminToken,
+		ocspStapling:           *ocspStapling,
+	}
+}
+
+func splitPaths(list string) (paths []string) {
+	for _, path := range strings.Split(list, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return
+}
+
+// The IP of -tcpBindIps a tunnel asked to bind on, nil if the server doesn't
+// offer it
+func tcpBindIp(s string) net.IP {
+	ip := net.ParseIP(s)
+	for _, bindIp := range opts.tcpBindIps {
+		if ip != nil && ip.Equal(bindIp) {
+			return bindIp
+		}
+	}
+	return nil
+}
+
+// Whether a listen address only accepts connections from this host
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
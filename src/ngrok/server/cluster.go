@@ -0,0 +1,313 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net"
+	"ngrok/conn"
+	"ngrok/log"
+	"ngrok/msg"
+	"ngrok/util"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	gossipInterval = 2 * time.Second
+
+	// peers not heard from for this long are considered gone, and their
+	// tunnels may be registered elsewhere
+	memberTimeout = 15 * time.Second
+
+	// how long the affinity of a client is gossiped after it connects,
+	// long enough for every peer to hear about it
+	reservationGossipTime = time.Minute
+)
+
+// What the cluster knows about one of the other servers
+type member struct {
+	tunnels  map[string]bool
+	added    time.Time
+	lastSeen time.Time
+}
+
+func (m *member) alive() bool {
+	return time.Since(m.lastSeen) < memberTimeout
+}
+
+type reservation struct {
+	url  string
+	time time.Time
+}
+
+// Cluster keeps track of the other servers sharing the domain, which tunnels
+// are connected to them and where recently connected clients were assigned.
+// Servers learn about each other from the -peers they're started with and
+// from the members their peers gossip about.
+type Cluster struct {
+	id           string
+	self         string
+	seeds        []string
+	members      map[string]*member
+	reservations map[string]reservation
+	log.Logger
+	sync.RWMutex
+}
+
+func NewCluster(self string, seeds []string) *Cluster {
+	c := &Cluster{
+		id:           util.RandId(8),
+		self:         self,
+		seeds:        seeds,
+		members:      make(map[string]*member),
+		reservations: make(map[string]reservation),
+		Logger:       log.NewPrefixLogger("cluster"),
+	}
+
+	for _, addr := range seeds {
+		c.members[addr] = &member{tunnels: make(map[string]bool), added: time.Now()}
+	}
+
+	go c.gossipThread()
+	return c
+}
+
+// Returns the address of the live peer the tunnel is connected to, if any
+func (c *Cluster) Owner(url string) string {
+	if c == nil {
+		return ""
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	for addr, m := range c.members {
+		if m.alive() && m.tunnels[url] {
+			return addr
+		}
+	}
+	return ""
+}
+
+// Returns the peers a connection for the tunnel should be relayed to, just its
+// owner if it's known and otherwise every peer
+func (c *Cluster) Peers(url string) []string {
+	if c == nil {
+		return nil
+	}
+
+	if owner := c.Owner(url); owner != "" {
+		return []string{owner}
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	peers := make([]string, 0, len(c.members))
+	for addr := range c.members {
+		peers = append(peers, addr)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// Tells the peers which url the clients identified by the affinity keys got
+func (c *Cluster) Reserve(url string, keys ...string) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for _, key := range keys {
+		c.reservations[key] = reservation{url, now}
+	}
+}
+
+func (c *Cluster) gossipThread() {
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+
+	for _ = range ticker.C {
+		c.expire()
+
+		c.RLock()
+		addrs := make([]string, 0, len(c.members))
+		for addr := range c.members {
+			addrs = append(addrs, addr)
+		}
+		c.RUnlock()
+
+		for _, addr := range addrs {
+			go c.exchange(addr)
+		}
+	}
+}
+
+// Swaps state with a peer
+func (c *Cluster) exchange(addr string) {
+	peerConn, err := conn.Dial(addr, "peer", nil)
+	if err != nil {
+		c.Debug("Failed to reach peer %s: %v", addr, err)
+		return
+	}
+	defer peerConn.Close()
+
+	peerConn.SetDeadline(time.Now().Add(connReadTimeout))
+	if err = msg.WriteMsg(peerConn, c.state()); err != nil {
+		c.Debug("Failed to gossip with peer %s: %v", addr, err)
+		return
+	}
+
+	var g msg.PeerGossip
+	if err = msg.ReadPeerMsgInto(peerConn, &g); err != nil {
+		c.Debug("Failed to gossip with peer %s: %v", addr, err)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(g.Secret), []byte(opts.peerSecret)) != 1 {
+		c.Warn("Peer %s answered with an invalid secret", addr)
+		return
+	}
+
+	c.merge(addr, &g)
+}
+
+// Answers the gossip of a peer with our own state
+func (c *Cluster) handleGossip(peerConn conn.Conn, g *msg.PeerGossip) {
+	defer peerConn.Close()
+
+	if subtle.ConstantTimeCompare([]byte(g.Secret), []byte(opts.peerSecret)) != 1 {
+		peerConn.Warn("Ignoring gossip with an invalid secret")
+		return
+	}
+
+	// peers listening on all interfaces are reached at the address they connect from
+	addr := g.Addr
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		if remote, ok := peerConn.RemoteAddr().(*net.TCPAddr); ok {
+			addr = net.JoinHostPort(remote.IP.String(), port)
+		}
+	}
+
+	if addr != "" {
+		c.merge(addr, g)
+	}
+
+	peerConn.SetWriteDeadline(time.Now().Add(connReadTimeout))
+	if err := msg.WriteMsg(peerConn, c.state()); err != nil {
+		peerConn.Debug("Failed to answer gossip: %v", err)
+	}
+}
+
+func (c *Cluster) state() *msg.PeerGossip {
+	// before locking, the registry checks with us while it's locked
+	tunnels := tunnelRegistry.Urls()
+
+	c.RLock()
+	defer c.RUnlock()
+
+	g := &msg.PeerGossip{
+		Secret:       opts.peerSecret,
+		Node:         c.id,
+		Addr:         c.self,
+		Tunnels:      tunnels,
+		Reservations: make(map[string]string),
+	}
+
+	for addr, m := range c.members {
+		if m.alive() {
+			g.Members = append(g.Members, addr)
+		}
+	}
+
+	for key, r := range c.reservations {
+		g.Reservations[key] = r.url
+	}
+
+	return g
+}
+
+func (c *Cluster) merge(addr string, g *msg.PeerGossip) {
+	c.Lock()
+	defer c.Unlock()
+
+	if g.Node == c.id {
+		// one of our addresses, e.g. when listening on all interfaces
+		if _, ok := c.members[addr]; ok {
+			c.Debug("Peer %s is ourselves", addr)
+			delete(c.members, addr)
+		}
+		return
+	}
+
+	m, ok := c.members[addr]
+	if !ok {
+		c.Info("New peer %s", addr)
+		m = &member{added: time.Now()}
+		c.members[addr] = m
+	} else if !m.alive() && !m.lastSeen.IsZero() {
+		c.Info("Peer %s is back", addr)
+	}
+
+	m.lastSeen = time.Now()
+	m.tunnels = make(map[string]bool)
+	for _, url := range g.Tunnels {
+		m.tunnels[url] = true
+	}
+
+	// the members of our peers are our members too
+	for _, other := range g.Members {
+		if _, ok := c.members[other]; !ok && other != c.self {
+			c.Info("Learned about peer %s from %s", other, addr)
+			c.members[other] = &member{tunnels: make(map[string]bool), added: time.Now()}
+		}
+	}
+
+	for key, url := range g.Reservations {
+		if v, ok := tunnelRegistry.affinity.Get(key); ok && string(v.(cacheUrl)) == url {
+			continue
+		}
+		tunnelRegistry.SetAffinity(url, key)
+	}
+}
+
+// Forgets the tunnels of peers that are gone so that their clients can get
+// their urls back from the servers they reconnect to. Peers we learned about
+// from gossip are forgotten entirely, the seeds are still tried.
+func (c *Cluster) expire() {
+	c.Lock()
+	defer c.Unlock()
+
+	for addr, m := range c.members {
+		if m.alive() || time.Since(m.added) < memberTimeout {
+			continue
+		}
+
+		if len(m.tunnels) > 0 {
+			c.Warn("Peer %s is gone, releasing its %d tunnels", addr, len(m.tunnels))
+			m.tunnels = make(map[string]bool)
+		}
+
+		if !c.isSeed(addr) {
+			delete(c.members, addr)
+		}
+	}
+
+	for key, r := range c.reservations {
+		if time.Since(r.time) > reservationGossipTime {
+			delete(c.reservations, key)
+		}
+	}
+}
+
+func (c *Cluster) isSeed(addr string) bool {
+	for _, seed := range c.seeds {
+		if seed == addr {
+			return true
+		}
+	}
+	return false
+}
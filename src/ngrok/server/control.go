@@ -30,6 +30,9 @@ type Control struct {
 	// actual connection
 	conn conn.Conn
 
+	// encoding of the messages after the AuthResp
+	codec msg.Codec
+
 	// put a message in this channel to send it over
 	// conn to the client
 	out chan (msg.Message)
@@ -41,6 +44,9 @@ type Control struct {
 	// the last time we received a ping from the client - for heartbeats
 	lastPing time.Time
 
+	// round trip times of the pings we send the client
+	rtt rttWindow
+
 	// all of the tunnels this control connection handles
 	tunnels []*Tunnel
 
@@ -70,6 +76,7 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth, extAuth *ExtAuth) {
 	c := &Control{
 		auth:            authMsg,
 		conn:            ctlConn,
+		codec:           msg.Negotiate(authMsg.Encodings, opts.encodings),
 		out:             make(chan msg.Message),
 		in:              make(chan msg.Message),
 		proxies:         make(chan conn.Conn, 10),
@@ -80,7 +87,14 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth, extAuth *ExtAuth) {
 		shutdown:        util.NewShutdown(),
 	}
 
+	span := StartSpan("control.handshake", spanKindServer, nil)
+	span.SetAttr("net.peer.addr", ctlConn.RemoteAddr().String())
+	span.SetAttr("ngrok.client.os", authMsg.OS)
+	span.SetAttr("ngrok.client.version", authMsg.MmVersion)
+
 	failAuth := func(e error) {
+		span.End(e)
+		webhook.AuthFailed(c, e)
 		_ = msg.WriteMsg(ctlConn, &msg.AuthResp{Error: e.Error()})
 		ctlConn.Close()
 	}
@@ -99,12 +113,23 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth, extAuth *ExtAuth) {
 	ctlConn.SetType("ctl")
 	ctlConn.AddLogPrefix(c.id)
 
+	// an error would make most clients give up for good, while a dropped
+	// connection makes them retry with backoff until maintenance is over
+	if maintenance.enabled() {
+		span.End(errMaintenance)
+		ctlConn.Info("Dropping control connection during maintenance")
+		ctlConn.Close()
+		return
+	}
+
 	if authMsg.Version != version.Proto {
 		failAuth(fmt.Errorf("Incompatible versions. Server %s, client %s. Download a new version at http://ngrok.com", version.MajorMinor(), authMsg.Version))
 		return
 	}
 
+	authSpan := StartSpan("ext_auth", spanKindClient, span)
 	c.rights, err = extAuth.Auth(authMsg)
+	authSpan.End(err)
 	if err != nil {
 		failAuth(err)
 		return
@@ -112,10 +137,19 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth, extAuth *ExtAuth) {
 	ctlConn.Debug("Token '%s' accepted", authMsg.User)
 
 	// register the control
-	if replaced := controlRegistry.Add(c.id, c); replaced != nil {
+	replaced, err := controlRegistry.Add(c.id, c, c.rights.MaxSessions())
+	if err != nil {
+		failAuth(err)
+		return
+	}
+	if replaced != nil {
 		replaced.shutdown.WaitComplete()
 	}
 
+	webhook.ClientConnected(c)
+	span.SetAttr("ngrok.client.id", c.id)
+	span.End(nil)
+
 	// start the writer first so that the following messages get sent
 	go c.writer()
 
@@ -124,6 +158,7 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth, extAuth *ExtAuth) {
 		Version:   version.Proto,
 		MmVersion: version.MajorMinor(),
 		ClientId:  c.id,
+		Encoding:  c.codec.Name(),
 	}
 
 	// As a performance optimization, ask for a proxy connection up front
@@ -137,8 +172,26 @@ func NewControl(ctlConn conn.Conn, authMsg *msg.Auth, extAuth *ExtAuth) {
 
 // Register a new tunnel on this control connection
 func (c *Control) registerTunnel(rawTunnelReq *msg.ReqTunnel) {
+	span := StartSpan("tunnel.register", spanKindServer, nil)
+	span.SetAttr("ngrok.client.id", c.id)
+	span.SetAttr("ngrok.protocol", rawTunnelReq.Protocol)
+
+	// clients that connected before maintenance began keep the tunnels they
+	// have, but can't open new ones
+	if maintenance.enabled() {
+		span.End(errMaintenance)
+		c.conn.Info("Refusing new tunnel during maintenance")
+		c.out <- &msg.NewTunnel{Error: errMaintenance.Error()}
+		return
+	}
+
+	err := checkReserved(rawTunnelReq)
+	if err == nil {
+		err = c.rights.RequestTunnel(rawTunnelReq)
+	}
 
-	if err := c.rights.RequestTunnel(rawTunnelReq); err != nil {
+	if err != nil {
+		span.End(err)
 		c.out <- &msg.NewTunnel{Error: err.Error()}
 		if len(c.tunnels) == 0 {
 			c.shutdown.Begin()
@@ -155,6 +208,7 @@ func (c *Control) registerTunnel(rawTunnelReq *msg.ReqTunnel) {
 		c.conn.Debug("Registering new tunnel")
 		t, err := NewTunnel(&tunnelReq, c)
 		if err != nil {
+			span.End(err)
 			c.out <- &msg.NewTunnel{Error: err.Error()}
 			if len(c.tunnels) == 0 {
 				c.shutdown.Begin()
@@ -175,7 +229,10 @@ func (c *Control) registerTunnel(rawTunnelReq *msg.ReqTunnel) {
 		}
 
 		rawTunnelReq.Hostname = strings.Replace(t.url, proto+"://", "", 1)
+		span.SetAttr("ngrok.tunnel."+proto, t.url)
 	}
+
+	span.End(nil)
 }
 
 func (c *Control) manager() {
@@ -196,8 +253,21 @@ func (c *Control) manager() {
 	reap := time.NewTicker(connReapInterval)
 	defer reap.Stop()
 
+	// our own pings, timed to measure the round trip to the client
+	ping := time.NewTicker(rttPingInterval)
+	defer ping.Stop()
+	var pingSent time.Time
+
 	for {
 		select {
+		case <-ping.C:
+			// only one ping is outstanding at a time, so clients too old
+			// to answer get just the one
+			if pingSent.IsZero() {
+				pingSent = time.Now()
+				c.out <- &msg.Ping{}
+			}
+
 		case <-reap.C:
 			if time.Since(c.lastPing) > pingTimeoutInterval {
 				c.conn.Info("Lost heartbeat")
@@ -217,6 +287,12 @@ func (c *Control) manager() {
 			case *msg.Ping:
 				c.lastPing = time.Now()
 				c.out <- &msg.Pong{}
+
+			case *msg.Pong:
+				if !pingSent.IsZero() {
+					c.rtt.add(time.Since(pingSent))
+					pingSent = time.Time{}
+				}
 			}
 		}
 	}
@@ -235,12 +311,18 @@ func (c *Control) writer() {
 	// notify that we've flushed all messages
 	defer c.writerShutdown.Complete()
 
-	// write messages to the control channel
+	// write messages to the control channel, switching
+	// to the negotiated codec after the AuthResp
+	codec := msg.JSON
 	for m := range c.out {
 		c.conn.SetWriteDeadline(time.Now().Add(controlWriteTimeout))
-		if err := msg.WriteMsg(c.conn, m); err != nil {
+		if err := msg.WriteMsgWith(c.conn, codec, m); err != nil {
 			panic(err)
 		}
+
+		if _, ok := m.(*msg.AuthResp); ok {
+			codec = c.codec
+		}
 	}
 }
 
@@ -259,7 +341,7 @@ func (c *Control) reader() {
 
 	// read messages from the control channel
 	for {
-		if msg, err := msg.ReadMsg(c.conn); err != nil {
+		if msg, err := msg.ReadMsgWith(c.conn, c.codec); err != nil {
 			if err == io.EOF {
 				c.conn.Info("EOF")
 				return
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	corsMaxAge = "600"
+)
+
+// Returns the value of Access-Control-Allow-Origin for a request from origin,
+// or "" if the origin isn't allowed. Origins listed explicitly are echoed so
+// that credentialed requests work too, any other origin only gets "*", for
+// which browsers never send credentials.
+func corsAllowOrigin(origins []string, origin string) string {
+	if origin == "" {
+		return ""
+	}
+
+	wildcard := false
+	for _, o := range origins {
+		if strings.EqualFold(o, origin) {
+			return origin
+		}
+		wildcard = wildcard || o == "*"
+	}
+
+	if wildcard {
+		return "*"
+	}
+	return ""
+}
+
+// Sets the Access-Control-Allow-Origin header and allows credentials only
+// for explicitly listed origins
+func setCorsOrigin(h http.Header, allowOrigin string) {
+	h.Set("Access-Control-Allow-Origin", allowOrigin)
+	if allowOrigin == "*" {
+		h.Del("Access-Control-Allow-Credentials")
+	} else {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Answers CORS preflight requests at the edge when the tunnel has CORS
+// enabled, returns nil for all other requests
+func corsPreflight(origins []string, req *http.Request) *http.Response {
+	if len(origins) == 0 || req.Method != "OPTIONS" || req.Header.Get("Access-Control-Request-Method") == "" {
+		return nil
+	}
+
+	resp := &http.Response{
+		Status:     "204 No Content",
+		StatusCode: http.StatusNoContent,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}
+
+	// without the headers, the browser refuses the actual request
+	allowOrigin := corsAllowOrigin(origins, req.Header.Get("Origin"))
+	if allowOrigin != "" {
+		setCorsOrigin(resp.Header, allowOrigin)
+		resp.Header.Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+		if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			resp.Header.Set("Access-Control-Allow-Headers", headers)
+		}
+		resp.Header.Set("Access-Control-Max-Age", corsMaxAge)
+	}
+	resp.Header.Set("Vary", "Origin")
+
+	return resp
+}
+
+// Adds the CORS headers to a response from the tunnel, replacing any set by
+// the backend
+func addCorsHeaders(origins []string, req *http.Request, resp *http.Response) {
+	if len(origins) == 0 {
+		return
+	}
+
+	resp.Header.Add("Vary", "Origin")
+	if allowOrigin := corsAllowOrigin(origins, req.Header.Get("Origin")); allowOrigin != "" {
+		setCorsOrigin(resp.Header, allowOrigin)
+	}
+}
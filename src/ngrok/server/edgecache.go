@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"ngrok/cache"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// responses bigger than this fraction of the cache are never stored
+	edgeCacheMaxEntryFraction = 8
+)
+
+// A response stored in a tunnel's edge cache
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func (r *cachedResponse) Size() int {
+	size := len(r.body)
+	for k, vs := range r.header {
+		for _, v := range vs {
+			size += len(k) + len(v)
+		}
+	}
+	return size
+}
+
+// Caches the responses of a tunnel that allow it with Cache-Control or Expires
+// headers, so that visitors don't all have to wait for the client's uplink.
+// Only successful responses to GET requests are cached, and requests with
+// credentials are passed through since the cache is shared by all visitors.
+type edgeCache struct {
+	*cache.LRUCache
+	maxEntry int64
+}
+
+// Capacity of the edge caches of new tunnels. It starts at -edgeCacheSize and
+// can be changed at runtime through the admin API.
+var edgeCacheSize uint64
+
+func newEdgeCache(capacity uint64) *edgeCache {
+	return &edgeCache{
+		LRUCache: cache.NewLRUCache(capacity),
+		maxEntry: int64(capacity / edgeCacheMaxEntryFraction),
+	}
+}
+
+// Changes the capacity, evicting responses if the cache shrinks
+func (c *edgeCache) resize(capacity uint64) {
+	atomic.StoreInt64(&c.maxEntry, int64(capacity/edgeCacheMaxEntryFraction))
+	c.SetCapacity(capacity)
+}
+
+func edgeCacheKey(req *http.Request) string {
+	return req.URL.RequestURI() + "\x00" + req.Header.Get("Accept-Encoding")
+}
+
+// Returns a cached response to the request, if there's a fresh one
+func (c *edgeCache) lookup(req *http.Request) *http.Response {
+	if req.Method != "GET" || noCache(req.Header) || hasCredentials(req.Header) {
+		return nil
+	}
+
+	key := edgeCacheKey(req)
+	v, ok := c.Get(key)
+	if !ok {
+		return nil
+	}
+
+	cached := v.(*cachedResponse)
+	now := time.Now()
+	if now.After(cached.expires) {
+		c.Delete(key)
+		return nil
+	}
+
+	header := make(http.Header, len(cached.header)+1)
+	for k, vs := range cached.header {
+		header[k] = vs
+	}
+	header.Set("Age", strconv.Itoa(int(now.Sub(cached.stored).Seconds())))
+
+	return &http.Response{
+		Status:        strconv.Itoa(cached.status) + " " + http.StatusText(cached.status),
+		StatusCode:    cached.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(cached.body)),
+		ContentLength: int64(len(cached.body)),
+		Request:       req,
+	}
+}
+
+// Stores the response if it can be cached. The body is replaced with one that
+// replays what was read to store it.
+func (c *edgeCache) store(req *http.Request, resp *http.Response) {
+	if req.Method != "GET" || resp.StatusCode != http.StatusOK || noCache(req.Header) {
+		return
+	}
+
+	ttl := cacheTtl(resp.Header)
+	if ttl <= 0 || resp.Header.Get("Set-Cookie") != "" {
+		return
+	}
+
+	// a shared cache may only store responses to authorized requests that
+	// say it may (RFC 7234 3.2), and cookies usually select per-user pages
+	if req.Header.Get("Cookie") != "" {
+		return
+	}
+	if req.Header.Get("Authorization") != "" && !sharedWithAuthorization(resp.Header) {
+		return
+	}
+
+	// we don't key on any other request headers
+	if vary := resp.Header.Get("Vary"); vary != "" && !strings.EqualFold(strings.TrimSpace(vary), "Accept-Encoding") {
+		return
+	}
+
+	maxEntry := atomic.LoadInt64(&c.maxEntry)
+	if resp.ContentLength > maxEntry {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxEntry+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+
+	if err != nil || int64(len(body)) > maxEntry {
+		return
+	}
+
+	now := time.Now()
+	header := make(http.Header, len(resp.Header))
+	for k, vs := range resp.Header {
+		header[k] = vs
+	}
+	header.Del("Connection")
+	header.Del("Transfer-Encoding")
+
+	c.Set(edgeCacheKey(req), &cachedResponse{
+		status:  resp.StatusCode,
+		header:  header,
+		body:    body,
+		stored:  now,
+		expires: now.Add(ttl),
+	})
+}
+
+// Whether the headers ask to bypass caches
+func noCache(h http.Header) bool {
+	cc := strings.ToLower(h.Get("Cache-Control"))
+	return strings.Contains(cc, "no-cache") || strings.Contains(cc, "no-store") || h.Get("Pragma") == "no-cache"
+}
+
+// Whether the request carries credentials that may select a per-user response
+func hasCredentials(h http.Header) bool {
+	return h.Get("Authorization") != "" || h.Get("Cookie") != ""
+}
+
+// Whether a response to a request with an Authorization header may be stored
+// by a shared cache
+func sharedWithAuthorization(h http.Header) bool {
+	for _, directive := range strings.Split(strings.ToLower(h.Get("Cache-Control")), ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "public" || directive == "must-revalidate" || strings.HasPrefix(directive, "s-maxage=") {
+			return true
+		}
+	}
+	return false
+}
+
+// How long a response may be cached by a shared cache, 0 if it may not
+func cacheTtl(h http.Header) time.Duration {
+	if cc := h.Get("Cache-Control"); cc != "" {
+		var maxAge, sMaxAge int = -1, -1
+		for _, directive := range strings.Split(strings.ToLower(cc), ",") {
+			directive = strings.TrimSpace(directive)
+			switch {
+			case directive == "no-store" || directive == "no-cache" || directive == "private":
+				return 0
+			case strings.HasPrefix(directive, "s-maxage="):
+				sMaxAge, _ = strconv.Atoi(directive[len("s-maxage="):])
+			case strings.HasPrefix(directive, "max-age="):
+				maxAge, _ = strconv.Atoi(directive[len("max-age="):])
+			}
+		}
+
+		if sMaxAge >= 0 {
+			return time.Duration(sMaxAge) * time.Second
+		}
+		if maxAge >= 0 {
+			return time.Duration(maxAge) * time.Second
+		}
+	}
+
+	if expires, err := http.ParseTime(h.Get("Expires")); err == nil {
+		return expires.Sub(time.Now())
+	}
+
+	return 0
+}
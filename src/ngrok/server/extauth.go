@@ -2,30 +2,38 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"ngrok/log"
 	"ngrok/msg"
+	"regexp"
 	"sort"
 	"strings"
 )
 
 type ExtAuthType int
+
 const (
-        PostJson ExtAuthType = iota
-        PostForm
+	PostJson ExtAuthType = iota
+	PostForm
 )
 
 type ExtAuth struct {
-	authUrl string
+	authUrl  string
 	authType ExtAuthType
 	log.Logger
 }
 
 type Rights struct {
 	data rightsData
+
+	// label under which this token's subdomains are registered, if namespaces are enabled
+	namespace string
 }
 
 type rightsData struct {
@@ -35,14 +43,28 @@ type rightsData struct {
 	AutomaticPortAllowed      bool
 	AutomaticSubdomainAllowed bool
 	AllowAll                  bool
+
+	// findme hostnames or patterns that find this token's tunnels, any of them if empty
+	FindmeHostnames []string
+
+	// namespace of the token's subdomains, a hash of the token if empty
+	Namespace string
+
+	// how many control connections the token may have at once on each
+	// server, 0 for no limit and -maxSessionsPerToken if not set
+	MaxSessions *int
+
+	// public IPs the token's tcp tunnels may bind their ports on, any if
+	// empty. Tunnels that don't ask for one get the first.
+	AllowedIps []string
 }
 
 // Creates a new ExtAuth object
 func NewExtAuth(u string, t ExtAuthType) *ExtAuth {
 	e := &ExtAuth{
-		authUrl:    u,
-		authType:   t,
-		Logger: log.NewPrefixLogger(),
+		authUrl:  u,
+		authType: t,
+		Logger:   log.NewPrefixLogger("extauth"),
 	}
 
 	return e
@@ -54,27 +76,26 @@ func (ea *ExtAuth) Auth(authMsg *msg.Auth) (*Rights, error) {
 
 	if ea.authUrl == "" {
 		r.data.AllowAll = true
-		return &r, nil
+		return &r, r.setNamespace(authMsg.User)
 	}
 
 	log.Debug("External authentification request for token: " + authMsg.User)
 	var resp *http.Response
 	var err error
 	switch ea.authType {
-		case PostJson:
-			b := []byte(`{"Token":"` + authMsg.User + `"}`)
-			resp, err = http.Post(ea.authUrl, "application/json", bytes.NewBuffer(b))
-		case PostForm:
-			v := url.Values{}
-			v.Set("token", authMsg.User)
-			resp, err = http.PostForm(ea.authUrl, v)
-		default:
-			log.Warn("Unknown external authentification type")
-			err = fmt.Errorf("External authentification unavailable")
-			return &r, err
+	case PostJson:
+		b := []byte(`{"Token":"` + authMsg.User + `"}`)
+		resp, err = http.Post(ea.authUrl, "application/json", bytes.NewBuffer(b))
+	case PostForm:
+		v := url.Values{}
+		v.Set("token", authMsg.User)
+		resp, err = http.PostForm(ea.authUrl, v)
+	default:
+		log.Warn("Unknown external authentification type")
+		err = fmt.Errorf("External authentification unavailable")
+		return &r, err
 	}
 
-
 	if err != nil {
 		log.Warn(err.Error())
 		err = fmt.Errorf("External authentification unavailable")
@@ -95,18 +116,99 @@ func (ea *ExtAuth) Auth(authMsg *msg.Auth) (*Rights, error) {
 	sort.Strings(r.data.AllowedHostnames)
 	sort.Strings(r.data.AllowedSubdomains)
 	sort.Ints(r.data.AllowedPorts)
+	for i, name := range r.data.FindmeHostnames {
+		r.data.FindmeHostnames[i] = strings.ToLower(name)
+	}
+
+	return &r, r.setNamespace(authMsg.User)
+}
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// Picks the namespace of the token's subdomains when namespaces are enabled.
+// Clients without a token aren't namespaced.
+func (r *Rights) setNamespace(token string) error {
+	if !opts.namespaces {
+		return nil
+	}
+
+	r.namespace = strings.ToLower(r.data.Namespace)
+	if r.namespace == "" && token != "" {
+		sum := sha256.Sum256([]byte(token))
+		r.namespace = hex.EncodeToString(sum[:4])
+	}
+
+	if r.namespace != "" && !namespacePattern.MatchString(r.namespace) {
+		return fmt.Errorf("Invalid namespace %s", r.namespace)
+	}
+	return nil
+}
+
+// Returns the namespace of the token's subdomains, "" if there is none
+func (r *Rights) Namespace() string {
+	return r.namespace
+}
 
-	return &r, err
+// Verifies that a tcp tunnel binds on one of the token's IPs, and picks the
+// first for tunnels that don't ask for one
+func (r *Rights) requestIp(rawTunnelReq *msg.ReqTunnel) error {
+	if len(r.data.AllowedIps) == 0 || (rawTunnelReq.Protocol != "tcp" && rawTunnelReq.Protocol != "socks") {
+		return nil
+	}
+
+	if rawTunnelReq.RemoteIp == "" {
+		rawTunnelReq.RemoteIp = r.data.AllowedIps[0]
+		return nil
+	}
+
+	ip := net.ParseIP(rawTunnelReq.RemoteIp)
+	for _, allowed := range r.data.AllowedIps {
+		if ip != nil && ip.Equal(net.ParseIP(allowed)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("IP %s not allowed for this session", rawTunnelReq.RemoteIp)
+}
+
+// Returns how many control connections the token may have at once, 0 for
+// no limit
+func (r *Rights) MaxSessions() int {
+	if r.data.MaxSessions != nil {
+		return *r.data.MaxSessions
+	}
+	return opts.maxSessionsPerToken
+}
+
+// Verifies that the tunnels may be found through a findme hostname
+func (r *Rights) FindmeAllowed(host string) bool {
+	return len(r.data.FindmeHostnames) == 0 || matchHostname(r.data.FindmeHostnames, host)
 }
 
 // Verifies that the tunnel request is valid
 func (r *Rights) RequestTunnel(rawTunnelReq *msg.ReqTunnel) error {
+	// http+https asks for a tunnel on each protocol, checked one at a time
+	// so that hostnames are canonicalized with each protocol's default port
+	if protocols := strings.Split(rawTunnelReq.Protocol, "+"); len(protocols) > 1 {
+		for _, proto := range protocols {
+			tunnelReq := *rawTunnelReq
+			tunnelReq.Protocol = proto
+			if err := r.RequestTunnel(&tunnelReq); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := r.requestIp(rawTunnelReq); err != nil {
+		return err
+	}
+
 	if r.data.AllowAll {
 		return nil
 	}
 
 	switch rawTunnelReq.Protocol {
-	case "tcp":
+	case "tcp", "socks":
 		port := int(rawTunnelReq.RemotePort)
 		if port != 0 {
 			i := sort.SearchInts(r.data.AllowedPorts, port)
@@ -122,7 +224,7 @@ func (r *Rights) RequestTunnel(rawTunnelReq *msg.ReqTunnel) error {
 		err := fmt.Errorf("Automatic port not allowed for this session")
 		return err
 	case "http", "https":
-		hostname := strings.ToLower(strings.TrimSpace(rawTunnelReq.Hostname))
+		hostname := canonicalHost(rawTunnelReq.Protocol, rawTunnelReq.Hostname)
 		if hostname != "" {
 			i := sort.SearchStrings(r.data.AllowedHostnames, hostname)
 			if i < len(r.data.AllowedHostnames) && r.data.AllowedHostnames[i] == hostname {
@@ -132,6 +234,11 @@ func (r *Rights) RequestTunnel(rawTunnelReq *msg.ReqTunnel) error {
 			return err
 		}
 		subdomain := strings.ToLower(strings.TrimSpace(rawTunnelReq.Subdomain))
+		if subdomain != "" && r.namespace != "" && len(r.data.AllowedSubdomains) == 0 {
+			// any subdomain is fine within the token's own namespace, unless
+			// the auth server lists which ones the token may use
+			return nil
+		}
 		if subdomain != "" {
 			i := sort.SearchStrings(r.data.AllowedSubdomains, subdomain)
 			if i < len(r.data.AllowedSubdomains) && r.data.AllowedSubdomains[i] == subdomain {
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"ngrok/conn"
+	"ngrok/util"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	FindmeResponse = `HTTP/1.0 200 OK
+Content-Type: %s
+Content-Length: %d
+Access-Control-Allow-Origin: *
+Cache-Control: no-cache
+
+%s`
+
+	FindmeRedirect = `HTTP/1.0 302 Found
+Content-Length: 0
+Location: %s
+Cache-Control: no-cache
+
+`
+)
+
+// Where the caller of the findme hostname is connecting from
+type findmeInfo struct {
+	Ip    string `json:"ip"`
+	Port  int    `json:"port,omitempty"`
+	Proto string `json:"proto"`
+}
+
+// Reports whether host matches any of the hostname patterns
+func matchHostname(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles a request to a findme hostname, host being the request's canonical
+// host like everywhere requests are routed. In "route" mode, the caller is
+// redirected to the tunnel opened by a client on the same public IP, which is
+// handy to find your own tunnel from another device on the same network. In
+// "info" mode, the caller's address is returned instead, as JSON or plain text.
+//
+// Auth tokens may be scoped to some of the findme hostnames, in which case
+// their tunnels are only found through those and not through the others.
+func findmeHandler(c conn.Conn, proto, host string, req *http.Request) {
+	info := findmeInfo{Proto: proto}
+	remoteIp, port, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		c.Warn("Failed to parse remote address %s: %v", c.RemoteAddr(), err)
+		c.Write([]byte(BadRequest))
+		return
+	}
+	info.Ip = remoteIp
+	info.Port, _ = strconv.Atoi(port)
+
+	// behind a load balancer, the caller is the last address it didn't add
+	if ip := forwardedFor(net.ParseIP(remoteIp), req.Header.Get("X-Forwarded-For")); ip != nil {
+		info.Ip, info.Port = ip.String(), 0
+	}
+
+	if opts.findmeMode == "info" {
+		findmeRespond(c, req, &info)
+		return
+	}
+
+	tunnel := tunnelRegistry.GetByClientIp(proto, info.Ip, func(t *Tunnel) bool {
+		return t.ctl.rights.FindmeAllowed(host)
+	})
+	if tunnel == nil {
+		c.Info("No tunnel found for findme client %s", info.Ip)
+		c.Write([]byte(fmt.Sprintf(NotFound, len(info.Ip)+18, info.Ip)))
+		return
+	}
+
+	location := tunnel.url + req.URL.RequestURI()
+	c.Debug("Redirecting findme client %s to %s", info.Ip, location)
+	c.Write([]byte(fmt.Sprintf(FindmeRedirect, location)))
+}
+
+// Returns the client address from an X-Forwarded-For header if peer is a
+// trusted proxy. Addresses are appended by each proxy along the way, so the
+// first untrusted one from the right is the client; anything left of it could
+// have been forged.
+func forwardedFor(peer net.IP, header string) net.IP {
+	if header == "" || peer == nil || !util.IpInNetworks(peer, trustedProxies) {
+		return nil
+	}
+
+	hops := strings.Split(header, ",")
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		if ip = net.ParseIP(strings.TrimSpace(hops[i])); ip == nil {
+			return nil
+		}
+
+		if !util.IpInNetworks(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// Writes the caller's address in the format asked for with the format query
+// parameter or, failing that, the Accept header. Plain text is the default.
+func findmeRespond(c conn.Conn, req *http.Request, info *findmeInfo) {
+	format := req.URL.Query().Get("format")
+	if format == "" && strings.Contains(req.Header.Get("Accept"), "application/json") {
+		format = "json"
+	}
+
+	var contentType, body string
+	switch format {
+	case "json":
+		buf, err := json.Marshal(info)
+		if err != nil {
+			panic(err)
+		}
+		contentType, body = "application/json", string(buf)+"\n"
+
+	default:
+		contentType, body = "text/plain; charset=utf-8", info.Ip+"\n"
+	}
+
+	c.Write([]byte(fmt.Sprintf(FindmeResponse, contentType, len(body), body)))
+}
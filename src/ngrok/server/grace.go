@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net"
+	"ngrok/conn"
+	"ngrok/log"
+	"sync"
+	"time"
+)
+
+// When a client's control connection drops, its URLs are held for the
+// reconnect grace period. Public connections for them wait instead of
+// failing, and are handed to the client's new tunnel if it reconnects in
+// time. TCP tunnels keep their listener open meanwhile so the new tunnel can
+// take over the port.
+type heldUrl struct {
+	// the client that had the url, only it may take over
+	clientId string
+
+	// the listener of a tcp tunnel, still accepting
+	listener *net.TCPListener
+
+	// whether the client's new tunnel took the listener, it then finishes
+	// the handover by calling resume once it's registered
+	taken bool
+
+	// closed when the url is taken over or the grace period ends
+	done chan struct{}
+
+	// the tunnel that took over, nil if none did in time
+	next *Tunnel
+}
+
+type graceRegistry struct {
+	sync.Mutex
+	urls map[string]*heldUrl
+}
+
+var graceUrls = &graceRegistry{urls: make(map[string]*heldUrl)}
+
+// Holds the url of a tunnel whose control connection went away. Returns
+// false when the grace period is off and the tunnel should close as usual.
+func (r *graceRegistry) hold(t *Tunnel) bool {
+	if opts.reconnectGrace <= 0 {
+		return false
+	}
+
+	h := &heldUrl{clientId: t.clientId, listener: t.listener, done: make(chan struct{})}
+
+	r.Lock()
+	r.urls[t.url] = h
+	r.Unlock()
+
+	t.Info("Holding %s for %s while the client reconnects", t.url, opts.reconnectGrace)
+	time.AfterFunc(opts.reconnectGrace, func() { r.expire(t.url, h) })
+	return true
+}
+
+func (r *graceRegistry) expire(url string, h *heldUrl) {
+	r.Lock()
+	if r.urls[url] != h || h.taken {
+		r.Unlock()
+		return
+	}
+	delete(r.urls, url)
+	r.Unlock()
+
+	log.Info("Client %s didn't reconnect in time, releasing %s", h.clientId, url)
+	if h.listener != nil {
+		h.listener.Close()
+	}
+	close(h.done)
+}
+
+// Hands a held url to the tunnel that registered it. Connections held for
+// another client's url are dropped rather than given to t.
+func (r *graceRegistry) resume(t *Tunnel) {
+	r.Lock()
+	h := r.urls[t.url]
+	delete(r.urls, t.url)
+	r.Unlock()
+
+	if h == nil {
+		return
+	}
+
+	if h.clientId == t.clientId {
+		t.Info("Took over held connections for %s", t.url)
+		h.next = t
+	}
+	if h.listener != nil && h.listener != t.listener {
+		h.listener.Close()
+	}
+	close(h.done)
+}
+
+// The listener of a held tcp url, if the client that had it asks for it back.
+// From then on the url doesn't expire, the caller must either resume or
+// release it.
+func (r *graceRegistry) listener(url, clientId string) *net.TCPListener {
+	r.Lock()
+	defer r.Unlock()
+	if h := r.urls[url]; h != nil && h.clientId == clientId && h.listener != nil && !h.taken {
+		h.taken = true
+		return h.listener
+	}
+	return nil
+}
+
+// Gives up a url whose listener was taken by a tunnel that then failed to
+// register, closing the listener and the connections waiting for it
+func (r *graceRegistry) release(url string) {
+	r.Lock()
+	h := r.urls[url]
+	if h != nil {
+		h.taken = false
+	}
+	r.Unlock()
+
+	if h != nil {
+		r.expire(url, h)
+	}
+}
+
+// Waits for the tunnel that takes over a held url. Returns the tunnel
+// registered for the url right away if it isn't held.
+func (r *graceRegistry) wait(url string, c conn.Conn) *Tunnel {
+	r.Lock()
+	h := r.urls[url]
+	r.Unlock()
+
+	if h == nil {
+		return tunnelRegistry.Get(url)
+	}
+
+	c.Info("Holding connection while the client of %s reconnects", url)
+	<-h.done
+	return h.next
+}
@@ -1,13 +1,19 @@
 package server
 
 import (
+	"bufio"
 	"crypto/tls"
 	"fmt"
 	vhost "github.com/inconshreveable/go-vhost"
-	//"net"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
 	"ngrok/conn"
 	"ngrok/log"
-	"strings"
+	"ngrok/util"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,20 +37,37 @@ Content-Length: 12
 Bad Request
 `
 
+	HeaderTooLarge = `HTTP/1.0 431 Request Header Fields Too Large
+Content-Length: 32
+
+Request header fields too large
+`
+
+	BodyTooLarge = `HTTP/1.0 413 Request Entity Too Large
+Content-Length: 25
+
+Request entity too large
+`
+
+	RequestIdHeader = "X-Request-Id"
+
+	// largest request headers accepted without -maxHeaderBytes, the same as
+	// net/http's default
+	defaultMaxHeaderBytes = 1 << 20
+
 	RedirectHttps = `HTTP/1.0 301 Moved Permanently
 Content-Length: %d
 Location: https://%s
 
 Content Moved to https://%s
 `
-
 )
 
 // Listens for new http(s) connections from the public internet
 func startHttpListener(addr string, tlsCfg *tls.Config) (listener *conn.Listener) {
 	// bind/listen for incoming connections
 	var err error
-	if listener, err = conn.Listen(addr, "pub", tlsCfg); err != nil {
+	if listener, err = conn.ListenProxied(addr, "pub", tlsCfg, trustedProxies); err != nil {
 		panic(err)
 	}
 
@@ -66,6 +89,8 @@ func startHttpListener(addr string, tlsCfg *tls.Config) (listener *conn.Listener
 // Handles a new http connection from the public internet
 func httpHandler(c conn.Conn, proto string) {
 	defer c.Close()
+	atomic.AddInt64(&activeConns, 1)
+	defer atomic.AddInt64(&activeConns, -1)
 	defer func() {
 		// recover from failures
 		if r := recover(); r != nil {
@@ -76,19 +101,26 @@ func httpHandler(c conn.Conn, proto string) {
 	// Make sure we detect dead connections while we decide how to multiplex
 	c.SetDeadline(time.Now().Add(connReadTimeout))
 
-	// multiplex by extracting the Host header, the vhost library
+	// multiplex by extracting the Host header, the vhost library. It reads
+	// as much as it takes to find the end of the headers, so cap that.
+	lift := c.LimitReads(maxHeaderBytes() + 4096)
 	vhostConn, err := vhost.HTTP(c)
+	exceeded := lift()
 	if err != nil {
-		c.Warn("Failed to read valid %s request: %v", proto, err)
-		c.Write([]byte(BadRequest))
+		if exceeded {
+			c.Info("Request headers are larger than %d bytes", maxHeaderBytes())
+			c.Write([]byte(HeaderTooLarge))
+		} else {
+			c.Warn("Failed to read valid %s request: %v", proto, err)
+			c.Write([]byte(BadRequest))
+		}
 		return
 
 	}
 
-	// read out the Host header and auth from the request
-	host := strings.ToLower(vhostConn.Host())
-	auth := vhostConn.Request.Header.Get("Authorization")
-	url := fmt.Sprintf("%s%s", host, vhostConn.Request.URL)
+	// read out the Host header from the request
+	host := canonicalHost(proto, vhostConn.Host())
+	req := vhostConn.Request
 
 	// done reading mux data, free up the request memory
 	vhostConn.Free()
@@ -96,9 +128,57 @@ func httpHandler(c conn.Conn, proto string) {
 	// We need to read from the vhost conn now since it mucked around reading the stream
 	c = conn.Wrap(vhostConn, "pub")
 
+	tunnel := routeHttp(c, proto, host, req, false)
+	if tunnel == nil {
+		return
+	}
+
+	// dead connections will now be handled by tunnel heartbeating and the client
+	c.SetDeadline(time.Time{})
+
+	// let the tunnel handle the connection now
+	span := httpSpan(c, tunnel, host, req)
+	if parseHttp(tunnel) {
+		proxyHttp(c, proto, tunnel, span)
+	} else {
+		tunnel.handlePublicConnection(c, span)
+	}
+}
+
+// Finds the tunnel a request is for. Requests that don't go to a tunnel here
+// are answered or relayed to a peer and nil is returned. If the request was
+// already read from c, it's replayed to the peer.
+func routeHttp(c conn.Conn, proto, host string, req *http.Request, consumed bool) *Tunnel {
+	if opts.statusHost != "" && host == opts.statusHost {
+		statusHandler(c, req)
+		return nil
+	}
+
+	if opts.releaseHost != "" && host == opts.releaseHost {
+		releaseHandler(c, proto, req)
+		return nil
+	}
+
+	// findme hostnames don't belong to any tunnel
+	if matchHostname(opts.findme, host) {
+		findmeHandler(c, proto, host, req)
+		return nil
+	}
+
+	// tunnels don't take new requests while we're draining
+	if maintenance.enabled() {
+		c.Info("Down for maintenance, not serving %s", host)
+		c.Write(maintenance.response())
+		return nil
+	}
+
 	// multiplex to find the right backend host
 	c.Debug("Found hostname %s in request", host)
 	tunnel := tunnelRegistry.Get(fmt.Sprintf("%s://%s", proto, host))
+	if tunnel == nil {
+		// its client may be reconnecting
+		tunnel = graceUrls.wait(fmt.Sprintf("%s://%s", proto, host), c)
+	}
 	if tunnel == nil {
 		if proto == "http" {
 			c.Debug("No http tunnel found, so check if we have one for https://%s", host)
@@ -106,28 +186,380 @@ func httpHandler(c conn.Conn, proto string) {
 			tunnel = tunnelRegistry.Get(fmt.Sprintf("https://%s", host))
 			if tunnel != nil {
 				// get the complete requested URL
+				url := fmt.Sprintf("%s%s", host, req.URL)
 				c.Debug("Redirecting to https for request %s", url)
 				c.Write([]byte(fmt.Sprintf(RedirectHttps, len(url)+26, url, url)))
-				return
+				return nil
 			}
 		}
+
+		// the tunnel may be connected to another server of the cluster
+		var replay *http.Request
+		if consumed {
+			replay = req
+		}
+		if relayToPeer(c, fmt.Sprintf("%s://%s", proto, host), replay) {
+			return nil
+		}
+
 		c.Info("No tunnel found for hostname %s", host)
 		c.Write([]byte(fmt.Sprintf(NotFound, len(host)+18, host)))
-		return
+		return nil
 	}
 
 	// If the client specified http auth and it doesn't match this request's auth
 	// then fail the request with 401 Not Authorized and request the client reissue the
 	// request with basic authdeny the request
-	if tunnel.req.HttpAuth != "" && auth != tunnel.req.HttpAuth {
+	if auth := req.Header.Get("Authorization"); tunnel.req.HttpAuth != "" && auth != tunnel.req.HttpAuth {
 		c.Info("Authentication failed: %s", auth)
 		c.Write([]byte(NotAuthorized))
+		return nil
+	}
+
+	return tunnel
+}
+
+func httpSpan(c conn.Conn, t *Tunnel, host string, req *http.Request) *Span {
+	span := StartSpanFromTraceparent("http.request", spanKindServer, req.Header.Get(TraceparentHeader))
+	span.SetAttr("http.method", req.Method)
+	span.SetAttr("http.host", host)
+	span.SetAttr("http.target", req.URL.RequestURI())
+	span.SetAttr("ngrok.tunnel", t.url)
+	span.SetAttr("net.peer.addr", c.RemoteAddr().String())
+	return span
+}
+
+// Whether the server reads the requests of the tunnel instead of passing the
+// raw stream through
+func parseHttp(t *Tunnel) bool {
+	return opts.httpKeepAlive > 0 || opts.maxHeaderBytes > 0 || opts.maxBodyBytes > 0 || opts.requestIds || t.cache != nil || len(t.req.CorsOrigins) > 0 || len(t.rewrites) > 0 || t.req.RewriteLocation
+}
+
+// Reads the requests instead of passing the raw stream through so that the
+// size limits are enforced before anything reaches the tunnel, requests can be
+// tagged with an id and responses can be cached or have CORS headers added.
+// With keep-alive enabled, the following requests on the connection are each
+// routed to their own tunnel, otherwise only one request is proxied.
+func proxyHttp(c conn.Conn, proto string, t *Tunnel, span *Span) {
+	limited := &io.LimitedReader{R: c, N: math.MaxInt64}
+	br := bufio.NewReader(limited)
+
+	backend := new(httpBackend)
+	defer backend.close()
+
+	for first := true; ; first = false {
+		if !first {
+			// wait for the next request on the persistent connection
+			c.SetReadDeadline(time.Now().Add(opts.httpKeepAlive))
+			if _, err := br.Peek(1); err != nil {
+				return
+			}
+			c.SetReadDeadline(time.Now().Add(connReadTimeout))
+		}
+
+		req := readHttpRequest(c, br, limited)
+		if req == nil {
+			if first {
+				span.End(fmt.Errorf("Failed to read request"))
+			}
+			return
+		}
+
+		if !first {
+			host := canonicalHost(proto, req.Host)
+			if t = routeHttp(&bufferedConn{c, br}, proto, host, req, true); t == nil {
+				return
+			}
+			c.SetReadDeadline(time.Time{})
+			span = httpSpan(c, t, host, req)
+		}
+
+		if !proxyHttpRequest(c, t, req, br, backend, span) {
+			return
+		}
+	}
+}
+
+func maxHeaderBytes() int64 {
+	if opts.maxHeaderBytes > 0 {
+		return opts.maxHeaderBytes
+	}
+	return defaultMaxHeaderBytes
+}
+
+// Reads a request, answering with an error if it's malformed or its headers
+// are too large
+func readHttpRequest(c conn.Conn, br *bufio.Reader, limited *io.LimitedReader) *http.Request {
+	// like net/http, leave some slack for the request line and buffering
+	limited.N = maxHeaderBytes() + 4096
+
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		if limited.N <= 0 {
+			c.Info("Request headers are larger than %d bytes", maxHeaderBytes())
+			c.Write([]byte(HeaderTooLarge))
+		} else {
+			c.Warn("Failed to read request: %v", err)
+			c.Write([]byte(BadRequest))
+		}
+		return nil
+	}
+	limited.N = math.MaxInt64
+
+	return req
+}
+
+// Proxies one request and returns whether the public connection may be
+// used for another one
+func proxyHttpRequest(c conn.Conn, t *Tunnel, req *http.Request, br *bufio.Reader, backend *httpBackend, span *Span) (keepAlive bool) {
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			c.Warn("proxyHttp failed with error %v", r)
+			err = fmt.Errorf("%v", r)
+			keepAlive = false
+		}
+		span.End(err)
+	}()
+
+	startTime := time.Now()
+	metrics.OpenConnection(t, c)
+
+	var body *bodyLimitReader
+	if opts.maxBodyBytes > 0 {
+		if req.ContentLength > opts.maxBodyBytes {
+			c.Info("Request body of %d bytes is larger than %d bytes", req.ContentLength, opts.maxBodyBytes)
+			c.Write([]byte(BodyTooLarge))
+			return
+		}
+
+		// chunked bodies are cut off when they exceed the limit
+		body = &bodyLimitReader{ReadCloser: req.Body, remaining: opts.maxBodyBytes}
+		req.Body = body
+	}
+
+	// tag the request so it can be traced through the logs of the server,
+	// the client and the backend. Only load balancers may set their own id.
+	requestId := req.Header.Get(RequestIdHeader)
+	if opts.requestIds && (requestId == "" || !trustedPeer(c)) {
+		requestId = util.RandId(16)
+		req.Header.Set(RequestIdHeader, requestId)
+	}
+
+	rewritePath(t.rewrites, req)
+
+	// otherwise Request.Write adds Go's own
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header.Set("User-Agent", "")
+	}
+
+	// the visitor keeps the connection open if it asked to, and the
+	// proxy connection stays open for as long as the backend lets it
+	keepAlive = opts.httpKeepAlive > 0 && !req.Close
+	upgrade := req.Header.Get("Upgrade") != ""
+	if !upgrade {
+		req.Header.Del("Connection")
+		req.Close = opts.httpKeepAlive == 0
+	}
+
+	// some requests are answered at the edge without bothering the client
+	edgeResp := corsPreflight(t.req.CorsOrigins, req)
+	if edgeResp == nil && t.cache != nil {
+		if edgeResp = t.cache.lookup(req); edgeResp != nil {
+			addCorsHeaders(t.req.CorsOrigins, req, edgeResp)
+		}
+	}
+
+	if edgeResp != nil {
+		c.Debug("Answering %s %s at the edge", req.Method, req.URL)
+		if requestId != "" {
+			edgeResp.Header.Set(RequestIdHeader, requestId)
+		}
+		accessLog(c, req, edgeResp, requestId)
+		span.SetAttr("http.status_code", edgeResp.StatusCode)
+		span.SetAttr("ngrok.edge_response", true)
+		edgeResp.Close = !keepAlive
+		if keepAlive {
+			// the next request starts after the body
+			io.Copy(ioutil.Discard, req.Body)
+		}
+		out := &countingWriter{w: c}
+		if err = edgeResp.Write(out); err != nil {
+			c.Warn("Failed to write response: %v", err)
+			keepAlive = false
+		}
+		metrics.CloseConnection(t, c, startTime, 0, out.n)
 		return
 	}
 
-	// dead connections will now be handled by tunnel heartbeating and the client
-	c.SetDeadline(time.Time{})
+	if err = backend.connect(c, t, span); err != nil {
+		return false
+	}
+	proxyConn, pbr := backend.conn, backend.br
 
-	// let the tunnel handle the connection now
-	tunnel.HandlePublicConnection(c)
+	// time spent by the client and the backend until the response headers arrive
+	backendSpan := StartSpan("backend", spanKindClient, span)
+	if backendSpan != nil {
+		req.Header.Set(TraceparentHeader, backendSpan.Traceparent())
+	}
+
+	in := &countingWriter{w: proxyConn}
+	if err = req.Write(in); err != nil {
+		if body != nil && body.exceeded {
+			c.Info("Request body is larger than %d bytes", opts.maxBodyBytes)
+			c.Write([]byte(BodyTooLarge))
+		} else {
+			c.Warn("Failed to write request to %s: %v", proxyConn.Id(), err)
+		}
+		backendSpan.End(err)
+		return false
+	}
+
+	resp, err := http.ReadResponse(pbr, req)
+	backendSpan.End(err)
+	if err != nil {
+		c.Warn("Failed to read response from %s: %v", proxyConn.Id(), err)
+		return false
+	}
+	defer resp.Body.Close()
+	span.SetAttr("http.status_code", resp.StatusCode)
+
+	if t.cache != nil {
+		t.cache.store(req, resp)
+	}
+	addCorsHeaders(t.req.CorsOrigins, req, resp)
+	if requestId != "" {
+		resp.Header.Set(RequestIdHeader, requestId)
+	}
+	if t.req.RewriteLocation {
+		rewriteLocation(t.url, resp)
+	}
+	accessLog(c, req, resp, requestId)
+
+	// a backend that closes or doesn't delimit its response can't take
+	// another request, and neither can the visitor in the latter case
+	if resp.Close || req.Close {
+		backend.release()
+	}
+	if resp.ContentLength < 0 && !chunked(resp.TransferEncoding) {
+		keepAlive = false
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Header.Del("Connection")
+		resp.Close = !keepAlive
+	}
+
+	out := &countingWriter{w: c}
+	if err = resp.Write(out); err != nil {
+		c.Warn("Failed to write response: %v", err)
+		return false
+	}
+
+	// websockets and other upgraded protocols are passed through from here on
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		bytesIn, bytesOut := conn.JoinIdle(&bufferedConn{c, br}, &bufferedConn{proxyConn, pbr}, t.idleTimeout())
+		in.n += bytesIn
+		out.n += bytesOut
+		keepAlive = false
+	}
+
+	metrics.CloseConnection(t, c, startTime, in.n, out.n)
+	return
+}
+
+func chunked(te []string) bool {
+	return len(te) > 0 && te[0] == "chunked"
+}
+
+// The proxy connection of a public connection, which is reused for following
+// requests to the same tunnel while the backend keeps it open
+type httpBackend struct {
+	t    *Tunnel
+	conn conn.Conn
+	br   *bufio.Reader
+}
+
+func (b *httpBackend) connect(c conn.Conn, t *Tunnel, span *Span) (err error) {
+	if b.conn != nil && b.t == t {
+		c.Debug("Reusing proxy connection %s", b.conn.Id())
+		return
+	}
+	b.close()
+
+	if b.conn, err = t.tracedProxyConn(c, span); err != nil {
+		return
+	}
+	b.t = t
+	b.br = bufio.NewReader(b.conn)
+	return
+}
+
+// closes the proxy connection once the current request is done with it
+func (b *httpBackend) release() {
+	b.t = nil
+}
+
+func (b *httpBackend) close() {
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn, b.t = nil, nil
+	}
+}
+
+func accessLog(c conn.Conn, req *http.Request, resp *http.Response, requestId string) {
+	if requestId != "" {
+		c.Info("%s %s -> %s [%s]", req.Method, req.URL.RequestURI(), resp.Status, requestId)
+	} else {
+		c.Info("%s %s -> %s", req.Method, req.URL.RequestURI(), resp.Status)
+	}
+}
+
+// Whether the connection comes from a trusted load balancer
+func trustedPeer(c conn.Conn) bool {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	return ok && util.IpInNetworks(addr.IP, trustedProxies)
+}
+
+// A connection with data buffered while parsing HTTP from it
+type bufferedConn struct {
+	conn.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Fails reads once the body is longer than remaining bytes, like
+// http.MaxBytesReader, and remembers that it did
+type bodyLimitReader struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (r *bodyLimitReader) Read(p []byte) (n int, err error) {
+	// read one byte past the limit to tell a body that ends right at it
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err = r.ReadCloser.Read(p)
+	if int64(n) > r.remaining {
+		n, r.remaining, r.exceeded = int(r.remaining), 0, true
+		return n, fmt.Errorf("Request body too large")
+	}
+	r.remaining -= int64(n)
+	return
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	w.n += int64(n)
+	return
 }
@@ -2,26 +2,36 @@ package server
 
 import (
 	"crypto/tls"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"ngrok/conn"
 	log "ngrok/log"
 	"ngrok/msg"
+	"ngrok/service"
 	"ngrok/util"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"syscall"
 	"time"
 )
 
 const (
-	registryCacheSize uint64        = 1024 * 1024 // 1 MB
-	connReadTimeout   time.Duration = 10 * time.Second
+	connReadTimeout time.Duration = 10 * time.Second
 )
 
 // GLOBALS
 var (
 	tunnelRegistry  *TunnelRegistry
+	cluster         *Cluster
 	controlRegistry *ControlRegistry
 	extAuth         *ExtAuth
+	tlsConfig       *tls.Config
+	trustedProxies  []*net.IPNet
+	randomSubdomain func() string
+	startTime       time.Time
 
 	// XXX: kill these global variables - they're only used in tunnel.go for constructing forwarding URLs
 	opts      *Options
@@ -57,13 +67,25 @@ func NewProxy(pxyConn conn.Conn, regPxy *msg.RegProxy) {
 // TLS and running all connections over the same port, we can bust through
 // restrictive firewalls.
 func tunnelListener(addr string, tlsConfig *tls.Config) {
-	// listen for incoming connections
-	listener, err := conn.Listen(addr, "tun", tlsConfig)
+	// listen for incoming connections. Behind a load balancer, the PROXY
+	// header tells where clients connect from, which findme and the url
+	// affinity go by.
+	listener, err := conn.ListenProxied(addr, "tun", tlsConfig, trustedProxies)
 	if err != nil {
 		panic(err)
 	}
 
 	log.Info("Listening for control and proxy connections on %s", listener.Addr.String())
+
+	// tell systemd we're up and feed its watchdog while the registries respond
+	if _, err := util.SdNotify("READY=1"); err != nil {
+		log.Warn("Failed to notify systemd: %v", err)
+	}
+	go util.SdWatchdog(func() {
+		controlRegistry.Count()
+		tunnelRegistry.CountByProtocol()
+	})
+
 	for c := range listener.Conns {
 		go func(tunnelConn conn.Conn) {
 			// don't crash on panics
@@ -100,11 +122,53 @@ func tunnelListener(addr string, tlsConfig *tls.Config) {
 }
 
 func Main() {
+	startTime = time.Now()
+
 	// parse options
 	opts = parseArgs()
 
-	// init logging
-	log.LogTo(opts.logto, opts.loglevel)
+	// install and control the Windows service
+	if opts.service != nil {
+		if err := service.Command("ngrokd", "ngrok tunnel server", opts.service); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// init logging, services log to the event log unless told otherwise
+	if service.IsService() && opts.logto == "stdout" {
+		// there's nowhere to report it if that fails
+		log.LogToEventLog("ngrokd", opts.loglevel)
+	} else {
+		log.LogTo(opts.logto, opts.loglevel)
+	}
+
+	if service.IsService() {
+		if err := service.Run("ngrokd", run, nil); err != nil {
+			log.Error("Failed to run as a service: %v", err)
+			os.Exit(1)
+		}
+		tunnelRegistry.Close()
+		return
+	}
+
+	run()
+}
+
+// Closes the affinity cache store when we're told to stop, so that the last
+// assignments aren't lost
+func closeOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+
+	log.Info("Stopping on %v", sig)
+	tunnelRegistry.Close()
+	os.Exit(0)
+}
+
+func run() {
 
 	// seed random number generator
 	seed, err := util.RandomSeed()
@@ -120,16 +184,64 @@ func Main() {
 	}
 	extAuth = NewExtAuth(opts.authurl, authType)
 
+	// protocol messages longer than this are rejected
+	msg.MaxMsgSize = opts.maxMsgBytes
+
+	// how random subdomains look
+	if randomSubdomain, err = newSubdomainGenerator(opts.subdomainScheme, opts.subdomainLength, opts.subdomainCharset); err != nil {
+		panic(err)
+	}
+
+	// subdomains nobody may claim
+	if reservedSubdomains, err = loadReservedSubdomains(opts.reservedSubdomains, opts.reservedSubdomainsFile); err != nil {
+		panic(err)
+	}
+
+	// what visitors see during maintenance
+	if opts.maintenancePage != "" {
+		if maintenance.page, err = ioutil.ReadFile(opts.maintenancePage); err != nil {
+			panic(err)
+		}
+	}
+
+	// load balancers allowed to tell us the real client address
+	if opts.trustedProxies != "" {
+		if trustedProxies, err = util.ParseNetworks(opts.trustedProxies); err != nil {
+			panic(err)
+		}
+	}
+
+	// export traces to an OpenTelemetry collector
+	if opts.otlpEndpoint != "" {
+		tracer = NewTracer(opts.otlpEndpoint)
+	}
+
+	// lifecycle events for external systems
+	if opts.webhookUrl != "" {
+		webhook = NewWebhook(opts.webhookUrl, opts.webhookSecret)
+	}
+
 	// init tunnel/control registry
 	registryCacheFile := os.Getenv("REGISTRY_CACHE_FILE")
-	tunnelRegistry = NewTunnelRegistry(registryCacheSize, registryCacheFile)
+	tunnelRegistry = NewTunnelRegistry(opts.registryCacheSize, opts.registryCacheTtl, opts.registryCachePolicy, registryCacheFile)
 	controlRegistry = NewControlRegistry()
+	edgeCacheSize = opts.edgeCacheSize
+	go closeOnSignal()
+
+	// the other servers sharing the domain
+	if opts.peerAddr != "" || len(opts.peers) > 0 {
+		cluster = NewCluster(opts.peerAddr, opts.peers)
+	}
+
+	for typ, socketOpts := range opts.socketOptions {
+		conn.SetSocketOptions(typ, socketOpts)
+	}
 
 	// start listeners
 	listeners = make(map[string]*conn.Listener)
 
 	// load tls configuration
-	tlsConfig, err := LoadTLSConfig(opts.tlsCrt, opts.tlsKey)
+	tlsConfig, err = LoadTLSConfig(opts.tlsCrts, opts.tlsKeys, opts.ocspStapling)
 	if err != nil {
 		panic(err)
 	}
@@ -144,6 +256,21 @@ func Main() {
 		listeners["https"] = startHttpListener(opts.httpsAddr, tlsConfig)
 	}
 
+	// connections relayed by the other servers of the cluster
+	if opts.peerAddr != "" {
+		listeners["peer"] = startPeerListener(opts.peerAddr)
+	}
+
+	// ssh reverse tunnels
+	if opts.sshAddr != "" {
+		listeners["ssh"] = startSSHListener(opts.sshAddr, opts.sshKey)
+	}
+
+	// api for operators
+	if opts.adminAddr != "" {
+		startAdminListener(opts.adminAddr, opts.adminToken)
+	}
+
 	// ngrok clients
 	tunnelListener(opts.tunnelAddr, tlsConfig)
 }
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"ngrok/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MaintenanceResponse = `HTTP/1.0 503 Service Unavailable
+Content-Type: text/html; charset=utf-8
+Retry-After: 300
+Content-Length: %d
+
+%s`
+
+	defaultMaintenancePage = "<html><body><h1>Down for maintenance</h1><p>This server is being upgraded, please try again in a few minutes.</p></body></html>\n"
+)
+
+// In maintenance mode, new control connections are dropped so that clients
+// retry later and new public connections get the maintenance page, while the
+// connections already being served finish so the server can be upgraded once
+// they're done.
+type maintenanceMode struct {
+	sync.RWMutex
+	on    bool
+	since time.Time
+
+	// the page public http(s) connections get
+	page []byte
+}
+
+var maintenance = &maintenanceMode{page: []byte(defaultMaintenancePage)}
+
+var errMaintenance = errors.New("The server is down for maintenance")
+
+// public connections being served, so operators can tell when a drain is done
+var activeConns int64
+
+func (m *maintenanceMode) enabled() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.on
+}
+
+func (m *maintenanceMode) set(on bool) {
+	m.Lock()
+	defer m.Unlock()
+	if on == m.on {
+		return
+	}
+
+	m.on = on
+	if on {
+		m.since = time.Now()
+		log.Info("Entering maintenance mode, %d public connections to drain", atomic.LoadInt64(&activeConns))
+	} else {
+		m.since = time.Time{}
+		log.Info("Leaving maintenance mode")
+	}
+}
+
+func (m *maintenanceMode) response() []byte {
+	return []byte(fmt.Sprintf(MaintenanceResponse, len(m.page), m.page))
+}
+
+// The state of maintenance mode for the admin API
+type maintenanceStatus struct {
+	Enabled     bool       `json:"enabled"`
+	Since       *time.Time `json:"since,omitempty"`
+	Tunnels     int        `json:"tunnels"`
+	Connections int64      `json:"connections"`
+}
+
+func (m *maintenanceMode) status() maintenanceStatus {
+	m.RLock()
+	defer m.RUnlock()
+
+	s := maintenanceStatus{Enabled: m.on, Connections: atomic.LoadInt64(&activeConns)}
+	if m.on {
+		since := m.since
+		s.Since = &since
+	}
+	for _, count := range tunnelRegistry.CountByProtocol() {
+		s.Tunnels += count
+	}
+	return s
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	gometrics "github.com/rcrowley/go-metrics"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"ngrok/conn"
 	"ngrok/log"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -106,7 +108,7 @@ func (m *LocalMetrics) OpenTunnel(t *Tunnel) {
 	}
 
 	switch t.req.Protocol {
-	case "tcp":
+	case "tcp", "socks":
 		m.tcpTunnelMeter.Mark(1)
 	case "http":
 		m.httpTunnelMeter.Mark(1)
@@ -130,19 +132,45 @@ func (m *LocalMetrics) Report() {
 
 	for {
 		time.Sleep(m.reportInterval)
+		caches := cacheStatuses()
+
+		// the clients' mean heartbeat round trips, and the slowest of them
+		var rttMean, rttMax float64
+		var measured int
+		for _, ctl := range controlStatuses() {
+			if ctl.Rtt.Count > 0 {
+				measured++
+				rttMean += ctl.Rtt.Mean
+				rttMax = math.Max(rttMax, ctl.Rtt.Mean)
+			}
+		}
+		if measured > 0 {
+			rttMean /= float64(measured)
+		}
+
 		buffer, err := json.Marshal(map[string]interface{}{
-			"windows":               m.windowsCounter.Count(),
-			"linux":                 m.linuxCounter.Count(),
-			"osx":                   m.osxCounter.Count(),
-			"other":                 m.otherCounter.Count(),
-			"httpTunnelMeter.count": m.httpTunnelMeter.Count(),
-			"tcpTunnelMeter.count":  m.tcpTunnelMeter.Count(),
-			"tunnelMeter.count":     m.tunnelMeter.Count(),
-			"tunnelMeter.m1":        m.tunnelMeter.Rate1(),
-			"connMeter.count":       m.connMeter.Count(),
-			"connMeter.m1":          m.connMeter.Rate1(),
-			"bytesIn.count":         m.bytesInCount.Count(),
-			"bytesOut.count":        m.bytesOutCount.Count(),
+			"windows":                 m.windowsCounter.Count(),
+			"linux":                   m.linuxCounter.Count(),
+			"osx":                     m.osxCounter.Count(),
+			"other":                   m.otherCounter.Count(),
+			"httpTunnelMeter.count":   m.httpTunnelMeter.Count(),
+			"tcpTunnelMeter.count":    m.tcpTunnelMeter.Count(),
+			"tunnelMeter.count":       m.tunnelMeter.Count(),
+			"tunnelMeter.m1":          m.tunnelMeter.Rate1(),
+			"connMeter.count":         m.connMeter.Count(),
+			"connMeter.m1":            m.connMeter.Rate1(),
+			"bytesIn.count":           m.bytesInCount.Count(),
+			"bytesOut.count":          m.bytesOutCount.Count(),
+			"registryCache.hits":      caches["registry"].Hits,
+			"registryCache.misses":    caches["registry"].Misses,
+			"registryCache.evictions": caches["registry"].Evictions,
+			"registryCache.size":      caches["registry"].Size,
+			"edgeCache.hits":          caches["edge"].Hits,
+			"edgeCache.misses":        caches["edge"].Misses,
+			"edgeCache.evictions":     caches["edge"].Evictions,
+			"edgeCache.size":          caches["edge"].Size,
+			"controlRtt.mean":         rttMean,
+			"controlRtt.max":          rttMax,
 		})
 
 		if err != nil {
@@ -165,6 +193,9 @@ type KeenIoMetrics struct {
 	ProjectToken string
 	HttpClient   http.Client
 	Metrics      chan *KeenIoMetric
+
+	// metrics dropped because keen.io couldn't keep up
+	dropped uint64
 }
 
 func NewKeenIoMetrics(batchInterval time.Duration) *KeenIoMetrics {
@@ -195,6 +226,10 @@ func NewKeenIoMetrics(batchInterval time.Duration) *KeenIoMetrics {
 				batch[m.Collection] = append(list, m.Event)
 
 			case <-batchTimer:
+				if dropped := atomic.SwapUint64(&k.dropped, 0); dropped > 0 {
+					k.Warn("Dropped %d metrics because the queue was full", dropped)
+				}
+
 				// no metrics to report
 				if len(batch) == 0 {
 					continue
@@ -218,6 +253,15 @@ func NewKeenIoMetrics(batchInterval time.Duration) *KeenIoMetrics {
 	return k
 }
 
+// Queues a metric without ever blocking the connection or tunnel it's about
+func (k *KeenIoMetrics) send(m *KeenIoMetric) {
+	select {
+	case k.Metrics <- m:
+	default:
+		atomic.AddUint64(&k.dropped, 1)
+	}
+}
+
 func (k *KeenIoMetrics) AuthedRequest(method, path string, body *bytes.Reader) (resp *http.Response, err error) {
 	path = fmt.Sprintf("https://api.keen.io/3.0/projects/%s%s", k.ProjectToken, path)
 	req, err := http.NewRequest(method, path, body)
@@ -286,7 +330,7 @@ func (k *KeenIoMetrics) CloseConnection(t *Tunnel, c conn.Conn, start time.Time,
 		BytesOut:           out,
 	}
 
-	k.Metrics <- &KeenIoMetric{Collection: "CloseConnection", Event: event}
+	k.send(&KeenIoMetric{Collection: "CloseConnection", Event: event})
 }
 
 func (k *KeenIoMetrics) OpenTunnel(t *Tunnel) {
@@ -325,5 +369,5 @@ func (k *KeenIoMetrics) CloseTunnel(t *Tunnel) {
 		Subdomain: t.req.Subdomain != "",
 	}
 
-	k.Metrics <- &KeenIoMetric{Collection: "CloseTunnel", Event: event}
+	k.send(&KeenIoMetric{Collection: "CloseTunnel", Event: event})
 }
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"ngrok/log"
+	"time"
+)
+
+const (
+	ocspTimeout       = 10 * time.Second
+	ocspRetryInterval = 5 * time.Minute
+	ocspMinRefresh    = time.Minute
+	ocspMaxRefresh    = 12 * time.Hour
+	maxOCSPResponse   = 1 << 20
+)
+
+// Keeps a fresh OCSP response stapled to a certificate, so visitors' browsers
+// don't have to ask the CA themselves
+type ocspStapler struct {
+	log.Logger
+	*liveCert
+	issuer *x509.Certificate
+	client http.Client
+}
+
+// Staples OCSP responses to the certificate and refreshes them in the
+// background. Certificates without an OCSP server or without their issuer in
+// the chain are left alone.
+func stapleOCSP(c *liveCert) error {
+	if len(c.cert.Certificate) < 2 || len(c.leaf.OCSPServer) == 0 {
+		return nil
+	}
+
+	issuer, err := x509.ParseCertificate(c.cert.Certificate[1])
+	if err != nil {
+		return err
+	}
+
+	s := &ocspStapler{
+		Logger:   log.NewPrefixLogger("ocsp", c.leaf.Subject.CommonName),
+		liveCert: c,
+		issuer:   issuer,
+		client:   http.Client{Timeout: ocspTimeout},
+	}
+	go s.refresh()
+	return nil
+}
+
+// Handshakes in progress may still use the old certificate, so it's copied
+// rather than changed
+func (s *ocspStapler) staple(raw []byte) {
+	cert := *s.get()
+	cert.OCSPStaple = raw
+	s.set(&cert)
+}
+
+// Fetches a new response halfway through the validity of the current one,
+// and drops a response that expired without being replaced
+func (s *ocspStapler) refresh() {
+	for {
+		wait := ocspRetryInterval
+		if resp, raw, err := s.fetch(); err != nil {
+			s.Warn("Failed to fetch OCSP response: %v", err)
+		} else {
+			s.staple(raw)
+
+			wait = resp.NextUpdate.Sub(time.Now()) / 2
+			if resp.NextUpdate.IsZero() || wait > ocspMaxRefresh {
+				wait = ocspMaxRefresh
+			} else if wait < ocspMinRefresh {
+				wait = ocspMinRefresh
+			}
+			s.Info("Stapled OCSP response, next update in %s", wait)
+		}
+
+		time.Sleep(wait)
+		s.dropExpired()
+	}
+}
+
+func (s *ocspStapler) dropExpired() {
+	raw := s.get().OCSPStaple
+	if raw == nil {
+		return
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, s.leaf, s.issuer)
+	if err != nil || (!resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate)) {
+		s.Warn("Stapled OCSP response expired")
+		s.staple(nil)
+	}
+}
+
+func (s *ocspStapler) fetch() (resp *ocsp.Response, raw []byte, err error) {
+	req, err := ocsp.CreateRequest(s.leaf, s.issuer, nil)
+	if err != nil {
+		return
+	}
+
+	for _, server := range s.leaf.OCSPServer {
+		var httpResp *http.Response
+		httpResp, err = s.client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+		if err != nil {
+			continue
+		}
+
+		raw, err = ioutil.ReadAll(io.LimitReader(httpResp.Body, maxOCSPResponse))
+		httpResp.Body.Close()
+		if err != nil {
+			continue
+		}
+		if httpResp.StatusCode != 200 {
+			err = fmt.Errorf("%s responded %s", server, httpResp.Status)
+			continue
+		}
+
+		if resp, err = ocsp.ParseResponseForCert(raw, s.leaf, s.issuer); err != nil {
+			continue
+		}
+
+		// never staple a response saying the certificate was revoked
+		if resp.Status != ocsp.Good {
+			err = fmt.Errorf("%s says the certificate's status is %d", server, resp.Status)
+			continue
+		}
+		return
+	}
+	return
+}
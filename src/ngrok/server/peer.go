@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"ngrok/conn"
+	"ngrok/log"
+	"ngrok/msg"
+	"ngrok/util"
+	"time"
+)
+
+// Listens for public connections relayed by the other servers of the cluster
+// for tunnels that are connected to this one, and for their gossip
+func startPeerListener(addr string) (listener *conn.Listener) {
+	// peers announce the visitor's address with a PROXY header
+	anywhere, err := util.ParseNetworks("0.0.0.0/0,::/0")
+	if err != nil {
+		panic(err)
+	}
+
+	if listener, err = conn.ListenProxied(addr, "peer", nil, anywhere); err != nil {
+		panic(err)
+	}
+
+	log.Info("Listening for connections relayed by peers on %s", listener.Addr.String())
+	go func() {
+		for c := range listener.Conns {
+			go peerHandler(c)
+		}
+	}()
+
+	return
+}
+
+func peerHandler(c conn.Conn) {
+	c.SetReadDeadline(time.Now().Add(connReadTimeout))
+
+	rawMsg, err := msg.ReadPeerMsg(c)
+	if err != nil {
+		c.Warn("Failed to read message from peer: %v", err)
+		c.Close()
+		return
+	}
+
+	switch m := rawMsg.(type) {
+	case *msg.PeerForward:
+		relayHandler(c, m)
+	case *msg.PeerGossip:
+		cluster.handleGossip(c, m)
+	default:
+		c.Warn("Unexpected message from peer: %v", rawMsg)
+		c.Close()
+	}
+}
+
+func relayHandler(c conn.Conn, fwd *msg.PeerForward) {
+	proto, err := relayedProto(fwd)
+	if err != nil {
+		c.Warn("Refusing to relay %s: %v", fwd.Url, err)
+		msg.WriteMsg(c, &msg.PeerForwardResp{Error: err.Error()})
+		c.Close()
+		return
+	}
+
+	c.Info("Relaying connection from %v for %s", c.RemoteAddr(), fwd.Url)
+	if err := msg.WriteMsg(c, &msg.PeerForwardResp{}); err != nil {
+		c.Warn("Failed to accept relay: %v", err)
+		c.Close()
+		return
+	}
+
+	// from here on it's like any public connection
+	c.SetReadDeadline(time.Time{})
+	httpHandler(c, proto)
+}
+
+// Checks a relay request, returning the protocol of the public connection
+func relayedProto(fwd *msg.PeerForward) (string, error) {
+	if subtle.ConstantTimeCompare([]byte(fwd.Secret), []byte(opts.peerSecret)) != 1 {
+		return "", fmt.Errorf("invalid secret")
+	}
+
+	u, err := url.Parse(fwd.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("only http(s) tunnels can be relayed")
+	}
+
+	// plain http requests are redirected when only an https tunnel exists
+	if tunnelRegistry.Get(fwd.Url) == nil && (u.Scheme != "http" || tunnelRegistry.Get("https://"+u.Host) == nil) {
+		return "", fmt.Errorf("tunnel not found")
+	}
+
+	return u.Scheme, nil
+}
+
+// Relays a public connection for a tunnel this server doesn't have to the
+// first peer that has it, starting with the replayed request if it was
+// already read. Returns false if none of them has the tunnel.
+func relayToPeer(c conn.Conn, tunnelUrl string, replay *http.Request) bool {
+	for _, addr := range cluster.Peers(tunnelUrl) {
+		peerConn, err := dialPeer(addr, c, tunnelUrl)
+		if err != nil {
+			c.Debug("Peer %s can't take %s: %v", addr, tunnelUrl, err)
+			continue
+		}
+		defer peerConn.Close()
+
+		if replay != nil {
+			// otherwise Request.Write adds Go's own
+			if _, ok := replay.Header["User-Agent"]; !ok {
+				replay.Header.Set("User-Agent", "")
+			}
+
+			if err = replay.Write(peerConn); err != nil {
+				c.Warn("Failed to replay request to peer %s: %v", addr, err)
+				return true
+			}
+		}
+
+		c.Info("Relaying %s to peer %s", tunnelUrl, addr)
+		c.SetDeadline(time.Time{})
+		conn.Join(c, peerConn)
+		return true
+	}
+	return false
+}
+
+func dialPeer(addr string, c conn.Conn, tunnelUrl string) (peerConn conn.Conn, err error) {
+	if peerConn, err = conn.Dial(addr, "peer", nil); err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			peerConn.Close()
+		}
+	}()
+
+	// the peer sees the visitor's address rather than ours
+	if _, err = peerConn.Write([]byte(conn.ProxyHeader(c.RemoteAddr().String(), peerConn.RemoteAddr()))); err != nil {
+		return
+	}
+
+	if err = msg.WriteMsg(peerConn, &msg.PeerForward{Url: tunnelUrl, Secret: opts.peerSecret}); err != nil {
+		return
+	}
+
+	peerConn.SetReadDeadline(time.Now().Add(connReadTimeout))
+	var resp msg.PeerForwardResp
+	if err = msg.ReadPeerMsgInto(peerConn, &resp); err != nil {
+		return
+	}
+	peerConn.SetReadDeadline(time.Time{})
+
+	if resp.Error != "" {
+		err = fmt.Errorf("%s", resp.Error)
+	}
+	return
+}
@@ -11,7 +11,7 @@ import (
 )
 
 const (
-	cacheSaveInterval time.Duration = 10 * time.Minute
+	cachePruneInterval time.Duration = 10 * time.Minute
 )
 
 type cacheUrl string
@@ -24,16 +24,19 @@ func (url cacheUrl) Size() int {
 type TunnelRegistry struct {
 	tunnels  map[string]*Tunnel
 	affinity *cache.LRUCache
+	store    *affinityStore
 	log.Logger
 	sync.RWMutex
 }
 
-func NewTunnelRegistry(cacheSize uint64, cacheFile string) *TunnelRegistry {
+func NewTunnelRegistry(cacheSize uint64, cacheTtl time.Duration, cachePolicy cache.EvictionPolicy, cacheFile string) *TunnelRegistry {
 	registry := &TunnelRegistry{
 		tunnels:  make(map[string]*Tunnel),
 		affinity: cache.NewLRUCache(cacheSize),
 		Logger:   log.NewPrefixLogger("registry", "tun"),
 	}
+	registry.affinity.SetTTL(cacheTtl)
+	registry.affinity.SetEvictionPolicy(cachePolicy)
 
 	// LRUCache uses Gob encoding. Unfortunately, Gob is fickle and will fail
 	// to encode or decode any non-primitive types that haven't been "registered"
@@ -42,14 +45,15 @@ func NewTunnelRegistry(cacheSize uint64, cacheFile string) *TunnelRegistry {
 	var urlobj cacheUrl
 	gob.Register(urlobj)
 
-	// try to load and then periodically save the affinity cache to file, if specified
+	// load the affinity cache from its store and write through to it, if specified
 	if cacheFile != "" {
-		err := registry.affinity.LoadItemsFromFile(cacheFile)
+		store, err := openAffinityStore(cacheFile, registry.affinity, cacheTtl)
 		if err != nil {
-			registry.Error("Failed to load affinity cache %s: %v", cacheFile, err)
+			registry.Error("Failed to open affinity cache %s: %v", cacheFile, err)
+		} else {
+			registry.store = store
+			registry.PruneCacheThread(cachePruneInterval)
 		}
-
-		registry.SaveCacheThread(cacheFile, cacheSaveInterval)
 	} else {
 		registry.Info("No affinity cache specified")
 	}
@@ -57,19 +61,31 @@ func NewTunnelRegistry(cacheSize uint64, cacheFile string) *TunnelRegistry {
 	return registry
 }
 
-// Spawns a goroutine the periodically saves the cache to a file.
-func (r *TunnelRegistry) SaveCacheThread(path string, interval time.Duration) {
+// Closes the affinity cache store, if there is one, so that all assignments
+// are on disk before the server exits
+func (r *TunnelRegistry) Close() {
+	if r.store == nil {
+		return
+	}
+
+	if err := r.store.Close(); err != nil {
+		r.Error("Failed to close affinity cache store: %v", err)
+	}
+}
+
+// Spawns a goroutine that periodically removes the assignments evicted
+// from the cache from its store.
+func (r *TunnelRegistry) PruneCacheThread(interval time.Duration) {
 	go func() {
-		r.Info("Saving affinity cache to %s every %s", path, interval.String())
+		r.Info("Pruning affinity cache store every %s", interval.String())
 		for {
 			time.Sleep(interval)
 
-			r.Debug("Saving affinity cache")
-			err := r.affinity.SaveItemsToFile(path)
+			pruned, err := r.store.Prune(r.affinity)
 			if err != nil {
-				r.Error("Failed to save affinity cache: %v", err)
+				r.Error("Failed to prune affinity cache store: %v", err)
 			} else {
-				r.Info("Saved affinity cache")
+				r.Debug("Pruned %d evicted affinity records", pruned)
 			}
 		}
 	}()
@@ -85,6 +101,12 @@ func (r *TunnelRegistry) Register(url string, t *Tunnel) error {
 		return fmt.Errorf("The tunnel %s is already registered.", url)
 	}
 
+	// peers only learn of each other's tunnels by gossip, so a url taken on
+	// another server in the last gossip round still gets through
+	if owner := cluster.Owner(url); owner != "" {
+		return fmt.Errorf("The tunnel %s is already registered on %s.", url, owner)
+	}
+
 	r.tunnels[url] = t
 
 	return nil
@@ -118,23 +140,41 @@ func (r *TunnelRegistry) RegisterAndCache(url string, t *Tunnel) (err error) {
 	if err = r.Register(url, t); err == nil {
 		// we successfully assigned a url, cache it
 		ipCacheKey, idCacheKey := r.cacheKeys(t)
-		r.affinity.Set(ipCacheKey, cacheUrl(url))
-		r.affinity.Set(idCacheKey, cacheUrl(url))
+		r.SetAffinity(url, ipCacheKey, idCacheKey)
+		cluster.Reserve(url, ipCacheKey, idCacheKey)
 	}
 	return
 
 }
 
+// Remembers the url for the clients identified by the affinity cache keys
+func (r *TunnelRegistry) SetAffinity(url string, keys ...string) {
+	for _, key := range keys {
+		r.affinity.Set(key, cacheUrl(url))
+	}
+
+	if r.store != nil {
+		if err := r.store.Put(url, keys...); err != nil {
+			r.Error("Failed to save affinity for %s: %v", url, err)
+		}
+	}
+}
+
 // Register a tunnel with the following process:
-// Consult the affinity cache to try to assign a previously used tunnel url if possible
-// Generate new urls repeatedly with the urlFn and register until one is available.
-func (r *TunnelRegistry) RegisterRepeat(urlFn func() string, t *Tunnel) (string, error) {
+// Consult the affinity cache to try to assign a previously used tunnel url if possible,
+// as long as the filter accepts it
+// Generate new urls repeatedly with the urlFn and register until one is available,
+// giving up after maxAttempts.
+func (r *TunnelRegistry) RegisterRepeat(urlFn func() string, t *Tunnel, maxAttempts int, filter func(string) bool) (string, error) {
 	url := r.GetCachedRegistration(t)
+	if url != "" && !filter(url) {
+		t.Debug("Not reusing registry affinity %s", url)
+		url = ""
+	}
 	if url == "" {
 		url = urlFn()
 	}
 
-	maxAttempts := 5
 	for i := 0; i < maxAttempts; i++ {
 		if err := r.RegisterAndCache(url, t); err != nil {
 			// pick a new url and try again
@@ -160,6 +200,68 @@ func (r *TunnelRegistry) Get(url string) *Tunnel {
 	return r.tunnels[url]
 }
 
+// Returns the most recent tunnel of the given protocol opened by a client
+// connecting from ip and accepted by the filter, if any
+func (r *TunnelRegistry) GetByClientIp(proto, ip string, filter func(*Tunnel) bool) (found *Tunnel) {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, t := range r.tunnels {
+		if t.req.Protocol != proto {
+			continue
+		}
+
+		addr, ok := t.ctl.conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || addr.IP.String() != ip || !filter(t) {
+			continue
+		}
+
+		if found == nil || t.start.After(found.start) {
+			found = t
+		}
+	}
+
+	return
+}
+
+// Returns the urls of all registered tunnels
+func (r *TunnelRegistry) Urls() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	urls := make([]string, 0, len(r.tunnels))
+	for url := range r.tunnels {
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// Returns the edge caches of the registered tunnels that have one
+func (r *TunnelRegistry) EdgeCaches() []*edgeCache {
+	r.RLock()
+	defer r.RUnlock()
+
+	caches := make([]*edgeCache, 0)
+	for _, t := range r.tunnels {
+		if t.cache != nil {
+			caches = append(caches, t.cache)
+		}
+	}
+	return caches
+}
+
+// Returns the number of registered tunnels for each protocol
+func (r *TunnelRegistry) CountByProtocol() map[string]int {
+	r.RLock()
+	defer r.RUnlock()
+
+	counts := make(map[string]int)
+	for _, t := range r.tunnels {
+		counts[t.req.Protocol]++
+	}
+	return counts
+}
+
 // ControlRegistry maps a client ID to Control structures
 type ControlRegistry struct {
 	controls map[string]*Control
@@ -180,10 +282,46 @@ func (r *ControlRegistry) Get(clientId string) *Control {
 	return r.controls[clientId]
 }
 
-func (r *ControlRegistry) Add(clientId string, ctl *Control) (oldCtl *Control) {
+func (r *ControlRegistry) Count() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.controls)
+}
+
+// All returns the registered controls
+func (r *ControlRegistry) All() []*Control {
+	r.RLock()
+	defer r.RUnlock()
+	controls := make([]*Control, 0, len(r.controls))
+	for _, ctl := range r.controls {
+		controls = append(controls, ctl)
+	}
+	return controls
+}
+
+// Add registers the control, replacing the one the client had before. It
+// fails when the control's token already has maxSessions other clients
+// connected; 0 means no limit, and clients without a token aren't limited.
+// Only the clients connected to this server count, not those of its peers.
+func (r *ControlRegistry) Add(clientId string, ctl *Control, maxSessions int) (oldCtl *Control, err error) {
 	r.Lock()
 	defer r.Unlock()
 
+	if token := ctl.auth.User; maxSessions > 0 && token != "" {
+		sessions := 0
+		for id, other := range r.controls {
+			if id != clientId && other.auth.User == token {
+				sessions++
+			}
+		}
+
+		if sessions >= maxSessions {
+			r.Info("Refusing client %s, its token already has %d sessions", clientId, sessions)
+			err = fmt.Errorf("Too many sessions for this token, at most %d may be connected at once", maxSessions)
+			return
+		}
+	}
+
 	oldCtl = r.controls[clientId]
 	if oldCtl != nil {
 		oldCtl.Replaced(ctl)
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"ngrok/conn"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ReleaseNotFound = `HTTP/1.0 404 Not Found
+Content-Length: 18
+
+Release not found
+`
+
+	NoUpdate = `HTTP/1.0 204 No Content
+Content-Length: 0
+
+`
+
+	ReleaseResponse = `HTTP/1.0 200 OK
+Content-Type: %s
+Content-Length: %d
+Cache-Control: no-cache
+
+`
+)
+
+// client binaries are named like ngrok-1.8-linux-amd64 or ngrok-1.8-windows-386.exe
+var releasePattern = regexp.MustCompile(`^ngrok-([0-9]+(?:\.[0-9]+)*)-([a-z0-9]+)-([a-z0-9]+)(\.exe)?$`)
+
+// What a client checking for updates is told about the latest release for
+// its platform. Signature is the base64 signature of the version and the
+// binary from the .sig file next to it, if there is one.
+type releaseInfo struct {
+	Version   string `json:"version"`
+	Url       string `json:"url"`
+	Sha256    string `json:"sha256"`
+	Signature string `json:"signature,omitempty"`
+}
+
+type release struct {
+	version []int
+	name    string
+}
+
+// Serves client binaries from the release directory so that clients can
+// update themselves from this server:
+//
+//	/check?os=linux&arch=amd64&version=1.7 describes the latest release if it's newer
+//	/download/ngrok-1.8-linux-amd64 downloads a binary
+func releaseHandler(c conn.Conn, proto string, req *http.Request) {
+	switch {
+	case req.URL.Path == "/check":
+		releaseCheck(c, proto, req)
+
+	case strings.HasPrefix(req.URL.Path, "/download/"):
+		releaseDownload(c, strings.TrimPrefix(req.URL.Path, "/download/"))
+
+	default:
+		c.Write([]byte(ReleaseNotFound))
+	}
+}
+
+func releaseCheck(c conn.Conn, proto string, req *http.Request) {
+	query := req.URL.Query()
+	latest, err := latestRelease(query.Get("os"), query.Get("arch"))
+	if err != nil {
+		c.Warn("Failed to list releases in %s: %v", opts.releaseDir, err)
+	}
+	if latest == nil {
+		c.Write([]byte(ReleaseNotFound))
+		return
+	}
+
+	if compareVersions(latest.version, parseVersion(query.Get("version"))) <= 0 {
+		c.Write([]byte(NoUpdate))
+		return
+	}
+
+	path := filepath.Join(opts.releaseDir, latest.name)
+	sum, err := fileSha256(path)
+	if err != nil {
+		c.Warn("Failed to read release %s: %v", latest.name, err)
+		c.Write([]byte(ReleaseNotFound))
+		return
+	}
+
+	info := &releaseInfo{
+		Version: formatVersion(latest.version),
+		Url:     fmt.Sprintf("%s://%s/download/%s", proto, req.Host, latest.name),
+		Sha256:  sum,
+	}
+	if sig, err := ioutil.ReadFile(path + ".sig"); err == nil {
+		info.Signature = strings.TrimSpace(string(sig))
+	}
+
+	body, err := json.Marshal(info)
+	if err != nil {
+		panic(err)
+	}
+
+	c.Info("Offering release %s to %s", latest.name, c.RemoteAddr())
+	c.Write([]byte(fmt.Sprintf(ReleaseResponse, "application/json", len(body)) + string(body)))
+}
+
+func releaseDownload(c conn.Conn, name string) {
+	if !releasePattern.MatchString(name) {
+		c.Write([]byte(ReleaseNotFound))
+		return
+	}
+
+	f, err := os.Open(filepath.Join(opts.releaseDir, name))
+	if err != nil {
+		c.Write([]byte(ReleaseNotFound))
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		c.Write([]byte(ReleaseNotFound))
+		return
+	}
+
+	c.Info("Sending release %s to %s", name, c.RemoteAddr())
+	if _, err = c.Write([]byte(fmt.Sprintf(ReleaseResponse, "application/octet-stream", stat.Size()))); err != nil {
+		return
+	}
+	if _, err = io.Copy(c, f); err != nil {
+		c.Warn("Failed to send release %s: %v", name, err)
+	}
+}
+
+// Finds the newest release for the platform in the release directory
+func latestRelease(goos, goarch string) (latest *release, err error) {
+	files, err := ioutil.ReadDir(opts.releaseDir)
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		m := releasePattern.FindStringSubmatch(f.Name())
+		if m == nil || f.IsDir() || m[2] != goos || m[3] != goarch {
+			continue
+		}
+
+		v := parseVersion(m[1])
+		if latest == nil || compareVersions(v, latest.version) > 0 {
+			latest = &release{v, f.Name()}
+		}
+	}
+	return
+}
+
+// The checksum of a release, remembered until the file changes so that
+// checks for updates don't read the whole binary each time
+type releaseSum struct {
+	modTime time.Time
+	size    int64
+	sum     string
+}
+
+var (
+	releaseSums     = make(map[string]releaseSum)
+	releaseSumsLock sync.Mutex
+)
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	releaseSumsLock.Lock()
+	cached, ok := releaseSums[path]
+	releaseSumsLock.Unlock()
+	if ok && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		return cached.sum, nil
+	}
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	releaseSumsLock.Lock()
+	releaseSums[path] = releaseSum{stat.ModTime(), stat.Size(), sum}
+	releaseSumsLock.Unlock()
+	return sum, nil
+}
+
+// Parses versions like 1.7 or 1.7.2, anything unparseable is version 0
+func parseVersion(s string) []int {
+	var v []int
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil
+		}
+		v = append(v, n)
+	}
+	return v
+}
+
+func formatVersion(v []int) string {
+	parts := make([]string, len(v))
+	for i, n := range v {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"ngrok/msg"
+	"os"
+	"path"
+	"strings"
+)
+
+// subdomains or patterns like admin* that clients may never claim
+var reservedSubdomains []string
+
+// Reads the reserved subdomains from a comma-separated list and a file with
+// one per line. Blank lines and lines starting with # are ignored.
+func loadReservedSubdomains(list, file string) (reserved []string, err error) {
+	add := func(name string) error {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || strings.HasPrefix(name, "#") {
+			return nil
+		}
+
+		if _, err := path.Match(name, ""); err != nil {
+			return fmt.Errorf("Invalid reserved subdomain %s: %v", name, err)
+		}
+
+		reserved = append(reserved, name)
+		return nil
+	}
+
+	for _, name := range strings.Split(list, ",") {
+		if err = add(name); err != nil {
+			return
+		}
+	}
+
+	if file == "" {
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err = add(scanner.Text()); err != nil {
+			return
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// Rejects tunnel requests for reserved subdomains, whether they ask for the
+// subdomain or for the equivalent hostname
+func checkReserved(req *msg.ReqTunnel) error {
+	subdomain := strings.ToLower(strings.TrimSpace(req.Subdomain))
+	if subdomain == "" {
+		hostname := canonicalHost(req.Protocol, req.Hostname)
+		suffix := "." + strings.ToLower(opts.domain)
+		if strings.HasSuffix(hostname, suffix) {
+			subdomain = strings.TrimSuffix(hostname, suffix)
+		}
+	}
+
+	if subdomain != "" && matchHostname(reservedSubdomains, subdomain) {
+		return fmt.Errorf("The subdomain %s is reserved", subdomain)
+	}
+	return nil
+}
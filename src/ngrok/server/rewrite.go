@@ -0,0 +1,107 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"ngrok/msg"
+	"regexp"
+	"strings"
+)
+
+// A compiled rewrite rule of a tunnel
+type rewrite struct {
+	msg.RewriteRule
+	re *regexp.Regexp
+}
+
+func compileRewrites(rules []msg.RewriteRule) ([]rewrite, error) {
+	rewrites := make([]rewrite, len(rules))
+	for i, rule := range rules {
+		rewrites[i].RewriteRule = rule
+
+		kinds := 0
+		if rule.StripPrefix != "" {
+			kinds++
+		}
+		if rule.AddPrefix != "" {
+			kinds++
+		}
+		if rule.Match != "" {
+			kinds++
+		}
+		if kinds != 1 {
+			return nil, fmt.Errorf("Rewrite rule %d must have exactly one of StripPrefix, AddPrefix or Match", i+1)
+		}
+
+		if rule.Match != "" {
+			var err error
+			if rewrites[i].re, err = regexp.Compile(rule.Match); err != nil {
+				return nil, fmt.Errorf("Invalid pattern in rewrite rule %d: %v", i+1, err)
+			}
+		}
+	}
+	return rewrites, nil
+}
+
+// Applies the rewrite rules in order to the path of the request
+func rewritePath(rewrites []rewrite, req *http.Request) {
+	if len(rewrites) == 0 {
+		return
+	}
+
+	path := req.URL.Path
+	for _, r := range rewrites {
+		switch {
+		case r.StripPrefix != "":
+			if strings.HasPrefix(path, r.StripPrefix) {
+				path = path[len(r.StripPrefix):]
+			}
+		case r.AddPrefix != "":
+			path = strings.TrimSuffix(r.AddPrefix, "/") + path
+		default:
+			path = r.re.ReplaceAllString(path, r.Replace)
+		}
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	if path != req.URL.Path {
+		req.URL.Path = path
+		req.URL.RawPath = ""
+	}
+}
+
+// Points absolute redirects to the local backend, like http://localhost:3000/login,
+// at the public URL of the tunnel instead
+func rewriteLocation(publicUrl string, resp *http.Response) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return
+	}
+
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || !isLoopbackHost(u.Hostname()) {
+		return
+	}
+
+	public, err := url.Parse(publicUrl)
+	if err != nil {
+		return
+	}
+
+	u.Scheme, u.Host = public.Scheme, public.Host
+	resp.Header.Set("Location", u.String())
+}
+
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	rttPingInterval = 10 * time.Second
+	rttWindowSize   = 30
+)
+
+// The round trip times of the last pings the server sent over a control
+// connection, so operators can spot clients on slow or lossy links
+type rttWindow struct {
+	sync.Mutex
+	samples [rttWindowSize]time.Duration
+	next    int
+	count   int
+}
+
+// Round trip times in milliseconds. Count is 0 until the client has
+// answered a ping; older clients never do.
+type rttStats struct {
+	Count int     `json:"count"`
+	Last  float64 `json:"last"`
+	Mean  float64 `json:"mean"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+func (w *rttWindow) add(rtt time.Duration) {
+	w.Lock()
+	defer w.Unlock()
+	w.samples[w.next] = rtt
+	w.next = (w.next + 1) % rttWindowSize
+	if w.count < rttWindowSize {
+		w.count++
+	}
+}
+
+func (w *rttWindow) stats() (s rttStats) {
+	w.Lock()
+	defer w.Unlock()
+	if w.count == 0 {
+		return
+	}
+
+	var sum, min, max time.Duration
+	for i := 0; i < w.count; i++ {
+		rtt := w.samples[i]
+		sum += rtt
+		if i == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+	}
+
+	last := w.samples[(w.next+rttWindowSize-1)%rttWindowSize]
+	return rttStats{
+		Count: w.count,
+		Last:  millis(last),
+		Mean:  millis(sum / time.Duration(w.count)),
+		Min:   millis(min),
+		Max:   millis(max),
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,468 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"ngrok/conn"
+	"ngrok/log"
+	"ngrok/msg"
+	"ngrok/util"
+	"ngrok/version"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sshPingInterval = 20 * time.Second
+)
+
+// The SSH gateway lets users open tunnels with a plain
+//
+//	ssh -R 80:localhost:3000 tunnel.example.com
+//
+// instead of installing the ngrok client. Each SSH connection is bridged to an
+// in-process control connection over a net.Pipe() speaking the regular ngrok
+// protocol, so its tunnels go through the same authentication, rights checks,
+// registration and proxying as those of any other client.
+//
+// The remote forward's bind address chooses the tunnel name: a name with dots
+// is a hostname, any other name is a subdomain and "localhost" (the default)
+// asks for a random one. Port 80 opens http and https tunnels, port 443 just
+// https and any other port a tcp tunnel on that remote port (0 for random).
+type sshGateway struct {
+	log.Logger
+	config *ssh.ServerConfig
+}
+
+// A remote forward requested by the SSH client
+type sshForward struct {
+	bindAddr string
+	bindPort uint32
+}
+
+// Bridges one SSH connection to a control connection
+type sshSession struct {
+	log.Logger
+	sshConn *ssh.ServerConn
+
+	// our end of the control connection pipe
+	ctlConn conn.Conn
+	ctlLock sync.Mutex
+	id      string
+
+	// NewTunnel messages for outstanding ReqTunnels, by ReqId
+	pending map[string]chan *msg.NewTunnel
+
+	// forwards by tunnel url, to open the right channel for each StartProxy
+	forwards map[string]sshForward
+
+	// session channels that we print tunnel urls to
+	sessions []ssh.Channel
+	sync.Mutex
+}
+
+// net.Pipe() has no useful addresses, report the SSH client's instead
+// so that the registry's per-ip affinity keeps working
+type sshPipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *sshPipeConn) RemoteAddr() net.Addr { return c.remote }
+
+// ssh.Channel doesn't implement net.Conn, fill in the rest
+type sshChannelConn struct {
+	ssh.Channel
+	local, remote net.Addr
+}
+
+func (c *sshChannelConn) LocalAddr() net.Addr                { return c.local }
+func (c *sshChannelConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *sshChannelConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sshChannelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sshChannelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newSSHGateway(keyPath string, extAuth *ExtAuth) (*sshGateway, error) {
+	g := &sshGateway{Logger: log.NewPrefixLogger("ssh")}
+
+	g.config = &ssh.ServerConfig{
+		// the password is the auth token, it is checked by NewControl
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return &ssh.Permissions{Extensions: map[string]string{"token": string(password)}}, nil
+		},
+
+		// without external authentication, there's no token to ask for
+		NoClientAuth: extAuth.authUrl == "",
+	}
+
+	var signer ssh.Signer
+	if keyPath == "" {
+		g.Warn("No SSH host key specified, generating a temporary one")
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if signer, err = ssh.NewSignerFromKey(key); err != nil {
+			return nil, err
+		}
+	} else {
+		pem, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if signer, err = ssh.ParsePrivateKey(pem); err != nil {
+			return nil, fmt.Errorf("Failed to parse SSH host key %s: %v", keyPath, err)
+		}
+	}
+
+	g.config.AddHostKey(signer)
+	return g, nil
+}
+
+// Listens for SSH connections from users without the ngrok client
+func startSSHListener(addr, keyPath string) (listener *conn.Listener) {
+	gw, err := newSSHGateway(keyPath, extAuth)
+	if err != nil {
+		panic(err)
+	}
+
+	if listener, err = conn.Listen(addr, "ssh", nil); err != nil {
+		panic(err)
+	}
+
+	gw.Info("Listening for SSH connections on %s", listener.Addr.String())
+	go func() {
+		for c := range listener.Conns {
+			go gw.handle(c)
+		}
+	}()
+
+	return
+}
+
+func (g *sshGateway) handle(c conn.Conn) {
+	defer c.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			c.Warn("SSH gateway failed with error %v: %s", r, debug.Stack())
+		}
+	}()
+
+	c.SetDeadline(time.Now().Add(connReadTimeout))
+	sshConn, chans, reqs, err := ssh.NewServerConn(c, g.config)
+	if err != nil {
+		c.Warn("SSH handshake failed: %v", err)
+		return
+	}
+	defer sshConn.Close()
+	c.SetDeadline(time.Time{})
+
+	var token string
+	if sshConn.Permissions != nil {
+		token = sshConn.Permissions.Extensions["token"]
+	}
+
+	s := &sshSession{
+		Logger:   c,
+		sshConn:  sshConn,
+		pending:  make(map[string]chan *msg.NewTunnel),
+		forwards: make(map[string]sshForward),
+	}
+
+	// open the control connection through an in-process pipe
+	srvSide, gwSide := net.Pipe()
+	s.ctlConn = conn.Wrap(&sshPipeConn{gwSide, sshConn.RemoteAddr()}, "ssh")
+	defer s.ctlConn.Close()
+
+	go NewControl(conn.Wrap(&sshPipeConn{srvSide, sshConn.RemoteAddr()}, "ctl"), &msg.Auth{
+		Version:   version.Proto,
+		MmVersion: version.MajorMinor(),
+		User:      token,
+		OS:        "ssh",
+		Arch:      string(sshConn.ClientVersion()),
+	}, extAuth)
+
+	var authResp msg.AuthResp
+	if err = msg.ReadMsgInto(s.ctlConn, &authResp); err != nil {
+		c.Warn("Failed to read AuthResp: %v", err)
+		return
+	}
+
+	if authResp.Error != "" {
+		c.Info("Authentication failed: %s", authResp.Error)
+		return
+	}
+
+	s.id = authResp.ClientId
+	c.Info("Authenticated SSH user %s as client %s", sshConn.User(), s.id)
+
+	go s.channels(chans)
+	go s.requests(reqs)
+	go s.heartbeat()
+	s.reader()
+}
+
+// Handles the messages the server sends over the control connection
+func (s *sshSession) reader() {
+	defer s.sshConn.Close()
+
+	for {
+		rawMsg, err := msg.ReadMsg(s.ctlConn)
+		if err != nil {
+			s.Info("Control connection closed: %v", err)
+			return
+		}
+
+		switch m := rawMsg.(type) {
+		case *msg.ReqProxy:
+			go s.proxy()
+
+		case *msg.NewTunnel:
+			s.Lock()
+			ch := s.pending[m.ReqId]
+			s.Unlock()
+
+			if ch != nil {
+				ch <- m
+			}
+
+		case *msg.Ping:
+			s.writeMsg(&msg.Pong{})
+
+		case *msg.Pong:
+		}
+	}
+}
+
+func (s *sshSession) writeMsg(m interface{}) error {
+	s.ctlLock.Lock()
+	defer s.ctlLock.Unlock()
+	return msg.WriteMsg(s.ctlConn, m)
+}
+
+func (s *sshSession) heartbeat() {
+	ping := time.NewTicker(sshPingInterval)
+	defer ping.Stop()
+
+	for range ping.C {
+		if err := s.writeMsg(&msg.Ping{}); err != nil {
+			return
+		}
+	}
+}
+
+// Accepts session channels so that we can tell the user their tunnel urls.
+// We don't run any commands, everything written to them is discarded.
+func (s *sshSession) channels(chans <-chan ssh.NewChannel) {
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range reqs {
+				// let pty and shell requests succeed so interactive clients stay connected
+				req.Reply(req.Type == "pty-req" || req.Type == "shell", nil)
+			}
+		}()
+
+		// hang up when the user closes the session or presses Ctrl+C
+		go func() {
+			buf := make([]byte, 256)
+			for {
+				n, err := ch.Read(buf)
+				if err != nil || strings.IndexByte(string(buf[:n]), 3) != -1 {
+					s.sshConn.Close()
+					return
+				}
+			}
+		}()
+
+		s.Lock()
+		s.sessions = append(s.sessions, ch)
+		for url, fwd := range s.forwards {
+			fmt.Fprintf(ch, "Forwarding %s -> %s:%d\r\n", url, fwd.bindAddr, fwd.bindPort)
+		}
+		s.Unlock()
+	}
+}
+
+func (s *sshSession) requests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			var fwd struct {
+				BindAddr string
+				BindPort uint32
+			}
+
+			if err := ssh.Unmarshal(req.Payload, &fwd); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			port, err := s.forward(sshForward{fwd.BindAddr, fwd.BindPort})
+			if err != nil {
+				s.Warn("Failed to open tunnel for %s:%d: %v", fwd.BindAddr, fwd.BindPort, err)
+				s.printf("Failed to open tunnel: %v\r\n", err)
+				req.Reply(false, nil)
+				continue
+			}
+
+			if fwd.BindPort == 0 {
+				req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+			} else {
+				req.Reply(true, nil)
+			}
+
+		default:
+			// tunnels can't be closed individually, that includes cancel-tcpip-forward
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// Requests a tunnel for a remote forward and waits for the server to open it.
+// Returns the public port of tcp tunnels.
+func (s *sshSession) forward(fwd sshForward) (port uint32, err error) {
+	reqTunnel := &msg.ReqTunnel{ReqId: util.RandId(8)}
+
+	switch fwd.bindPort {
+	case 80:
+		reqTunnel.Protocol = "http+https"
+	case 443:
+		reqTunnel.Protocol = "https"
+	default:
+		reqTunnel.Protocol = "tcp"
+		reqTunnel.RemotePort = uint16(fwd.bindPort)
+	}
+
+	if reqTunnel.Protocol != "tcp" {
+		switch name := strings.ToLower(fwd.bindAddr); {
+		case name == "" || name == "localhost" || name == "*" || net.ParseIP(name) != nil:
+			// random subdomain
+		case strings.Contains(name, "."):
+			reqTunnel.Hostname = name
+		default:
+			reqTunnel.Subdomain = name
+		}
+	}
+
+	protocols := strings.Split(reqTunnel.Protocol, "+")
+	ch := make(chan *msg.NewTunnel, len(protocols))
+	s.Lock()
+	s.pending[reqTunnel.ReqId] = ch
+	s.Unlock()
+
+	defer func() {
+		s.Lock()
+		delete(s.pending, reqTunnel.ReqId)
+		s.Unlock()
+	}()
+
+	if err = s.writeMsg(reqTunnel); err != nil {
+		return
+	}
+
+	for range protocols {
+		select {
+		case m := <-ch:
+			if m.Error != "" {
+				return 0, fmt.Errorf("%s", m.Error)
+			}
+
+			s.Lock()
+			s.forwards[m.Url] = fwd
+			s.Unlock()
+
+			s.Info("Tunnel established at %s", m.Url)
+			s.printf("Forwarding %s -> %s:%d\r\n", m.Url, fwd.bindAddr, fwd.bindPort)
+
+			if m.Protocol == "tcp" {
+				var p int
+				parts := strings.Split(m.Url, ":")
+				if p, err = strconv.Atoi(parts[len(parts)-1]); err != nil {
+					return
+				}
+				port = uint32(p)
+			}
+
+		case <-time.After(pingTimeoutInterval):
+			return 0, fmt.Errorf("Timed out waiting for the tunnel")
+		}
+	}
+
+	return
+}
+
+// writes a message to all of the user's session channels
+func (s *sshSession) printf(format string, args ...interface{}) {
+	s.Lock()
+	defer s.Unlock()
+	for _, ch := range s.sessions {
+		fmt.Fprintf(ch, format, args...)
+	}
+}
+
+// Registers a proxy connection through an in-process pipe like a client
+// would and joins it with a forwarded-tcpip channel once the server uses it
+func (s *sshSession) proxy() {
+	srvSide, gwSide := net.Pipe()
+	pxyConn := conn.Wrap(&sshPipeConn{gwSide, s.sshConn.RemoteAddr()}, "ssh")
+	defer pxyConn.Close()
+
+	go NewProxy(conn.Wrap(&sshPipeConn{srvSide, s.sshConn.RemoteAddr()}, "pxy"), &msg.RegProxy{ClientId: s.id})
+
+	var startPxy msg.StartProxy
+	if err := msg.ReadMsgInto(pxyConn, &startPxy); err != nil {
+		pxyConn.Debug("Proxy closed before use: %v", err)
+		return
+	}
+
+	s.Lock()
+	fwd, ok := s.forwards[startPxy.Url]
+	s.Unlock()
+	if !ok {
+		pxyConn.Error("Couldn't find forward for proxy: %s", startPxy.Url)
+		return
+	}
+
+	originAddr, originPort := startPxy.ClientAddr, 0
+	if host, port, err := net.SplitHostPort(startPxy.ClientAddr); err == nil {
+		originAddr = host
+		originPort, _ = strconv.Atoi(port)
+	}
+
+	ch, reqs, err := s.sshConn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+		Addr       string
+		Port       uint32
+		OriginAddr string
+		OriginPort uint32
+	}{fwd.bindAddr, fwd.bindPort, originAddr, uint32(originPort)}))
+	if err != nil {
+		pxyConn.Warn("Failed to open forwarded-tcpip channel: %v", err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	chConn := conn.Wrap(&sshChannelConn{ch, s.sshConn.LocalAddr(), s.sshConn.RemoteAddr()}, "prv")
+	defer chConn.Close()
+	conn.Join(chConn, pxyConn)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"ngrok/conn"
+	"ngrok/server/assets"
+	"strings"
+	"time"
+)
+
+const (
+	StatusResponse = `HTTP/1.0 200 OK
+Content-Type: %s
+Content-Length: %d
+Cache-Control: no-cache
+
+%s`
+)
+
+// Aggregate health of the server for the status page. Nothing about
+// individual tunnels or clients is included.
+type serverStatus struct {
+	Domain    string           `json:"domain"`
+	Uptime    string           `json:"uptime"`
+	Clients   int              `json:"clients"`
+	Tunnels   map[string]int   `json:"tunnels"`
+	Listeners []listenerStatus `json:"listeners"`
+}
+
+type listenerStatus struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+func currentStatus() *serverStatus {
+	status := &serverStatus{
+		Domain:  opts.domain,
+		Uptime:  time.Since(startTime).Truncate(time.Second).String(),
+		Clients: controlRegistry.Count(),
+		Tunnels: tunnelRegistry.CountByProtocol(),
+	}
+
+	// only the listeners the public uses, the peer and ssh ones are private
+	status.Listeners = append(status.Listeners, listenerStatus{"tunnel", opts.tunnelAddr})
+	for _, name := range []string{"http", "https"} {
+		if l, ok := listeners[name]; ok {
+			status.Listeners = append(status.Listeners, listenerStatus{name, l.Addr.String()})
+		}
+	}
+
+	return status
+}
+
+// Renders the status page as HTML, or JSON if asked for with the format query
+// parameter or the Accept header
+func statusHandler(c conn.Conn, req *http.Request) {
+	status := currentStatus()
+
+	format := req.URL.Query().Get("format")
+	if format == "" && strings.Contains(req.Header.Get("Accept"), "application/json") {
+		format = "json"
+	}
+
+	var contentType string
+	var body []byte
+	switch format {
+	case "json":
+		buf, err := json.Marshal(status)
+		if err != nil {
+			panic(err)
+		}
+		contentType, body = "application/json", buf
+
+	default:
+		page, err := assets.Asset("assets/server/status.html")
+		if err != nil {
+			panic(err)
+		}
+
+		tmpl, err := template.New("status").Parse(string(page))
+		if err != nil {
+			panic(err)
+		}
+
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, status); err != nil {
+			panic(err)
+		}
+		contentType, body = "text/html; charset=utf-8", buf.Bytes()
+	}
+
+	c.Write([]byte(fmt.Sprintf(StatusResponse, contentType, len(body), body)))
+}
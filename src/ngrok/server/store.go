@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+	"ngrok/cache"
+	"ngrok/log"
+	"os"
+	"sort"
+	"time"
+)
+
+var affinityBucket = []byte("affinity")
+
+const (
+	// BoltDB files start with a meta page whose magic number follows the
+	// 16 byte page header
+	boltMagic       = 0xED0CDAED
+	boltMagicOffset = 16
+)
+
+// Persists the registry's affinity cache in a BoltDB file. Every assignment
+// is written as it's made, so URLs survive a crash instead of only being saved
+// in periodic snapshots.
+type affinityStore struct {
+	db *bolt.DB
+	log.Logger
+}
+
+// Opens the store at path and loads its assignments into the cache. Affinity
+// cache files saved by older versions with gob are imported once and kept
+// next to the new file with a .gob suffix.
+func openAffinityStore(path string, lru *cache.LRUCache, ttl time.Duration) (s *affinityStore, err error) {
+	s = &affinityStore{Logger: log.NewPrefixLogger("registry", "store")}
+
+	legacy, err := isGobCache(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy {
+		// the assignments are only a convenience, so a damaged file
+		// doesn't keep the server from starting
+		s.Info("Importing gob affinity cache %s", path)
+		if err = lru.LoadItemsFromFile(path); err != nil {
+			s.Warn("Failed to import affinity cache %s, starting without it: %v", path, err)
+		}
+
+		if err = os.Rename(path, path+".gob"); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second}); err != nil {
+		return nil, err
+	}
+
+	if legacy {
+		for _, item := range lru.Items() {
+			if err = s.Put(string(item.Value.(cacheUrl)), item.Key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err = s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(affinityBucket)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return s, s.load(lru, ttl)
+}
+
+// Whether the file at path was saved with gob by an older version rather than
+// being a BoltDB file. Missing and empty files become new stores.
+func isGobCache(path string) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, boltMagicOffset+4)
+	switch _, err = io.ReadFull(f, hdr); err {
+	case nil:
+	case io.EOF:
+		return false, nil
+	case io.ErrUnexpectedEOF:
+		return true, nil
+	default:
+		return false, err
+	}
+
+	// the meta page is written in the byte order of the machine
+	magic := hdr[boltMagicOffset:]
+	return binary.LittleEndian.Uint32(magic) != boltMagic && binary.BigEndian.Uint32(magic) != boltMagic, nil
+}
+
+// Each value is the time it was written followed by the url
+func encodeAffinity(url string, t time.Time) []byte {
+	buf := make([]byte, 8+len(url))
+	binary.BigEndian.PutUint64(buf, uint64(t.UnixNano()))
+	copy(buf[8:], url)
+	return buf
+}
+
+func decodeAffinity(buf []byte) (url string, t time.Time, err error) {
+	if len(buf) < 8 {
+		err = fmt.Errorf("Affinity record is too short: %d bytes", len(buf))
+		return
+	}
+	t = time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+	url = string(buf[8:])
+	return
+}
+
+// Loads the assignments that haven't expired into the cache
+func (s *affinityStore) load(lru *cache.LRUCache, ttl time.Duration) error {
+	type record struct {
+		key, url string
+		written  time.Time
+	}
+
+	var records []record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(affinityBucket).ForEach(func(k, v []byte) error {
+			url, written, err := decodeAffinity(v)
+			if err != nil {
+				s.Warn("Skipping affinity record %s: %v", k, err)
+				return nil
+			}
+
+			if ttl > 0 && time.Since(written) > ttl {
+				return nil
+			}
+			records = append(records, record{string(k), url, written})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// oldest first, so the most recent assignments are the last to be evicted
+	sort.Slice(records, func(i, j int) bool { return records[i].written.Before(records[j].written) })
+	for _, r := range records {
+		lru.Set(r.key, cacheUrl(r.url))
+	}
+
+	s.Info("Loaded %d affinity records", len(records))
+	return nil
+}
+
+// Saves the url assigned for each of the keys
+func (s *affinityStore) Put(url string, keys ...string) error {
+	value := encodeAffinity(url, time.Now())
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(affinityBucket)
+		if b == nil {
+			var err error
+			if b, err = tx.CreateBucketIfNotExists(affinityBucket); err != nil {
+				return err
+			}
+		}
+
+		for _, k := range keys {
+			if err := b.Put([]byte(k), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Deletes the records of assignments that the cache has evicted
+func (s *affinityStore) Prune(lru *cache.LRUCache) (pruned int, err error) {
+	live := make(map[string]bool)
+	for _, k := range lru.Keys() {
+		live[k] = true
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(affinityBucket)
+
+		// bolt cursors skip keys when deleting while iterating
+		var stale [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if !live[string(k)] {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(stale)
+		return nil
+	})
+	return
+}
+
+func (s *affinityStore) Close() error {
+	return s.db.Close()
+}
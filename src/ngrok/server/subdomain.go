@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+const (
+	defaultSubdomainCharset = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+var (
+	subdomainAdjectives = []string{
+		"able", "amber", "ancient", "bold", "brave", "bright", "brisk", "calm",
+		"clever", "cool", "crisp", "curious", "daring", "eager", "early", "fancy",
+		"fast", "fierce", "gentle", "glad", "golden", "grand", "happy", "hidden",
+		"honest", "humble", "jolly", "keen", "kind", "lively", "lucky", "merry",
+		"mighty", "misty", "modest", "noble", "odd", "patient", "plain", "polite",
+		"proud", "quick", "quiet", "rapid", "rare", "silent", "silver", "simple",
+		"sleek", "smooth", "snowy", "solid", "spicy", "steady", "sunny", "swift",
+		"tender", "tidy", "tiny", "vivid", "warm", "wild", "wise", "young",
+	}
+
+	subdomainNouns = []string{
+		"badger", "bear", "beaver", "bison", "crane", "crow", "deer", "dolphin",
+		"eagle", "falcon", "ferret", "finch", "fox", "gecko", "goose", "hare",
+		"hawk", "heron", "ibis", "jaguar", "koala", "lark", "lemur", "lion",
+		"llama", "lynx", "marmot", "mole", "moose", "moth", "newt", "otter",
+		"owl", "panda", "parrot", "pelican", "penguin", "puffin", "quail", "rabbit",
+		"raven", "robin", "salmon", "seal", "shark", "sloth", "snail", "sparrow",
+		"squid", "stork", "swan", "tapir", "tiger", "toad", "trout", "turtle",
+		"viper", "walrus", "weasel", "whale", "wolf", "wombat", "yak", "zebra",
+	}
+)
+
+// Returns a function generating random subdomains with the given scheme:
+//
+//	hex    a random 31-bit number in hex, like 5b3a1f2c
+//	random length characters from charset
+//	words  an adjective, a noun and a number, like quiet-otter-42
+func newSubdomainGenerator(scheme string, length int, charset string) (func() string, error) {
+	switch scheme {
+	case "hex":
+		return func() string {
+			return fmt.Sprintf("%x", rand.Int31())
+		}, nil
+
+	case "random":
+		if length <= 0 {
+			return nil, fmt.Errorf("Subdomain length must be positive, got %d", length)
+		}
+
+		if charset == "" {
+			charset = defaultSubdomainCharset
+		}
+
+		for _, c := range charset {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return nil, fmt.Errorf("Subdomain charset may only contain lowercase letters, digits and '-', got %q", c)
+			}
+		}
+
+		return func() string {
+			b := make([]byte, length)
+			for i := range b {
+				b[i] = charset[rand.Intn(len(charset))]
+			}
+
+			// hostname labels can't start or end with '-'
+			if b[0] == '-' {
+				b[0] = 'x'
+			}
+			if b[length-1] == '-' {
+				b[length-1] = 'x'
+			}
+			return string(b)
+		}, nil
+
+	case "words":
+		return func() string {
+			return fmt.Sprintf("%s-%s-%d",
+				subdomainAdjectives[rand.Intn(len(subdomainAdjectives))],
+				subdomainNouns[rand.Intn(len(subdomainNouns))],
+				rand.Intn(100))
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown subdomain scheme %s, must be one of: hex, random, words", scheme)
+	}
+}
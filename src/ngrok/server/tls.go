@@ -2,11 +2,82 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"io/ioutil"
 	"ngrok/server/assets"
+	"strings"
+	"sync"
 )
 
-func LoadTLSConfig(crtPath string, keyPath string) (tlsConfig *tls.Config, err error) {
+// A certificate that can be swapped out while the server runs, e.g. to staple
+// a new OCSP response to it
+type liveCert struct {
+	sync.RWMutex
+	cert *tls.Certificate
+	leaf *x509.Certificate
+}
+
+func (c *liveCert) get() *tls.Certificate {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert
+}
+
+func (c *liveCert) set(cert *tls.Certificate) {
+	c.Lock()
+	defer c.Unlock()
+	c.cert = cert
+}
+
+// Picks the certificate for the name a visitor asks for with SNI. Names are
+// matched exactly first, then against wildcard certificates. Visitors that
+// don't send a name, or ask for one none of the certificates cover, get the
+// first certificate.
+type certSelector struct {
+	certs []*liveCert
+	names map[string]*liveCert
+}
+
+func newCertSelector(certs []*liveCert) *certSelector {
+	s := &certSelector{certs: certs, names: make(map[string]*liveCert)}
+
+	// add them last to first so the first certificate for a name wins
+	for i := len(certs) - 1; i >= 0; i-- {
+		leaf := certs[i].leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+
+		for _, name := range names {
+			s.names[strings.ToLower(name)] = certs[i]
+		}
+	}
+	return s
+}
+
+func (s *certSelector) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if c, ok := s.names[name]; ok {
+		return c.get(), nil
+	}
+
+	if i := strings.Index(name, "."); i > 0 {
+		if c, ok := s.names["*"+name[i:]]; ok {
+			return c.get(), nil
+		}
+	}
+
+	return s.certs[0].get(), nil
+}
+
+// Loads the certificates and keys at the paths, paired in order. Without any
+// paths, the snakeoil certificate is used.
+func LoadTLSConfig(crtPaths []string, keyPaths []string, ocspStapling bool) (tlsConfig *tls.Config, err error) {
+	if len(crtPaths) == 0 {
+		crtPaths, keyPaths = []string{""}, []string{""}
+	}
+
 	fileOrAsset := func(path string, default_path string) ([]byte, error) {
 		loadFn := ioutil.ReadFile
 		if path == "" {
@@ -17,26 +88,41 @@ func LoadTLSConfig(crtPath string, keyPath string) (tlsConfig *tls.Config, err e
 		return loadFn(path)
 	}
 
-	var (
-		crt  []byte
-		key  []byte
-		cert tls.Certificate
-	)
+	certs := make([]*liveCert, len(crtPaths))
+	for i := range crtPaths {
+		var (
+			crt  []byte
+			key  []byte
+			cert tls.Certificate
+			leaf *x509.Certificate
+		)
 
-	if crt, err = fileOrAsset(crtPath, "assets/server/tls/snakeoil.crt"); err != nil {
-		return
-	}
+		if crt, err = fileOrAsset(crtPaths[i], "assets/server/tls/snakeoil.crt"); err != nil {
+			return
+		}
 
-	if key, err = fileOrAsset(keyPath, "assets/server/tls/snakeoil.key"); err != nil {
-		return
-	}
+		if key, err = fileOrAsset(keyPaths[i], "assets/server/tls/snakeoil.key"); err != nil {
+			return
+		}
+
+		if cert, err = tls.X509KeyPair(crt, key); err != nil {
+			return
+		}
+
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
 
-	if cert, err = tls.X509KeyPair(crt, key); err != nil {
-		return
+		certs[i] = &liveCert{cert: &cert, leaf: leaf}
+		if ocspStapling {
+			if err = stapleOCSP(certs[i]); err != nil {
+				return
+			}
+		}
 	}
 
 	tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
+		GetCertificate: newCertSelector(certs).GetCertificate,
 	}
 
 	return
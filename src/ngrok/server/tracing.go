@@ -0,0 +1,285 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"ngrok/log"
+	"ngrok/version"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceBatchSize     = 512
+	traceQueueSize     = 4096
+	traceFlushInterval = 5 * time.Second
+	traceTimeout       = 10 * time.Second
+
+	TraceparentHeader = "traceparent"
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusOk    = 1
+	spanStatusError = 2
+)
+
+var tracer *Tracer
+
+// Exports spans to an OpenTelemetry collector with OTLP over HTTP, using the
+// JSON encoding so we don't need protobuf. Spans are batched and dropped if
+// the collector can't keep up.
+type Tracer struct {
+	log.Logger
+	endpoint   string
+	spans      chan *Span
+	httpClient http.Client
+}
+
+// A timed operation. All methods are no-ops on a nil span, which is what
+// StartSpan returns when tracing is disabled.
+type Span struct {
+	traceId  [16]byte
+	spanId   [8]byte
+	parentId [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      error
+	sync.Mutex
+}
+
+func NewTracer(endpoint string) *Tracer {
+	t := &Tracer{
+		Logger:     log.NewPrefixLogger("tracing"),
+		endpoint:   strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		spans:      make(chan *Span, traceQueueSize),
+		httpClient: http.Client{Timeout: traceTimeout},
+	}
+
+	go t.exporter()
+	return t
+}
+
+// Starts a span, as a child of parent if it isn't nil
+func StartSpan(name string, kind int, parent *Span) *Span {
+	if tracer == nil {
+		return nil
+	}
+
+	s := &Span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	rand.Read(s.spanId[:])
+	if parent != nil {
+		s.traceId = parent.traceId
+		s.parentId = parent.spanId
+	} else {
+		rand.Read(s.traceId[:])
+	}
+	return s
+}
+
+// Starts a span continuing the trace of a W3C traceparent header, or a new
+// trace if the header is missing or invalid
+func StartSpanFromTraceparent(name string, kind int, traceparent string) *Span {
+	s := StartSpan(name, kind, nil)
+	if s == nil {
+		return nil
+	}
+
+	// version-traceid-parentid-flags
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return s
+	}
+
+	traceId, err1 := hex.DecodeString(parts[1])
+	parentId, err2 := hex.DecodeString(parts[2])
+	if err1 == nil && err2 == nil {
+		copy(s.traceId[:], traceId)
+		copy(s.parentId[:], parentId)
+	}
+	return s
+}
+
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.attrs[key] = value
+}
+
+// The traceparent header that makes the receiver's spans children of this one
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%x-%x-01", s.traceId, s.spanId)
+}
+
+// Ends the span and queues it for export. A non-nil error marks it failed.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.Unlock()
+
+	select {
+	case tracer.spans <- s:
+	default:
+		tracer.Warn("Queue is full, dropping span %s", s.name)
+	}
+}
+
+func (t *Tracer) exporter() {
+	batch := make([]*Span, 0, traceBatchSize)
+	flush := time.NewTicker(traceFlushInterval)
+	defer flush.Stop()
+
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) < traceBatchSize {
+				continue
+			}
+		case <-flush.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := t.export(batch); err != nil {
+			t.Warn("Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+// OTLP/JSON request body, see opentelemetry-proto's trace_service.proto
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string     `json:"traceId"`
+	SpanId            string     `json:"spanId"`
+	ParentSpanId      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpAttr {
+	a := otlpAttr{Key: key}
+	switch v := value.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.Lock()
+		o := otlpSpan{
+			TraceId:           hex.EncodeToString(s.traceId[:]),
+			SpanId:            hex.EncodeToString(s.spanId[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentId != [8]byte{} {
+			o.ParentSpanId = hex.EncodeToString(s.parentId[:])
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttribute(k, v))
+		}
+		if s.err != nil {
+			o.Status.Code, o.Status.Message = spanStatusError, s.err.Error()
+		} else {
+			o.Status.Code = spanStatusOk
+		}
+		s.Unlock()
+		spans = append(spans, o)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttr{
+						otlpAttribute("service.name", "ngrokd"),
+						otlpAttribute("service.version", version.MajorMinor()),
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "ngrok/server"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.httpClient.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Got %s response: %s", resp.Status, msg)
+	}
+	return nil
+}
@@ -3,7 +3,6 @@ package server
 import (
 	"encoding/base64"
 	"fmt"
-	"math/rand"
 	"net"
 	"ngrok/conn"
 	"ngrok/log"
@@ -39,9 +38,18 @@ type Tunnel struct {
 	// tcp listener
 	listener *net.TCPListener
 
+	// http response cache, if the client asked for one
+	cache *edgeCache
+
+	// rewrites of request paths
+	rewrites []rewrite
+
 	// control connection
 	ctl *Control
 
+	// the id of the client, which the control forgets when it's replaced
+	clientId string
+
 	// logger
 	log.Logger
 
@@ -49,6 +57,48 @@ type Tunnel struct {
 	closing int32
 }
 
+// Canonicalizes a virtual host so that registration and lookup agree on it:
+// lower-case, without a trailing dot and without the protocol's default port,
+// e.g. MyApp.example.com.:443 becomes myapp.example.com for https
+func canonicalHost(protocol, host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+
+	name, port := host, ""
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+		name, port = host[:i], host[i+1:]
+	}
+	name = strings.TrimSuffix(name, ".")
+
+	if port == "" || port == strconv.Itoa(defaultPortMap[protocol]) {
+		return name
+	}
+	return name + ":" + port
+}
+
+// With namespaces, the hosts two or more labels deep in our domain belong to
+// the namespace of their last label, e.g. app.alice.example.com to alice. A
+// token may only register hosts in its own namespace, and tokens without one
+// none of them, so that nobody can take over another tenant's namespace.
+func checkNamespace(host, domain, ns string) error {
+	if !opts.namespaces || !strings.HasSuffix(host, "."+domain) {
+		return nil
+	}
+
+	labels := strings.Split(strings.TrimSuffix(host, "."+domain), ".")
+	owner := ""
+	if len(labels) > 1 {
+		owner = labels[len(labels)-1]
+	}
+
+	switch {
+	case ns != "" && owner != ns:
+		return fmt.Errorf("Hostname %s is outside of your namespace %s.%s", host, ns, domain)
+	case ns == "" && owner != "":
+		return fmt.Errorf("Hostname %s is in the namespace %s.%s of another token", host, owner, domain)
+	}
+	return nil
+}
+
 // Common functionality for registering virtually hosted protocols
 func registerVhost(t *Tunnel, protocol string, servingPort int) (err error) {
 	vhost := os.Getenv("VHOST")
@@ -57,22 +107,23 @@ func registerVhost(t *Tunnel, protocol string, servingPort int) (err error) {
 	}
 
 	// Canonicalize virtual host by removing default port (e.g. :80 on HTTP)
-	defaultPort, ok := defaultPortMap[protocol]
-	if !ok {
+	if _, ok := defaultPortMap[protocol]; !ok {
 		return fmt.Errorf("Couldn't find default port for protocol %s", protocol)
 	}
+	vhost = canonicalHost(protocol, vhost)
 
-	defaultPortSuffix := fmt.Sprintf(":%d", defaultPort)
-	if strings.HasSuffix(vhost, defaultPortSuffix) {
-		vhost = vhost[0 : len(vhost)-len(defaultPortSuffix)]
+	// Subdomains of namespaced tokens go under their namespace, e.g. app.alice.example.com
+	domain, ns := vhost, t.ctl.rights.Namespace()
+	if ns != "" {
+		vhost = ns + "." + vhost
 	}
 
-	// Canonicalize by always using lower-case
-	vhost = strings.ToLower(vhost)
-
 	// Register for specific hostname
-	hostname := strings.ToLower(strings.TrimSpace(t.req.Hostname))
+	hostname := canonicalHost(protocol, t.req.Hostname)
 	if hostname != "" {
+		if err = checkNamespace(hostname, domain, ns); err != nil {
+			return
+		}
 		t.url = fmt.Sprintf("%s://%s", protocol, hostname)
 		return tunnelRegistry.Register(t.url, t)
 	}
@@ -80,14 +131,20 @@ func registerVhost(t *Tunnel, protocol string, servingPort int) (err error) {
 	// Register for specific subdomain
 	subdomain := strings.ToLower(strings.TrimSpace(t.req.Subdomain))
 	if subdomain != "" {
+		if err = checkNamespace(subdomain+"."+vhost, domain, ns); err != nil {
+			return
+		}
 		t.url = fmt.Sprintf("%s://%s.%s", protocol, subdomain, vhost)
 		return tunnelRegistry.Register(t.url, t)
 	}
 
-	// Register for random URL
+	// Register for random URL. The affinity cache is shared by clients behind
+	// the same IP, so the URL cached for it may be in another namespace.
 	t.url, err = tunnelRegistry.RegisterRepeat(func() string {
-		return fmt.Sprintf("%s://%x.%s", protocol, rand.Int31(), vhost)
-	}, t)
+		return fmt.Sprintf("%s://%s.%s", protocol, randomSubdomain(), vhost)
+	}, t, opts.subdomainAttempts, func(url string) bool {
+		return checkNamespace(strings.TrimPrefix(url, protocol+"://"), domain, ns) == nil
+	})
 
 	return
 }
@@ -96,42 +153,108 @@ func registerVhost(t *Tunnel, protocol string, servingPort int) (err error) {
 // on a control channel
 func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
 	t = &Tunnel{
-		req:    m,
-		start:  time.Now(),
-		ctl:    ctl,
-		Logger: log.NewPrefixLogger(),
+		req:      m,
+		start:    time.Now(),
+		ctl:      ctl,
+		clientId: ctl.id,
+		Logger:   log.NewPrefixLogger(),
 	}
 
 	proto := t.req.Protocol
+	if t.req.Tls && proto != "tcp" {
+		err = fmt.Errorf("TLS termination is only supported for tcp tunnels")
+		return
+	}
+
+	// the dedicated IP a tcp tunnel's port is bound on, -tcpDefaultIp if nil
+	var bindIp net.IP
+	if t.req.RemoteIp != "" {
+		if proto != "tcp" && proto != "socks" {
+			err = fmt.Errorf("Remote IPs are only supported for tcp and socks tunnels")
+			return
+		}
+
+		if bindIp = tcpBindIp(t.req.RemoteIp); bindIp == nil {
+			err = fmt.Errorf("This server doesn't bind tunnels on IP %s", t.req.RemoteIp)
+			return
+		}
+	}
+
+	if t.req.IdleTimeout < 0 {
+		err = fmt.Errorf("Invalid idle timeout %d, it must not be negative", t.req.IdleTimeout)
+		return
+	}
+
+	if (len(t.req.Rewrites) > 0 || t.req.RewriteLocation) && proto != "http" && proto != "https" {
+		err = fmt.Errorf("Rewrite rules are only supported for http(s) tunnels")
+		return
+	}
+
+	if t.rewrites, err = compileRewrites(t.req.Rewrites); err != nil {
+		return
+	}
+
 	switch proto {
-	case "tcp":
+	case "tcp", "socks":
+		// tunnels on a dedicated IP are reached by it rather than the domain
+		scheme, host, listenIp := proto, opts.domain, net.ParseIP("0.0.0.0")
+		if t.req.Tls {
+			scheme = "tls"
+		}
+		if bindIp != nil {
+			host, listenIp = bindIp.String(), bindIp
+		} else if opts.tcpDefaultIp != nil {
+			listenIp = opts.tcpDefaultIp
+		}
+		tcpUrl := func(port int) string {
+			return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+
 		bindTcp := func(port int) error {
-			if t.listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: port}); err != nil {
-				err = t.ctl.conn.Error("Error binding TCP listener: %v", err)
-				return err
+			// take back the listener we held for the port while the client
+			// reconnected, its accept loop keeps running
+			held := false
+			if port != 0 {
+				t.listener = graceUrls.listener(tcpUrl(port), t.clientId)
+				held = t.listener != nil
+			}
+
+			if !held {
+				if t.listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: listenIp, Port: port}); err != nil {
+					err = t.ctl.conn.Error("Error binding TCP listener: %v", err)
+					return err
+				}
 			}
 
 			// create the url
 			addr := t.listener.Addr().(*net.TCPAddr)
-			t.url = fmt.Sprintf("tcp://%s:%d", opts.domain, addr.Port)
+			t.url = tcpUrl(addr.Port)
 
 			// register it
 			if err = tunnelRegistry.RegisterAndCache(t.url, t); err != nil {
 				// This should never be possible because the OS will
 				// only assign available ports to us.
-				t.listener.Close()
+				if held {
+					graceUrls.release(t.url)
+				} else {
+					t.listener.Close()
+				}
 				err = fmt.Errorf("TCP listener bound, but failed to register %s", t.url)
 				return err
 			}
 
-			go t.listenTcp(t.listener)
+			if !held {
+				go t.listenTcp(t.listener)
+			}
 			return nil
 		}
 
 		// use the custom remote port you asked for
 		if t.req.RemotePort != 0 {
-			bindTcp(int(t.req.RemotePort))
-			return
+			if err = bindTcp(int(t.req.RemotePort)); err != nil {
+				return
+			}
+			break
 		}
 
 		// try to return to you the same port you had before
@@ -149,14 +272,15 @@ func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
 					t.ctl.conn.Warn("Failed to get custom port %d: %v, trying a random one", port, err)
 				} else {
 					// success, we're done
-					return
+					break
 				}
 			}
 		}
 
 		// Bind for TCP connections
-		bindTcp(0)
-		return
+		if err = bindTcp(0); err != nil {
+			return
+		}
 
 	case "http", "https":
 		l, ok := listeners[proto]
@@ -169,6 +293,10 @@ func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
 			return
 		}
 
+		if size := atomic.LoadUint64(&edgeCacheSize); m.Cache && size > 0 {
+			t.cache = newEdgeCache(size)
+		}
+
 	default:
 		err = fmt.Errorf("Protocol %s is not supported", proto)
 		return
@@ -181,8 +309,10 @@ func NewTunnel(m *msg.ReqTunnel, ctl *Control) (t *Tunnel, err error) {
 
 	t.AddLogPrefix(t.Id())
 	t.Info("Registered new tunnel on: %s", t.ctl.conn.Id())
+	graceUrls.resume(t)
 
 	metrics.OpenTunnel(t)
+	webhook.TunnelOpened(t)
 	return
 }
 
@@ -192,8 +322,9 @@ func (t *Tunnel) Shutdown() {
 	// mark that we're shutting down
 	atomic.StoreInt32(&t.closing, 1)
 
-	// if we have a public listener (this is a raw TCP tunnel), shut it down
-	if t.listener != nil {
+	// hold the url while the client reconnects, otherwise shut down the
+	// public listener if we have one (this is a raw TCP tunnel)
+	if !graceUrls.hold(t) && t.listener != nil {
 		t.listener.Close()
 	}
 
@@ -206,6 +337,7 @@ func (t *Tunnel) Shutdown() {
 	// t.ctl.stoptunnel <- t
 
 	metrics.CloseTunnel(t)
+	webhook.TunnelClosed(t)
 }
 
 func (t *Tunnel) Id() string {
@@ -235,14 +367,45 @@ func (t *Tunnel) listenTcp(listener *net.TCPListener) {
 		}
 
 		conn := conn.Wrap(tcpConn, "pub")
+		if t.req.Tls {
+			// the handshake happens on the first read, in HandlePublicConnection
+			conn.StartTLSServer(tlsConfig)
+		}
 		conn.AddLogPrefix(t.Id())
 		conn.Info("New connection from %v", conn.RemoteAddr())
 
-		go t.HandlePublicConnection(conn)
+		if maintenance.enabled() {
+			conn.Info("Down for maintenance, closing")
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			atomic.AddInt64(&activeConns, 1)
+			defer atomic.AddInt64(&activeConns, -1)
+
+			// once the client reconnected, its new tunnel owns this listener
+			owner := t
+			if atomic.LoadInt32(&t.closing) == 1 {
+				if owner = graceUrls.wait(t.url, conn); owner == nil {
+					conn.Close()
+					return
+				}
+			}
+			owner.HandlePublicConnection(conn)
+		}()
 	}
 }
 
 func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
+	span := StartSpan("tunnel.connection", spanKindServer, nil)
+	span.SetAttr("ngrok.tunnel", t.url)
+	span.SetAttr("net.peer.addr", publicConn.RemoteAddr().String())
+	t.handlePublicConnection(publicConn, span)
+}
+
+// Proxies a public connection as part of a traced operation
+func (t *Tunnel) handlePublicConnection(publicConn conn.Conn, span *Span) {
 	defer publicConn.Close()
 	defer func() {
 		if r := recover(); r != nil {
@@ -253,15 +416,57 @@ func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
 	startTime := time.Now()
 	metrics.OpenConnection(t, publicConn)
 
-	var proxyConn conn.Conn
-	var err error
+	proxyConn, err := t.tracedProxyConn(publicConn, span)
+	for err != nil {
+		// the client may be reconnecting, then its new tunnel takes over
+		var next *Tunnel
+		if atomic.LoadInt32(&t.closing) == 1 && opts.reconnectGrace > 0 {
+			next = graceUrls.wait(t.url, publicConn)
+		}
+		if next == nil || next.clientId != t.clientId {
+			span.End(err)
+			return
+		}
+
+		t = next
+		proxyConn, err = t.tracedProxyConn(publicConn, span)
+	}
+	defer proxyConn.Close()
+
+	// join the public and proxy connections
+	bytesIn, bytesOut := conn.JoinIdle(publicConn, proxyConn, t.idleTimeout())
+	metrics.CloseConnection(t, publicConn, startTime, bytesIn, bytesOut)
+
+	span.SetAttr("ngrok.bytes_in", bytesIn)
+	span.SetAttr("ngrok.bytes_out", bytesOut)
+	span.End(nil)
+}
+
+// How long proxied connections may stay idle, the client's choice if it made one
+func (t *Tunnel) idleTimeout() time.Duration {
+	if t.req.IdleTimeout > 0 {
+		return time.Duration(t.req.IdleTimeout) * time.Second
+	}
+	return opts.idleTimeout
+}
+
+func (t *Tunnel) tracedProxyConn(publicConn conn.Conn, parent *Span) (proxyConn conn.Conn, err error) {
+	span := StartSpan("proxy.dial", spanKindInternal, parent)
+	proxyConn, err = t.getProxyConn(publicConn)
+	span.End(err)
+	return
+}
+
+// Gets a proxy connection from the client and tells it we're about to
+// proxy a connection from publicConn over it
+func (t *Tunnel) getProxyConn(publicConn conn.Conn) (proxyConn conn.Conn, err error) {
+	start := time.Now()
 	for i := 0; i < (2 * proxyMaxPoolSize); i++ {
 		// get a proxy connection
 		if proxyConn, err = t.ctl.GetProxy(); err != nil {
 			t.Warn("Failed to get proxy connection: %v", err)
 			return
 		}
-		defer proxyConn.Close()
 		t.Info("Got proxy connection %s", proxyConn.Id())
 		proxyConn.AddLogPrefix(t.Id())
 
@@ -269,6 +474,7 @@ func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
 		startPxyMsg := &msg.StartProxy{
 			Url:        t.url,
 			ClientAddr: publicConn.RemoteAddr().String(),
+			Queued:     int64(time.Since(start)),
 		}
 
 		if err = msg.WriteMsg(proxyConn, startPxyMsg); err != nil {
@@ -292,8 +498,5 @@ func (t *Tunnel) HandlePublicConnection(publicConn conn.Conn) {
 
 	// no timeouts while connections are joined
 	proxyConn.SetDeadline(time.Time{})
-
-	// join the public and proxy connections
-	bytesIn, bytesOut := conn.Join(publicConn, proxyConn)
-	metrics.CloseConnection(t, publicConn, startTime, bytesIn, bytesOut)
+	return
 }
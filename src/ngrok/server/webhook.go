@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"ngrok/log"
+	"strconv"
+	"time"
+)
+
+const (
+	webhookQueueSize   = 1000
+	webhookMaxAttempts = 5
+	webhookTimeout     = 10 * time.Second
+	webhookRetryDelay  = time.Second
+)
+
+var webhook *Webhook
+
+// Posts tunnel lifecycle events as JSON to a URL so that other systems can
+// keep track of what is exposed. If a secret is set, each request carries the
+// Unix time it was sent at in an X-Ngrok-Timestamp header and an
+// X-Ngrok-Signature header with the hex HMAC-SHA256 of the timestamp, a dot
+// and the body. Receivers should reject requests whose timestamp is more than
+// a few minutes off, so that captured requests can't be replayed later.
+type Webhook struct {
+	log.Logger
+	url        string
+	secret     string
+	events     chan *WebhookEvent
+	httpClient http.Client
+}
+
+type WebhookEvent struct {
+	Event string      `json:"event"`
+	Time  string      `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+type webhookTunnel struct {
+	Url      string `json:"url"`
+	Protocol string `json:"protocol"`
+	ClientId string `json:"client_id"`
+	Duration int64  `json:"duration,omitempty"`
+}
+
+type webhookClient struct {
+	ClientId string `json:"client_id,omitempty"`
+	Addr     string `json:"addr"`
+	OS       string `json:"os,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func NewWebhook(url, secret string) *Webhook {
+	w := &Webhook{
+		Logger:     log.NewPrefixLogger("webhook"),
+		url:        url,
+		secret:     secret,
+		events:     make(chan *WebhookEvent, webhookQueueSize),
+		httpClient: http.Client{Timeout: webhookTimeout},
+	}
+
+	go w.sender()
+	return w
+}
+
+// Queues an event. Events are dropped rather than holding up the server if
+// the webhook can't keep up. Does nothing if no webhook is configured.
+func (w *Webhook) Send(event string, data interface{}) {
+	if w == nil {
+		return
+	}
+
+	e := &WebhookEvent{
+		Event: event,
+		Time:  time.Now().UTC().Format(time.RFC3339),
+		Data:  data,
+	}
+
+	select {
+	case w.events <- e:
+	default:
+		w.Warn("Queue is full, dropping %s event", event)
+	}
+}
+
+func (w *Webhook) TunnelOpened(t *Tunnel) {
+	w.Send("tunnel_opened", &webhookTunnel{Url: t.url, Protocol: t.req.Protocol, ClientId: t.ctl.id})
+}
+
+func (w *Webhook) TunnelClosed(t *Tunnel) {
+	w.Send("tunnel_closed", &webhookTunnel{
+		Url:      t.url,
+		Protocol: t.req.Protocol,
+		ClientId: t.ctl.id,
+		Duration: int64(time.Since(t.start).Seconds()),
+	})
+}
+
+func (w *Webhook) ClientConnected(c *Control) {
+	w.Send("client_connected", &webhookClient{
+		ClientId: c.id,
+		Addr:     c.conn.RemoteAddr().String(),
+		OS:       c.auth.OS,
+		Version:  c.auth.MmVersion,
+	})
+}
+
+func (w *Webhook) AuthFailed(c *Control, err error) {
+	w.Send("auth_failed", &webhookClient{
+		Addr:    c.conn.RemoteAddr().String(),
+		OS:      c.auth.OS,
+		Version: c.auth.MmVersion,
+		Error:   err.Error(),
+	})
+}
+
+// Delivers events one at a time, so that they arrive in order
+func (w *Webhook) sender() {
+	for e := range w.events {
+		body, err := json.Marshal(e)
+		if err != nil {
+			w.Error("Failed to serialize %s event: %v", e.Event, err)
+			continue
+		}
+
+		delay := webhookRetryDelay
+		for attempt := 1; ; attempt++ {
+			if err = w.post(body); err == nil {
+				break
+			}
+
+			if attempt == webhookMaxAttempts {
+				w.Error("Giving up on %s event after %d attempts: %v", e.Event, attempt, err)
+				break
+			}
+
+			w.Warn("Failed to deliver %s event, retrying in %s: %v", e.Event, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (w *Webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if w.secret != "" {
+		// signed on each attempt, so retries are as fresh as the first try
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set("X-Ngrok-Timestamp", timestamp)
+		req.Header.Set("X-Ngrok-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Got %s response: %s", resp.Status, msg)
+	}
+	return nil
+}
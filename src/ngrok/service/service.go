@@ -0,0 +1,31 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Installs, removes, starts or stops the Windows service called name, e.g.
+//
+//	ngrok service install -config=C:\ngrok\ngrok.yml start www
+//
+// The arguments after install are the ones the service runs with.
+func Command(name, description string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Specify a service command: install, uninstall, start or stop")
+	}
+
+	switch args[0] {
+	case "install":
+		return install(name, description, args[1:])
+	case "uninstall":
+		return uninstall(name)
+	case "start":
+		return start(name)
+	case "stop":
+		return stop(name)
+	default:
+		return fmt.Errorf("Unknown service command %s, must be one of: %s", args[0],
+			strings.Join([]string{"install", "uninstall", "start", "stop"}, ", "))
+	}
+}
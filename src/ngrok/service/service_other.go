@@ -0,0 +1,32 @@
+// +build !windows
+
+package service
+
+import "fmt"
+
+var errNotWindows = fmt.Errorf("Services are only supported on Windows, use your init system elsewhere")
+
+// Whether we were started by the Windows service manager
+func IsService() bool {
+	return false
+}
+
+func Run(name string, run func(), stop func()) error {
+	return errNotWindows
+}
+
+func install(name, description string, args []string) error {
+	return errNotWindows
+}
+
+func uninstall(name string) error {
+	return errNotWindows
+}
+
+func start(name string) error {
+	return errNotWindows
+}
+
+func stop(name string) error {
+	return errNotWindows
+}
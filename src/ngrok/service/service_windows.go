@@ -0,0 +1,219 @@
+package service
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// how long stop waits for the service to go away
+	stopTimeout = 30 * time.Second
+
+	// the service manager restarts us this long after we die
+	restartDelay = 5 * time.Second
+)
+
+var (
+	isService     bool
+	isServiceOnce sync.Once
+)
+
+// Whether we were started by the Windows service manager
+func IsService() bool {
+	isServiceOnce.Do(func() {
+		is, err := svc.IsWindowsService()
+		isService = err == nil && is
+	})
+	return isService
+}
+
+type handler struct {
+	run  func()
+	stop func()
+}
+
+func (h *handler) Execute(args []string, reqs <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.run()
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+	for {
+		select {
+		case <-done:
+			// we stopped without being asked to, so report a failure and
+			// let the recovery actions restart us
+			return true, 1
+
+		case req := <-reqs:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				if h.stop != nil {
+					h.stop()
+					select {
+					case <-done:
+					case <-time.After(stopTimeout):
+					}
+				}
+				return false, 0
+			}
+		}
+	}
+}
+
+// Runs as the service called name until the service manager stops it. run
+// does the work, and stop, if not nil, makes run return.
+func Run(name string, run func(), stop func()) error {
+	return svc.Run(name, &handler{run: run, stop: stop})
+}
+
+func install(name, description string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("Service %s is already installed", name)
+	}
+
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: name,
+		Description: description,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// restart after every failure, forgetting them after a day
+	actions := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: restartDelay},
+		{Type: mgr.ServiceRestart, Delay: restartDelay},
+		{Type: mgr.ServiceRestart, Delay: restartDelay},
+	}
+	if err = s.SetRecoveryActions(actions, uint32((24 * time.Hour).Seconds())); err != nil {
+		s.Delete()
+		return err
+	}
+
+	// also when we stop on our own with an error, not only when we crash
+	if err = s.SetRecoveryActionsOnNonCrashFailures(true); err != nil {
+		s.Delete()
+		return err
+	}
+
+	if err = eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("Failed to register the event log source: %v", err)
+	}
+
+	fmt.Printf("Installed service %s running %s %v\n", name, exe, args)
+	return nil
+}
+
+func uninstall(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("Service %s is not installed", name)
+	}
+	defer s.Close()
+
+	if err = s.Delete(); err != nil {
+		return err
+	}
+
+	// the service is gone either way, a stale event source is harmless
+	eventlog.Remove(name)
+
+	fmt.Printf("Uninstalled service %s\n", name)
+	return nil
+}
+
+func start(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("Service %s is not installed", name)
+	}
+	defer s.Close()
+
+	if err = s.Start(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Started service %s\n", name)
+	return nil
+}
+
+func stop(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("Service %s is not installed", name)
+	}
+	defer s.Close()
+
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(stopTimeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Service %s didn't stop within %s", name, stopTimeout)
+		}
+
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Stopped service %s\n", name)
+	return nil
+}
@@ -1,18 +1,51 @@
 package util
 
+import "sync/atomic"
+
+// how many items a listener can fall behind before the oldest are dropped
+const broadcastBuffer = 256
+
+// Sends every item to all registered listeners. Each listener has a bounded
+// buffer; when a slow listener's buffer is full, its oldest item is dropped
+// instead of blocking the broadcast or the other listeners, unless the
+// broadcast is lossless.
 type Broadcast struct {
 	listeners []chan interface{}
 	reg       chan (chan interface{})
 	unreg     chan (chan interface{})
 	in        chan interface{}
+	size      int
+	lossless  bool
+	dropped   uint64
 }
 
 func NewBroadcast() *Broadcast {
+	return newBroadcast(broadcastBuffer, false)
+}
+
+// Like NewBroadcast but each listener buffers up to size items
+func NewBoundedBroadcast(size int) *Broadcast {
+	return newBroadcast(size, false)
+}
+
+// Like NewBroadcast, but a slow listener holds up the broadcast once its
+// buffer is full instead of losing items
+func NewLosslessBroadcast() *Broadcast {
+	return newBroadcast(broadcastBuffer, true)
+}
+
+func newBroadcast(size int, lossless bool) *Broadcast {
+	if size < 1 {
+		size = 1
+	}
+
 	b := &Broadcast{
 		listeners: make([]chan interface{}, 0),
 		reg:       make(chan (chan interface{})),
 		unreg:     make(chan (chan interface{})),
 		in:        make(chan interface{}),
+		size:      size,
+		lossless:  lossless,
 	}
 
 	go func() {
@@ -35,7 +68,7 @@ func NewBroadcast() *Broadcast {
 
 			case item := <-b.in:
 				for _, l := range b.listeners {
-					l <- item
+					b.send(l, item)
 				}
 			}
 		}
@@ -44,12 +77,35 @@ func NewBroadcast() *Broadcast {
 	return b
 }
 
+// Only the broadcast goroutine sends to listeners, so once the oldest item
+// is taken out there's room for the new one
+func (b *Broadcast) send(l chan interface{}, item interface{}) {
+	if b.lossless {
+		l <- item
+		return
+	}
+
+	for {
+		select {
+		case l <- item:
+			return
+		default:
+		}
+
+		select {
+		case <-l:
+			atomic.AddUint64(&b.dropped, 1)
+		default:
+		}
+	}
+}
+
 func (b *Broadcast) In() chan interface{} {
 	return b.in
 }
 
 func (b *Broadcast) Reg() chan interface{} {
-	listener := make(chan interface{})
+	listener := make(chan interface{}, b.size)
 	b.reg <- listener
 	return listener
 }
@@ -57,3 +113,8 @@ func (b *Broadcast) Reg() chan interface{} {
 func (b *Broadcast) UnReg(listener chan interface{}) {
 	b.unreg <- listener
 }
+
+// How many items were dropped because a listener fell behind
+func (b *Broadcast) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
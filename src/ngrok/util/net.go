@@ -0,0 +1,28 @@
+package util
+
+import (
+	"net"
+	"strings"
+)
+
+// Parses a comma-separated list of CIDR networks
+func ParseNetworks(spec string) (nets []*net.IPNet, err error) {
+	for _, cidr := range strings.Split(spec, ",") {
+		var n *net.IPNet
+		if _, n, err = net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+			return
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// Reports whether ip belongs to any of the networks
+func IpInNetworks(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Tells systemd about the state of a Type=notify service, e.g. READY=1,
+// through the socket in $NOTIFY_SOCKET. It returns false without an error
+// when we weren't started by systemd.
+func SdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	// a leading @ stands for the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	if _, err = c.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// The interval systemd expects watchdog pings at, or 0 when the service has
+// no WatchdogSec or the watchdog is meant for another process
+func SdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Pings systemd's watchdog at half the interval it asks for. Each ping first
+// runs check, which should go through the locks and loops the process can't
+// work without: if they're deadlocked, check never returns, the pings stop
+// and systemd restarts us. Returns right away if there's no watchdog.
+func SdWatchdog(check func()) {
+	interval := SdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	for {
+		check()
+		SdNotify("WATCHDOG=1")
+		time.Sleep(interval / 2)
+	}
+}